@@ -0,0 +1,489 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/wave"
+)
+
+const (
+	// limiterRelease is the time constant of the limiter gain going back to unity
+	limiterRelease = 50 * time.Millisecond
+	// loudnessWindow is the sliding window of the loudness measured by the loudnorm filter
+	loudnessWindow = 10 * time.Second
+	// loudnessSmoothing is the time constant of the loudnorm gain changes
+	loudnessSmoothing = 2 * time.Second
+	// maxLoudnessGain is the highest gain in dB applied by the loudnorm filter, so silence and
+	// background noise are not brought up to the target
+	maxLoudnessGain = 20
+)
+
+// pcmFilter processes a chunk of interleaved samples normalized to [-1, 1], it can change the
+// sample rate, the number of channels and the length of the chunk
+type pcmFilter func(samples []float32, info wave.ChunkInfo) ([]float32, wave.ChunkInfo)
+
+// parseAudioFilters parses a comma separated chain of filters applied in order, f.e.
+// "volume=6,resample=48000,channels=2,loudnorm=-23,limiter=-1"
+func parseAudioFilters(chain string) (audio.TransformFunc, error) {
+	var transforms []audio.TransformFunc
+
+	for _, filter := range strings.Split(chain, ",") {
+		filter = strings.TrimSpace(filter)
+		if filter == "" {
+			continue
+		}
+
+		name, param := filter, ""
+		if i := strings.Index(filter, "="); i >= 0 {
+			name, param = filter[:i], filter[i+1:]
+		}
+		newFilter, err := newAudioFilter(strings.ToLower(name), param)
+		if err != nil {
+			return nil, fmt.Errorf("invalid audio filter %s: %w", filter, err)
+		}
+		transforms = append(transforms, pcmTransform(newFilter))
+	}
+
+	if len(transforms) == 0 {
+		return nil, nil
+	}
+	return audio.Merge(transforms...), nil
+}
+
+// newAudioFilter returns a constructor of the filter, every track gets its own filter state
+func newAudioFilter(name string, param string) (func() pcmFilter, error) {
+	number := func(defaultValue float64) (float64, error) {
+		if param == "" {
+			return defaultValue, nil
+		}
+		return strconv.ParseFloat(param, 64)
+	}
+
+	switch name {
+	case "volume":
+		// volume=dB
+		gain, err := number(0)
+		if err != nil {
+			return nil, err
+		}
+		return func() pcmFilter { return gainFilter(gain) }, nil
+
+	case "resample":
+		// resample=rate
+		rate, err := strconv.Atoi(param)
+		if err != nil {
+			return nil, err
+		}
+		if rate <= 0 {
+			return nil, fmt.Errorf("invalid sample rate %d", rate)
+		}
+		return func() pcmFilter { return newResampler(rate) }, nil
+
+	case "channels":
+		// channels=n, mono is the average of the channels and the extra channels are copies
+		channels, err := strconv.Atoi(param)
+		if err != nil {
+			return nil, err
+		}
+		if channels <= 0 {
+			return nil, fmt.Errorf("invalid number of channels %d", channels)
+		}
+		return func() pcmFilter { return channelMixer(channels) }, nil
+
+	case "limiter":
+		// limiter[=dBFS], the ceiling of the peaks, -1 by default
+		ceiling, err := number(-1)
+		if err != nil {
+			return nil, err
+		}
+		if ceiling > 0 {
+			return nil, fmt.Errorf("invalid ceiling %gdBFS, it must be 0 or less", ceiling)
+		}
+		return func() pcmFilter { return newLimiter(ceiling) }, nil
+
+	case "loudnorm":
+		// loudnorm[=LUFS], the target loudness, -23 by default as in EBU R128
+		target, err := number(-23)
+		if err != nil {
+			return nil, err
+		}
+		if target > 0 || target < -70 {
+			return nil, fmt.Errorf("invalid target loudness %gLUFS", target)
+		}
+		return func() pcmFilter { return newLoudnessNormalizer(target) }, nil
+
+	default:
+		return nil, fmt.Errorf("unknown filter, valid filters are volume|resample|channels|limiter|loudnorm")
+	}
+}
+
+// pcmTransform runs a filter on the chunks converted to float samples, keeping their
+// presentation timestamps and their sample format
+func pcmTransform(newFilter func() pcmFilter) audio.TransformFunc {
+	return func(r audio.Reader) audio.Reader {
+		filter := newFilter()
+
+		return audio.ReaderFunc(func() (chunk wave.Audio, release func(), err error) {
+			chunk, release, err = r.Read()
+			if err != nil {
+				return chunk, release, err
+			}
+			defer release()
+
+			chunk, pts, ok := splitAudioPresentationTimestamp(chunk)
+			samples, isFloat := pcmSamples(chunk)
+			samples, info := filter(samples, chunk.ChunkInfo())
+			chunk = pcmChunk(samples, info, isFloat)
+			if ok {
+				chunk = WithAudioPresentationTimestamp(chunk, pts)
+			}
+			return chunk, func() {}, nil
+		})
+	}
+}
+
+// pcmSamples returns the interleaved samples of a chunk normalized to [-1, 1] and whether they
+// were float samples
+func pcmSamples(chunk wave.Audio) ([]float32, bool) {
+	switch chunk := chunk.(type) {
+	case *wave.Int16Interleaved:
+		samples := make([]float32, len(chunk.Data))
+		for i, sample := range chunk.Data {
+			samples[i] = float32(sample) / math.MaxInt16
+		}
+		return samples, false
+	case *wave.Float32Interleaved:
+		return append([]float32(nil), chunk.Data...), true
+	}
+
+	info := chunk.ChunkInfo()
+	samples := make([]float32, info.Len*info.Channels)
+	isFloat := false
+	for i := 0; i < info.Len; i++ {
+		for ch := 0; ch < info.Channels; ch++ {
+			switch sample := chunk.At(i, ch).(type) {
+			case wave.Int16Sample:
+				samples[i*info.Channels+ch] = float32(sample) / math.MaxInt16
+			case wave.Float32Sample:
+				samples[i*info.Channels+ch] = float32(sample)
+				isFloat = true
+			}
+		}
+	}
+	return samples, isFloat
+}
+
+func pcmChunk(samples []float32, info wave.ChunkInfo, isFloat bool) wave.Audio {
+	if isFloat {
+		chunk := wave.NewFloat32Interleaved(info)
+		copy(chunk.Data, samples)
+		return chunk
+	}
+
+	chunk := wave.NewInt16Interleaved(info)
+	for i, sample := range samples {
+		chunk.Data[i] = int16(math.Max(-1, math.Min(1, float64(sample))) * math.MaxInt16)
+	}
+	return chunk
+}
+
+func dBToGain(dB float64) float64 {
+	return math.Pow(10, dB/20)
+}
+
+// smoothing returns the coefficient of a one pole filter with the given time constant
+func smoothing(timeConstant time.Duration, sampleRate int) float64 {
+	return 1 - math.Exp(-1/(timeConstant.Seconds()*float64(sampleRate)))
+}
+
+func gainFilter(dB float64) pcmFilter {
+	gain := float32(dBToGain(dB))
+	return func(samples []float32, info wave.ChunkInfo) ([]float32, wave.ChunkInfo) {
+		for i := range samples {
+			samples[i] *= gain
+		}
+		return samples, info
+	}
+}
+
+func channelMixer(channels int) pcmFilter {
+	return func(samples []float32, info wave.ChunkInfo) ([]float32, wave.ChunkInfo) {
+		if info.Channels == channels || info.Channels == 0 {
+			return samples, info
+		}
+
+		mixed := make([]float32, info.Len*channels)
+		for i := 0; i < info.Len; i++ {
+			frame := samples[i*info.Channels : (i+1)*info.Channels]
+			out := mixed[i*channels : (i+1)*channels]
+			if channels == 1 {
+				var sum float32
+				for _, sample := range frame {
+					sum += sample
+				}
+				out[0] = sum / float32(info.Channels)
+				continue
+			}
+			for ch := range out {
+				out[ch] = frame[ch%info.Channels]
+			}
+		}
+
+		info.Channels = channels
+		return mixed, info
+	}
+}
+
+// resampler converts the sample rate with linear interpolation, the position between the input
+// samples and the last input frame are kept across the chunks so there are no clicks at their
+// boundaries
+type resampler struct {
+	rate int
+	// correction changes the ratio of the conversion by a small fraction, f.e. to compensate the
+	// drift of the clock of the input, positive values produce fewer samples
+	correction float64
+
+	inputRate, channels int
+	position            float64
+	last                []float32
+}
+
+func newResampler(rate int) pcmFilter {
+	return (&resampler{rate: rate}).process
+}
+
+func (r *resampler) process(samples []float32, info wave.ChunkInfo) ([]float32, wave.ChunkInfo) {
+	if info.SamplingRate <= 0 || info.Len == 0 {
+		return samples, info
+	}
+	if info.SamplingRate != r.inputRate || info.Channels != r.channels {
+		r.inputRate, r.channels = info.SamplingRate, info.Channels
+		r.position, r.last = 0, nil
+	}
+	channels := r.channels
+	if info.SamplingRate == r.rate && r.correction == 0 {
+		r.position = 0
+		r.last = append(r.last[:0], samples[(info.Len-1)*channels:info.Len*channels]...)
+		return samples, info
+	}
+
+	// the frame before the first one of the chunk is the last one of the previous chunk
+	at := func(i int, ch int) float32 {
+		if i < 0 {
+			if r.last == nil {
+				return samples[ch]
+			}
+			return r.last[ch]
+		}
+		return samples[i*channels+ch]
+	}
+
+	step := float64(r.inputRate) / float64(r.rate) * (1 + r.correction)
+	var resampled []float32
+	for ; r.position < float64(info.Len)-1; r.position += step {
+		i := int(math.Floor(r.position))
+		fraction := float32(r.position - float64(i))
+		for ch := 0; ch < channels; ch++ {
+			a, b := at(i, ch), at(i+1, ch)
+			resampled = append(resampled, a+(b-a)*fraction)
+		}
+	}
+	r.position -= float64(info.Len)
+	r.last = append(r.last[:0], samples[(info.Len-1)*channels:info.Len*channels]...)
+
+	info.Len = len(resampled) / channels
+	info.SamplingRate = r.rate
+	return resampled, info
+}
+
+// newLimiter keeps the peaks below the ceiling, the gain drops right away on a peak and goes
+// back to unity with the release time constant
+func newLimiter(ceilingdB float64) pcmFilter {
+	ceiling := dBToGain(ceilingdB)
+	gain := 1.0
+
+	return func(samples []float32, info wave.ChunkInfo) ([]float32, wave.ChunkInfo) {
+		if info.Channels == 0 {
+			return samples, info
+		}
+		release := smoothing(limiterRelease, info.SamplingRate)
+
+		for i := 0; i < info.Len; i++ {
+			frame := samples[i*info.Channels : (i+1)*info.Channels]
+			var peak float64
+			for _, sample := range frame {
+				peak = math.Max(peak, math.Abs(float64(sample)))
+			}
+
+			target := 1.0
+			if peak*gain > ceiling {
+				target = ceiling / peak
+			}
+			if target < gain {
+				gain = target
+			} else {
+				gain += (target - gain) * release
+			}
+			for ch := range frame {
+				frame[ch] *= float32(gain)
+			}
+		}
+		return samples, info
+	}
+}
+
+// biquad is a second order filter in direct form I
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+// kWeighting returns the two stages of the K-weighting filter of ITU-R BS.1770 at the sample
+// rate, the high shelf modeling the head and the high pass of the revised low frequency B curve
+func kWeighting(sampleRate int) (biquad, biquad) {
+	k := math.Tan(math.Pi * 1681.974450955533 / float64(sampleRate))
+	q := 0.7071752369554196
+	vh := math.Pow(10, 3.999843853973347/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	k = math.Tan(math.Pi * 38.13547087602444 / float64(sampleRate))
+	q = 0.5003270373238773
+	a0 = 1 + k/q + k*k
+	highPass := biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+	return shelf, highPass
+}
+
+// newLoudnessNormalizer brings the loudness to the target. The loudness is the gated integrated
+// loudness of EBU R128 measured on the 400ms blocks of the last loudnessWindow, so it follows the
+// changes of the program, and the gain moves slowly towards it. A limiter should follow it, the
+// gain can push the peaks over full scale.
+func newLoudnessNormalizer(target float64) pcmFilter {
+	var sampleRate, channels int
+	var filters [][2]biquad
+	// the energy of the 100ms sub-blocks, the blocks are 4 sub-blocks overlapping by 75%
+	var subBlocks []float64
+	var blocks []float64
+	var energy float64
+	var count, subBlockLen int
+	gain, wanted := 1.0, 1.0
+
+	reset := func(info wave.ChunkInfo) {
+		sampleRate, channels = info.SamplingRate, info.Channels
+		filters = make([][2]biquad, channels)
+		for ch := range filters {
+			filters[ch][0], filters[ch][1] = kWeighting(sampleRate)
+		}
+		subBlocks, blocks = nil, nil
+		energy, count = 0, 0
+		subBlockLen = sampleRate / 10
+	}
+
+	measure := func() {
+		if len(blocks) == 0 {
+			return
+		}
+		// absolute gate at -70 LUFS and relative gate 10 LU below the loudness of the blocks
+		// above it
+		gated := func(threshold float64) (float64, int) {
+			var sum float64
+			var n int
+			for _, block := range blocks {
+				if block > threshold {
+					sum += block
+					n++
+				}
+			}
+			return sum, n
+		}
+		sum, n := gated(loudnessEnergy(-70))
+		if n == 0 {
+			return
+		}
+		sum, n = gated(sum / float64(n) * dBToPower(-10))
+		if n == 0 {
+			return
+		}
+		loudness := energyLoudness(sum / float64(n))
+		wanted = dBToGain(math.Min(maxLoudnessGain, target-loudness))
+	}
+
+	return func(samples []float32, info wave.ChunkInfo) ([]float32, wave.ChunkInfo) {
+		if info.SamplingRate <= 0 || info.Channels == 0 {
+			return samples, info
+		}
+		if info.SamplingRate != sampleRate || info.Channels != channels {
+			reset(info)
+		}
+		smooth := smoothing(loudnessSmoothing, sampleRate)
+
+		for i := 0; i < info.Len; i++ {
+			frame := samples[i*channels : (i+1)*channels]
+			for ch, sample := range frame {
+				y := filters[ch][1].process(filters[ch][0].process(float64(sample)))
+				energy += y * y
+			}
+
+			count++
+			if count == subBlockLen {
+				subBlocks = append(subBlocks, energy/float64(subBlockLen))
+				energy, count = 0, 0
+				if len(subBlocks) > 4 {
+					subBlocks = subBlocks[1:]
+				}
+				if len(subBlocks) == 4 {
+					blocks = append(blocks, (subBlocks[0]+subBlocks[1]+subBlocks[2]+subBlocks[3])/4)
+					if maxBlocks := int(loudnessWindow / (100 * time.Millisecond)); len(blocks) > maxBlocks {
+						blocks = blocks[len(blocks)-maxBlocks:]
+					}
+					measure()
+				}
+			}
+
+			gain += (wanted - gain) * smooth
+			for ch := range frame {
+				frame[ch] *= float32(gain)
+			}
+		}
+		return samples, info
+	}
+}
+
+func dBToPower(dB float64) float64 {
+	return math.Pow(10, dB/10)
+}
+
+// energyLoudness converts the mean square of the K-weighted samples, summed over the channels,
+// to LUFS
+func energyLoudness(energy float64) float64 {
+	return -0.691 + 10*math.Log10(energy)
+}
+
+func loudnessEnergy(loudness float64) float64 {
+	return dBToPower(loudness + 0.691)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/pion/mediadevices/pkg/wave"
+)
+
+// sine returns the interleaved samples of a sine starting at the sample start, with the same
+// value on every channel
+func sine(frequency float64, amplitude float64, rate int, channels int, start int, length int) []float32 {
+	samples := make([]float32, length*channels)
+	for i := 0; i < length; i++ {
+		value := float32(amplitude * math.Sin(2*math.Pi*frequency*float64(start+i)/float64(rate)))
+		for ch := 0; ch < channels; ch++ {
+			samples[i*channels+ch] = value
+		}
+	}
+	return samples
+}
+
+// filterSine runs a sine through the filter in chunks and returns the filtered samples
+func filterSine(filter pcmFilter, frequency float64, amplitude float64, rate int, channels int, chunk int, chunks int) ([]float32, wave.ChunkInfo) {
+	var filtered []float32
+	var info wave.ChunkInfo
+	for i := 0; i < chunks; i++ {
+		var samples []float32
+		info = wave.ChunkInfo{Len: chunk, Channels: channels, SamplingRate: rate}
+		samples, info = filter(sine(frequency, amplitude, rate, channels, i*chunk, chunk), info)
+		filtered = append(filtered, samples...)
+	}
+	return filtered, info
+}
+
+func peak(samples []float32) float64 {
+	var peak float64
+	for _, sample := range samples {
+		peak = math.Max(peak, math.Abs(float64(sample)))
+	}
+	return peak
+}
+
+func TestResampler(t *testing.T) {
+	tests := []struct {
+		input, output, channels int
+		correction              float64
+	}{
+		{48000, 48000, 2, 0},
+		{44100, 48000, 2, 0},
+		{48000, 16000, 1, 0},
+		{8000, 48000, 1, 0},
+		{48000, 48000, 1, 0.01},
+		{48000, 48000, 1, -0.01},
+	}
+	for _, test := range tests {
+		r := &resampler{rate: test.output, correction: test.correction}
+		// 1s in chunks of 10ms
+		chunk := test.input / 100
+		resampled, info := filterSine(r.process, 250, 0.5, test.input, test.channels, chunk, 100)
+
+		if info.SamplingRate != test.output || info.Channels != test.channels {
+			t.Errorf("%+v: got %+v", test, info)
+			continue
+		}
+		// the output of the last input sample is only produced with the next chunk
+		expected := float64(test.output) / (1 + test.correction)
+		if frames := len(resampled) / test.channels; math.Abs(float64(frames)-expected) > float64(test.output)/float64(test.input)+1 {
+			t.Errorf("%+v: got %d frames, expected %.0f", test, frames, expected)
+		}
+
+		// the samples follow the sine at the output rate across the chunks, the interpolation
+		// error of a 250Hz sine is under 0.005 at 8kHz and above
+		step := float64(test.input) / float64(test.output) * (1 + test.correction)
+	samples:
+		for i := 0; i < len(resampled)/test.channels; i++ {
+			ideal := 0.5 * math.Sin(2*math.Pi*250*float64(i)*step/float64(test.input))
+			for ch := 0; ch < test.channels; ch++ {
+				if diff := math.Abs(float64(resampled[i*test.channels+ch]) - ideal); diff > 0.005 {
+					t.Errorf("%+v: got %f at %d, expected %f", test, resampled[i*test.channels+ch], i, ideal)
+					break samples
+				}
+			}
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	const rate = 48000
+	tests := []struct {
+		name      string
+		ceiling   float64
+		amplitude float64
+		// expected is the peak of the output
+		expected float64
+	}{
+		{"under the ceiling", -1, 0.5, 0.5},
+		{"limited", -6, 1, dBToGain(-6)},
+		{"full scale", 0, 2, 1},
+	}
+	for _, test := range tests {
+		limited, _ := filterSine(newLimiter(test.ceiling), 1000, test.amplitude, rate, 2, rate/100, 50)
+		if got := peak(limited); math.Abs(got-test.expected) > 0.01 || got > dBToGain(test.ceiling)+1e-6 {
+			t.Errorf("%s: got a peak of %f, expected %f", test.name, got, test.expected)
+		}
+	}
+
+	// the gain goes back to unity after a peak
+	limiter := newLimiter(-6)
+	filterSine(limiter, 1000, 1, rate, 1, rate/100, 10)
+	released, _ := filterSine(limiter, 1000, 0.25, rate, 1, rate/100, 50)
+	if got := peak(released[len(released)-rate/10:]); math.Abs(got-0.25) > 0.01 {
+		t.Errorf("got a peak of %f after the release, expected 0.25", got)
+	}
+}
+
+func TestLoudnessNormalizer(t *testing.T) {
+	const rate = 48000
+	tests := []struct {
+		name      string
+		target    float64
+		amplitude float64
+		// expected is the amplitude of the output once the gain settled
+		expected float64
+	}{
+		// a 1kHz sine of amplitude 1 on each of two channels is at 0 LUFS
+		{"lowered", -23, 0.5, dBToGain(-23)},
+		{"raised", -23, 0.02, dBToGain(-23)},
+		{"other target", -16, 0.1, dBToGain(-16)},
+		{"gain capped", -23, 0.001, 0.001 * dBToGain(maxLoudnessGain)},
+		{"silence", -23, 0, 0},
+	}
+	for _, test := range tests {
+		// 20s in chunks of 10ms, the gain settles in a few smoothing time constants
+		normalized, _ := filterSine(newLoudnessNormalizer(test.target), 1000, test.amplitude, rate, 2, rate/100, 2000)
+		got := peak(normalized[len(normalized)-2*rate:])
+		if (test.expected == 0 && got != 0) || (test.expected != 0 && math.Abs(20*math.Log10(got/test.expected)) > 0.5) {
+			t.Errorf("%s: got an amplitude of %f, expected %f", test.name, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	mio "github.com/pion/mediadevices/pkg/io"
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/io/video"
+)
+
+// TrackBufferConfig configures how the raw frames of a track are shared by its readers, the
+// encoders of the peer connections and the compose, mix and switch sources reading an input.
+// Zero values keep the mediadevices defaults.
+type TrackBufferConfig struct {
+	// BufferSize is the number of frames or audio chunks kept in the ring buffer of the track.
+	// The broadcaster reads the input at the pace of the fastest reader, a reader more than
+	// BufferSize frames behind skips to the oldest buffered one, so a slow reader never stalls
+	// the others.
+	BufferSize uint
+	// CopyFrames gives every encoder its own copy of the frames, for encoders or filters that
+	// modify the frames they read
+	CopyFrames bool
+}
+
+// WithTrackBuffer sets the buffering of the raw frames of every track
+func WithTrackBuffer(config TrackBufferConfig) CodecSelectorOption {
+	return func(t *CodecSelector) {
+		t.trackBuffer = config
+	}
+}
+
+func (config TrackBufferConfig) videoBroadcaster() *video.BroadcasterConfig {
+	if config.BufferSize == 0 {
+		return nil
+	}
+	return &video.BroadcasterConfig{Core: &mio.BroadcasterConfig{BufferSize: config.BufferSize}}
+}
+
+func (config TrackBufferConfig) audioBroadcaster() *audio.BroadcasterConfig {
+	if config.BufferSize == 0 {
+		return nil
+	}
+	return &audio.BroadcasterConfig{Core: &mio.BroadcasterConfig{BufferSize: config.BufferSize}}
+}
+
+// SlowConsumerPolicy is what happens to the frames queued for a consumer, f.e. the recorder,
+// when the queue is full
+type SlowConsumerPolicy int
+
+const (
+	// DropOldest drops the oldest queued frame, the consumer skips to the latest frames
+	DropOldest SlowConsumerPolicy = iota
+	// DropNewest drops the frame that doesn't fit in the queue
+	DropNewest
+	// Block waits for the consumer, which stalls the publishing while the queue is full, for
+	// archives that must be complete
+	Block
+)
+
+var slowConsumerPolicies = []string{"drop-oldest", "drop-newest", "block"}
+
+func (policy SlowConsumerPolicy) String() string {
+	if policy < 0 || int(policy) >= len(slowConsumerPolicies) {
+		return fmt.Sprintf("SlowConsumerPolicy(%d)", int(policy))
+	}
+	return slowConsumerPolicies[policy]
+}
+
+// ParseSlowConsumerPolicy parses drop-oldest, drop-newest or block
+func ParseSlowConsumerPolicy(name string) (SlowConsumerPolicy, error) {
+	for i, policy := range slowConsumerPolicies {
+		if name == policy {
+			return SlowConsumerPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid slow consumer policy %s, valid values are drop-oldest|drop-newest|block", name)
+}
+
+// frameQueue queues the frames of a consumer applying a SlowConsumerPolicy. The items are read
+// from items.
+type frameQueue struct {
+	items     chan interface{}
+	policy    SlowConsumerPolicy
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newFrameQueue(size int, policy SlowConsumerPolicy) *frameQueue {
+	return &frameQueue{items: make(chan interface{}, size), policy: policy, done: make(chan struct{})}
+}
+
+// push queues an item and returns whether a frame was dropped, the items pushed after close
+// are dropped
+func (queue *frameQueue) push(item interface{}) bool {
+	if queue.policy == Block {
+		select {
+		case queue.items <- item:
+			return false
+		case <-queue.done:
+			return true
+		}
+	}
+
+	for dropped := false; ; {
+		select {
+		case queue.items <- item:
+			return dropped
+		default:
+		}
+		if queue.policy == DropNewest {
+			return true
+		}
+		select {
+		case <-queue.items:
+			dropped = true
+		default:
+		}
+	}
+}
+
+// close releases the producers blocked by the Block policy once the consumer has stopped
+func (queue *frameQueue) close() {
+	queue.closeOnce.Do(func() {
+		close(queue.done)
+	})
+}
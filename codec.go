@@ -4,25 +4,43 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/pion/mediadevices/pkg/codec"
 	"github.com/pion/mediadevices/pkg/io/audio"
 	"github.com/pion/mediadevices/pkg/io/video"
 	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/pion/mediadevices/pkg/wave/mixer"
 	"github.com/pion/webrtc/v3"
 )
 
 // CodecSelector is a container of video and audio encoder builders, which later will be used
 // for codec matching.
 type CodecSelector struct {
-	videoEncoders []codec.VideoEncoderBuilder
-	audioEncoders []codec.AudioEncoderBuilder
+	videoEncoders  []codec.VideoEncoderBuilder
+	audioEncoders  []codec.AudioEncoderBuilder
+	audioChannels  int
+	audioFilters   audio.TransformFunc
+	keyFramePolicy KeyFramePolicy
+
+	headerExtensions []string
+	videoRotation    int
+	videoFilters     video.TransformFunc
+	overlays         *Overlays
+
+	trackBuffer   TrackBufferConfig
+	sharedEncoder bool
+
+	pacer        *PacerFactory
+	stallTimeout time.Duration
+	clock        *mediaClock
 }
 
 // CodecSelectorOption is a type for specifying CodecSelector options
 type CodecSelectorOption func(*CodecSelector)
 
-// WithVideoEncoders replace current video codecs with listed encoders
+// WithVideoEncoders replace current video codecs with listed encoders. The order of the encoders
+// is the preference order used in the offer, the codec finally used is the one picked in the answer.
 func WithVideoEncoders(encoders ...codec.VideoEncoderBuilder) CodecSelectorOption {
 	return func(t *CodecSelector) {
 		t.videoEncoders = encoders
@@ -36,9 +54,68 @@ func WithAudioEncoders(encoders ...codec.AudioEncoderBuilder) CodecSelectorOptio
 	}
 }
 
+// WithAudioChannels mixes the audio to the given number of channels before encoding it
+func WithAudioChannels(channels int) CodecSelectorOption {
+	return func(t *CodecSelector) {
+		t.audioChannels = channels
+	}
+}
+
+// WithAudioFilters sets the filters applied to the samples of every audio input before encoding
+func WithAudioFilters(filters audio.TransformFunc) CodecSelectorOption {
+	return func(t *CodecSelector) {
+		t.audioFilters = filters
+	}
+}
+
+// WithKeyFramePolicy sets the policy applied to the keyframe requests received for video encoders
+func WithKeyFramePolicy(policy KeyFramePolicy) CodecSelectorOption {
+	return func(t *CodecSelector) {
+		t.keyFramePolicy = policy
+	}
+}
+
+// WithHeaderExtensions enables the given RTP header extensions for the published tracks
+func WithHeaderExtensions(names ...string) CodecSelectorOption {
+	return func(t *CodecSelector) {
+		t.headerExtensions = names
+	}
+}
+
+// WithVideoRotation signals the rotation of the video with the video orientation extension
+func WithVideoRotation(degrees int) CodecSelectorOption {
+	return func(t *CodecSelector) {
+		t.videoRotation = degrees
+	}
+}
+
+// WithVideoFilters sets the filters applied to the raw frames of every video input before encoding
+func WithVideoFilters(filters video.TransformFunc) CodecSelectorOption {
+	return func(t *CodecSelector) {
+		t.videoFilters = filters
+	}
+}
+
+// WithOverlays draws the text and image overlays on the frames of every video input, after the
+// video filters
+func WithOverlays(overlays *Overlays) CodecSelectorOption {
+	return func(t *CodecSelector) {
+		t.overlays = overlays
+	}
+}
+
+// WithPacer registers the given pacers with the interceptors, so the packets of every peer
+// connection go through its own pacer instead of being written right away
+func WithPacer(pacer *PacerFactory) CodecSelectorOption {
+	return func(t *CodecSelector) {
+		t.pacer = pacer
+	}
+}
+
 // NewCodecSelector constructs CodecSelector with given variadic options
 func NewCodecSelector(opts ...CodecSelectorOption) *CodecSelector {
 	var track CodecSelector
+	track.clock = &mediaClock{}
 
 	for _, opt := range opts {
 		opt(&track)
@@ -49,13 +126,27 @@ func NewCodecSelector(opts ...CodecSelectorOption) *CodecSelector {
 
 // Populate lets the webrtc engine be aware of supported codecs that are contained in CodecSelector
 func (selector *CodecSelector) Populate(setting *webrtc.MediaEngine) {
+	payloadTypes := make(map[webrtc.PayloadType]bool)
 	for _, encoder := range selector.videoEncoders {
-		setting.RegisterCodec(encoder.RTPCodec().RTPCodecParameters, webrtc.RTPCodecTypeVideo)
+		parameters := encoder.RTPCodec().RTPCodecParameters
+		// Only the first encoder for a given payload type can be offered
+		if payloadTypes[parameters.PayloadType] {
+			continue
+		}
+		payloadTypes[parameters.PayloadType] = true
+		setting.RegisterCodec(parameters, webrtc.RTPCodecTypeVideo)
 	}
 
 	for _, encoder := range selector.audioEncoders {
 		setting.RegisterCodec(encoder.RTPCodec().RTPCodecParameters, webrtc.RTPCodecTypeAudio)
 	}
+
+	for _, name := range selector.headerExtensions {
+		extension := headerExtensions[name]
+		for _, kind := range extension.kinds {
+			setting.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension.uri}, kind)
+		}
+	}
 }
 
 // selectVideoCodecByNames selects a single codec that can be built and matched. codecNames can be formatted as "video/<codecName>" or "<codecName>"
@@ -106,6 +197,11 @@ func (selector *CodecSelector) selectAudioCodecByNames(reader audio.Reader, inpu
 	var errReasons []string
 	var err error
 
+	if selector.audioChannels > 0 && inputProp.ChannelCount != selector.audioChannels {
+		reader = audio.NewChannelMixer(selector.audioChannels, &mixer.MonoMixer{})(reader)
+		inputProp.ChannelCount = selector.audioChannels
+	}
+
 outer:
 	for _, wantCodec := range codecNames {
 		wantCodecLower := strings.ToLower(wantCodec)
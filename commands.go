@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Command is a command typed on the standard input while publishing, f.e. "layout pip"
+type Command struct {
+	// Usage lists the arguments of the command
+	Usage       string
+	Description string
+	Run         func(args []string) error
+}
+
+var (
+	commandsMu sync.RWMutex
+	commands   = make(map[string]*Command)
+)
+
+// RegisterCommand makes a command available on the standard input. It panics if the name is
+// already registered, like RegisterSource.
+func RegisterCommand(name string, command Command) {
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+
+	if command.Run == nil {
+		panic("RegisterCommand: missing Run for command " + name)
+	}
+	if _, ok := commands[name]; ok {
+		panic("RegisterCommand: command registered twice " + name)
+	}
+	commands[name] = &command
+}
+
+// RunCommand runs a command line, the name of the command followed by its arguments
+func RunCommand(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	commandsMu.RLock()
+	command, ok := commands[fields[0]]
+	commandsMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown command %s, valid commands are %s", fields[0], strings.Join(commandNames(), "|"))
+	}
+	if err := command.Run(fields[1:]); err != nil {
+		return fmt.Errorf("%s: %w, usage: %s %s", fields[0], err, fields[0], command.Usage)
+	}
+	return nil
+}
+
+// CommandUsage describes the registered commands
+func CommandUsage() string {
+	var usage strings.Builder
+
+	for _, name := range commandNames() {
+		commandsMu.RLock()
+		command := commands[name]
+		commandsMu.RUnlock()
+
+		fmt.Fprintf(&usage, "  %s %s: %s\n", name, command.Usage, command.Description)
+	}
+	return usage.String()
+}
+
+func commandNames() []string {
+	commandsMu.RLock()
+	defer commandsMu.RUnlock()
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
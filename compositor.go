@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/io/video"
+)
+
+// compositorLayouts are the layouts of the compositor inputs on the canvas
+var compositorLayouts = []string{"side-by-side", "pip", "grid"}
+
+func init() {
+	RegisterSource("compose", SourceFactory{
+		Description: "video inputs separated by | composited on one canvas, f.e. compose:y4m:/tmp/slides.y4m|unix:///tmp/camera.sock?format=framed?layout=pip, " +
+			"the options of the compositor go after the ones of the last input, they are taken by the compositor when they are all compositor options",
+		Kinds: videoKinds,
+		Options: []SourceOption{
+			{"layout", "side-by-side", "layout of the inputs side-by-side|pip|grid"},
+			{"main", "0", "index of the full canvas input of the pip layout"},
+			{"width", "1280", "width of the canvas"},
+			{"height", "720", "height of the canvas"},
+			{"fps", "30", "frame rate of the canvas"},
+		},
+		NewTrack: func(uri *SourceURI, kind mediadevices.MediaDeviceType, selector *CodecSelector) (mediadevices.Track, error) {
+			return newCompositorTrack(uri, selector)
+		},
+	})
+	RegisterCommand("layout", Command{
+		Usage:       strings.Join(compositorLayouts, "|") + " [main input]",
+		Description: "change the layout of the compose inputs",
+		Run: func(args []string) error {
+			if len(args) == 0 || len(args) > 2 {
+				return fmt.Errorf("invalid number of arguments")
+			}
+			main := -1
+			if len(args) == 2 {
+				var err error
+				if main, err = strconv.Atoi(args[1]); err != nil || main < 0 {
+					return fmt.Errorf("invalid main input %s", args[1])
+				}
+			}
+
+			compositorsMu.Lock()
+			defer compositorsMu.Unlock()
+			if len(compositors) == 0 {
+				return fmt.Errorf("there is no compose input")
+			}
+			// none of the compositors is changed when the layout is invalid for one of them
+			for _, c := range compositors {
+				if err := c.validateLayout(args[0], main); err != nil {
+					return err
+				}
+			}
+			for _, c := range compositors {
+				if err := c.setLayout(args[0], main); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
+
+var (
+	compositorsMu sync.Mutex
+	compositors   []*compositor
+)
+
+// compositor draws the latest frame of each input on a canvas at a constant frame rate
+type compositor struct {
+	size      image.Point
+	frameRate int
+	inputs    []*compositorInput
+	tracks    inputTracks
+
+	mu     sync.Mutex
+	layout string
+	main   int
+}
+
+// compositorInput keeps the latest frame of an input and the scaler of its current cell
+type compositorInput struct {
+	name string
+
+	mu    sync.Mutex
+	frame *image.YCbCr
+
+	// only used by the compositor reader
+	current image.Image
+	cell    image.Rectangle
+	scaled  video.Reader
+}
+
+func newCompositorTrack(uri *SourceURI, selector *CodecSelector) (mediadevices.Track, error) {
+	c := &compositor{layout: uri.Option("layout")}
+
+	var values [4]int
+	for i, name := range []string{"main", "width", "height", "fps"} {
+		value, err := uri.IntOption(name)
+		if err != nil {
+			return nil, err
+		}
+		if value < 0 || value == 0 && name != "main" {
+			return nil, fmt.Errorf("invalid %s option %d of %s input", name, value, uri.Scheme)
+		}
+		values[i] = value
+	}
+	c.main, c.size, c.frameRate = values[0], image.Pt(even(values[1]), even(values[2])), values[3]
+
+	names := splitSourceInputs(uri.Path)
+	if len(names) == 0 {
+		return nil, fmt.Errorf("invalid %s input: missing inputs", uri)
+	}
+	if err := c.setLayout(c.layout, c.main); err != nil {
+		return nil, err
+	}
+	if c.main >= len(names) {
+		return nil, fmt.Errorf("invalid main option %d of %s input, there are %d inputs", c.main, uri.Scheme, len(names))
+	}
+
+	// the filters and the overlays of the selector are applied once, on the canvas
+	inputSelector := *selector
+	inputSelector.videoFilters = nil
+	inputSelector.overlays = nil
+	inputSelector.stallTimeout = 0
+
+	for _, name := range names {
+		track, err := newSourceTrack(name, mediadevices.VideoInput, &inputSelector)
+		if err != nil {
+			c.tracks.Close()
+			return nil, fmt.Errorf("invalid compose input %s: %w", name, err)
+		}
+		c.tracks = append(c.tracks, track)
+		videoTrack, ok := track.(*VideoTrack)
+		if !ok {
+			c.tracks.Close()
+			return nil, fmt.Errorf("invalid compose input %s: only video tracks are accepted, got a %T track", name, track)
+		}
+
+		input := &compositorInput{name: name}
+		go input.run(videoTrack.NewReader(false))
+		c.inputs = append(c.inputs, input)
+	}
+
+	compositorsMu.Lock()
+	compositors = append(compositors, c)
+	compositorsMu.Unlock()
+
+	return newVideoTrackFromReader(&closableVideoReader{Reader: c.reader(selector), Closer: c}, selector), nil
+}
+
+// Close closes the inputs and removes the compositor from the ones changed by the layout command
+func (c *compositor) Close() error {
+	compositorsMu.Lock()
+	for i, registered := range compositors {
+		if registered == c {
+			compositors = append(compositors[:i], compositors[i+1:]...)
+			break
+		}
+	}
+	compositorsMu.Unlock()
+
+	return c.tracks.Close()
+}
+
+// validateLayout checks the layout and the main input, a negative main keeps the current main
+// input
+func (c *compositor) validateLayout(layout string, main int) error {
+	valid := false
+	for _, name := range compositorLayouts {
+		valid = valid || name == layout
+	}
+	if !valid {
+		return fmt.Errorf("invalid layout %s, valid values are %s", layout, strings.Join(compositorLayouts, "|"))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inputs != nil && main >= len(c.inputs) {
+		return fmt.Errorf("invalid main input %d, there are %d inputs", main, len(c.inputs))
+	}
+	return nil
+}
+
+// setLayout changes the layout, a negative main keeps the current main input
+func (c *compositor) setLayout(layout string, main int) error {
+	if err := c.validateLayout(layout, main); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if main < 0 {
+		main = c.main
+	}
+	c.layout, c.main = layout, main
+	return nil
+}
+
+// run keeps the latest frame of the input, the last one is shown when the input stops
+func (input *compositorInput) run(r video.Reader) {
+	for {
+		img, release, err := r.Read()
+		if err != nil {
+			log.Printf("Compose input %s stopped: %v\n", input.name, err)
+			return
+		}
+		img, _, _ = splitPresentationTimestamp(img)
+		frame := copyYCbCr(toYCbCr420(img))
+		release()
+
+		input.mu.Lock()
+		input.frame = frame
+		input.mu.Unlock()
+	}
+}
+
+// cells returns the rectangles of the inputs in drawing order, later ones are drawn on top
+func (c *compositor) cells() ([]int, []image.Rectangle) {
+	c.mu.Lock()
+	layout, main := c.layout, c.main
+	c.mu.Unlock()
+
+	n := len(c.inputs)
+	width, height := c.size.X, c.size.Y
+	var order []int
+	var cells []image.Rectangle
+
+	switch layout {
+	case "pip":
+		order = append(order, main)
+		cells = append(cells, image.Rectangle{Max: c.size})
+		// the other inputs are stacked from the bottom right corner
+		margin := even(height / 40)
+		cell := image.Pt(even(width/4), even(height/4))
+		for i := 0; i < n; i++ {
+			if i == main {
+				continue
+			}
+			corner := image.Pt(width-margin, height-len(order)*margin-(len(order)-1)*cell.Y)
+			order = append(order, i)
+			cells = append(cells, image.Rectangle{Min: corner.Sub(cell), Max: corner})
+		}
+
+	default:
+		columns, rows := n, 1
+		if layout == "grid" {
+			columns = int(math.Ceil(math.Sqrt(float64(n))))
+			rows = (n + columns - 1) / columns
+		}
+		for i := 0; i < n; i++ {
+			column, row := i%columns, i/columns
+			order = append(order, i)
+			cells = append(cells, image.Rect(
+				(width*column/columns)&^1, (height*row/rows)&^1,
+				(width*(column+1)/columns)&^1, (height*(row+1)/rows)&^1,
+			))
+		}
+	}
+	return order, cells
+}
+
+// reader draws the canvas at the frame rate, timestamped on the media clock
+func (c *compositor) reader(selector *CodecSelector) video.Reader {
+	frameDuration := time.Second / time.Duration(c.frameRate)
+	var start time.Duration
+	var frames int64
+
+	return video.ReaderFunc(func() (img image.Image, release func(), err error) {
+		if frames == 0 {
+			start = selector.clock.now()
+		}
+		pts := start + time.Duration(frames)*frameDuration
+		if wait := pts - selector.clock.now(); wait > 0 {
+			time.Sleep(wait)
+		}
+		frames++
+
+		canvas := newBlackFrame(image.Rectangle{Max: c.size})
+		order, cells := c.cells()
+		for i, index := range order {
+			input := c.inputs[index]
+			input.mu.Lock()
+			frame := input.frame
+			input.mu.Unlock()
+			if frame == nil || cells[i].Empty() {
+				continue
+			}
+
+			scaled, err := input.fit(frame, cells[i])
+			if err != nil {
+				log.Printf("Compose input %s cannot be scaled: %v\n", input.name, err)
+				continue
+			}
+			// centered in the cell keeping its aspect ratio
+			offset := cells[i].Size().Sub(scaled.Rect.Size()).Div(2)
+			pasteFrame(canvas, scaled, cells[i].Min.Add(image.Pt(offset.X&^1, offset.Y&^1)))
+		}
+
+		return WithPresentationTimestamp(canvas, pts), func() {}, nil
+	})
+}
+
+// fit scales the frame to fit in the cell keeping its aspect ratio, the scaler is created again
+// when the cell or the size of the input change
+func (input *compositorInput) fit(frame *image.YCbCr, cell image.Rectangle) (*image.YCbCr, error) {
+	if input.scaled == nil || cell != input.cell || frame.Rect.Size() != input.current.Bounds().Size() {
+		size, target := frame.Rect.Size(), cell.Size()
+		fit := image.Pt(target.X, size.Y*target.X/size.X)
+		if fit.Y > target.Y {
+			fit = image.Pt(size.X*target.Y/size.Y, target.Y)
+		}
+		input.cell = cell
+		input.scaled = video.Scale(even(fit.X), even(fit.Y), video.ScalerFastBoxSampling)(video.ReaderFunc(func() (image.Image, func(), error) {
+			return input.current, func() {}, nil
+		}))
+	}
+
+	input.current = frame
+	img, _, err := input.scaled.Read()
+	if err != nil {
+		return nil, err
+	}
+	return toYCbCr420(img), nil
+}
+
+// pasteFrame copies the frame on the canvas at an even position, clipped to the canvas
+func pasteFrame(canvas *image.YCbCr, frame *image.YCbCr, at image.Point) {
+	rect := image.Rectangle{Min: at, Max: at.Add(frame.Rect.Size())}.Intersect(canvas.Rect)
+	if rect.Empty() {
+		return
+	}
+	from := rect.Min.Sub(at)
+
+	for row := 0; row < rect.Dy(); row++ {
+		dst := canvas.YOffset(rect.Min.X, rect.Min.Y+row)
+		copy(canvas.Y[dst:dst+rect.Dx()], frame.Y[frame.YOffset(from.X, from.Y+row):])
+	}
+	chromaWidth := (rect.Dx() + 1) / 2
+	for row := 0; row < (rect.Dy()+1)/2; row++ {
+		dst := canvas.COffset(rect.Min.X, rect.Min.Y+row*2)
+		src := frame.COffset(from.X, from.Y+row*2)
+		copy(canvas.Cb[dst:dst+chromaWidth], frame.Cb[src:])
+		copy(canvas.Cr[dst:dst+chromaWidth], frame.Cr[src:])
+	}
+}
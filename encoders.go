@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/codec/aom"
+)
+
+// EncoderConfig contains the tuning options of the video and audio encoders. Zero values
+// keep the defaults of each encoder, except OpusComplexity that is -1 for the default.
+type EncoderConfig struct {
+	VideoBitrate     int
+	KeyFrameInterval int
+	// RateControl is one of cbr, vbr or crf, VP8, VP9 and H.264 expose it
+	RateControl string
+	// CRF is the constant quality used when RateControl is crf, 0-63 for VP8 and VP9 and 0-51
+	// for H.264
+	CRF int
+
+	// VPXDeadline and VPXCPUUsed are the deadline and the cpu-used of VP8 and VP9
+	VPXDeadline time.Duration
+	VPXCPUUsed  int
+	// VP9TemporalLayers and VP9SpatialLayers are the scalability layers of VP9, 1 to 3
+	VP9TemporalLayers int
+	VP9SpatialLayers  int
+
+	X264Preset  string
+	X264Profile string
+	X264Tune    string
+
+	OpusBitrate       int
+	OpusFrameDuration time.Duration
+	OpusStereo        bool
+	// OpusComplexity is 0-10, -1 keeps the libopus default
+	OpusComplexity int
+	OpusDTX        bool
+}
+
+var opusFrameDurations = []time.Duration{
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	40 * time.Millisecond,
+	60 * time.Millisecond,
+}
+
+// parseVideoCodecs splits a comma separated list of codec names keeping the preference order
+func parseVideoCodecs(list string) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("video codec %s listed more than once", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no video codec specified")
+	}
+
+	return names, nil
+}
+
+// newVideoEncoders builds the encoder builders for the given codec names, in the same order
+func newVideoEncoders(names []string, config EncoderConfig) ([]codec.VideoEncoderBuilder, error) {
+	encoders := make([]codec.VideoEncoderBuilder, 0, len(names))
+
+	if config.VP9TemporalLayers > 1 || config.VP9SpatialLayers > 1 {
+		vp9Listed := false
+		for _, name := range names {
+			vp9Listed = vp9Listed || name == "vp9"
+		}
+		if !vp9Listed {
+			return nil, fmt.Errorf("layers are only supported by vp9, which is not a video codec")
+		}
+	}
+
+	for _, name := range names {
+		encoder, err := newVideoEncoder(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := config.applyVideo(encoder); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		encoders = append(encoders, encoder)
+	}
+
+	return encoders, nil
+}
+
+func newVideoEncoder(name string) (codec.VideoEncoderBuilder, error) {
+	switch name {
+	case "vp8":
+		return newVP8Params(), nil
+	case "vp9":
+		return newVP9Params(), nil
+	case "h264":
+		return newX264Params(), nil
+	case "av1":
+		params, err := aom.NewParams()
+		if err != nil {
+			return nil, err
+		}
+		return &params, nil
+	default:
+		return nil, fmt.Errorf("unsupported video codec %s, valid values are vp8|vp9|h264|av1", name)
+	}
+}
+
+// newAudioEncoders builds the audio encoder builders
+func newAudioEncoders(config EncoderConfig) ([]codec.AudioEncoderBuilder, error) {
+	params := newOpusParams()
+	if err := config.applyOpus(params); err != nil {
+		return nil, fmt.Errorf("opus: %w", err)
+	}
+
+	return []codec.AudioEncoderBuilder{params}, nil
+}
+
+// applyVideo validates the configuration against the params type of the encoder and sets
+// the options supported by it
+func (config EncoderConfig) applyVideo(encoder codec.VideoEncoderBuilder) error {
+	switch params := encoder.(type) {
+	case *vpxParams:
+		return config.applyVPX(params)
+	case *x264Params:
+		return config.applyX264(params)
+	case *aom.Params:
+		// every codec offered must honor the rate control, whichever one the server selects
+		if config.RateControl != "" {
+			return fmt.Errorf("rate control %s is not supported, the encoder keeps its own", config.RateControl)
+		}
+		config.applyBase(&params.BaseParams)
+	default:
+		return fmt.Errorf("unsupported encoder params %T", encoder)
+	}
+
+	return nil
+}
+
+func (config EncoderConfig) applyBase(params *codec.BaseParams) {
+	if config.VideoBitrate > 0 {
+		params.BitRate = config.VideoBitrate
+	}
+	if config.KeyFrameInterval > 0 {
+		params.KeyFrameInterval = config.KeyFrameInterval
+	}
+}
+
+func (config EncoderConfig) applyVPX(params *vpxParams) error {
+	config.applyBase(&params.BaseParams)
+
+	if err := config.validateRateControl(63); err != nil {
+		return err
+	}
+	params.RateControl, params.CRF = config.RateControl, config.CRF
+
+	maxCPUUsed := 16
+	if params.vp9 {
+		maxCPUUsed = 9
+	}
+	if config.VPXCPUUsed < -maxCPUUsed || config.VPXCPUUsed > maxCPUUsed {
+		return fmt.Errorf("invalid cpu-used %d, valid range is %d-%d", config.VPXCPUUsed, -maxCPUUsed, maxCPUUsed)
+	}
+	params.CPUUsed = config.VPXCPUUsed
+
+	if params.vp9 {
+		for _, layers := range []int{config.VP9TemporalLayers, config.VP9SpatialLayers} {
+			if layers < 0 || layers > 3 {
+				return fmt.Errorf("invalid number of layers %d, valid range is 1-3", layers)
+			}
+		}
+		params.TemporalLayers, params.SpatialLayers = config.VP9TemporalLayers, config.VP9SpatialLayers
+		if params.layered() && config.RateControl != "" && config.RateControl != "cbr" {
+			return fmt.Errorf("rate control %s is not supported with layers, the layers are only encoded in cbr", config.RateControl)
+		}
+	}
+
+	if config.VPXDeadline < 0 {
+		return fmt.Errorf("invalid deadline %s", config.VPXDeadline)
+	}
+	if config.VPXDeadline > 0 {
+		params.Deadline = config.VPXDeadline
+	}
+
+	return nil
+}
+
+func (config EncoderConfig) applyX264(params *x264Params) error {
+	config.applyBase(&params.BaseParams)
+
+	if err := config.validateRateControl(51); err != nil {
+		return err
+	}
+	params.RateControl, params.CRF = config.RateControl, config.CRF
+
+	if config.X264Preset != "" {
+		if !containsString(x264Presets, config.X264Preset) {
+			return fmt.Errorf("invalid x264 preset %s, valid values are %s", config.X264Preset, strings.Join(x264Presets, "|"))
+		}
+		params.Preset = config.X264Preset
+	}
+	if config.X264Profile != "" {
+		if _, ok := x264ProfileLevelIDs[config.X264Profile]; !ok {
+			return fmt.Errorf("invalid x264 profile %s, valid values are baseline|main|high", config.X264Profile)
+		}
+		params.Profile = config.X264Profile
+	}
+	if config.X264Tune != "" {
+		for _, tune := range strings.Split(config.X264Tune, ",") {
+			if !containsString(x264Tunes, tune) {
+				return fmt.Errorf("invalid x264 tune %s, valid values are %s", tune, strings.Join(x264Tunes, "|"))
+			}
+		}
+		params.Tune = config.X264Tune
+	}
+
+	return nil
+}
+
+// validateRateControl checks the rate control mode, and the crf against the range of the encoder
+func (config EncoderConfig) validateRateControl(maxCRF int) error {
+	switch config.RateControl {
+	case "", "cbr", "vbr":
+	case "crf":
+		if config.CRF < 0 || config.CRF > maxCRF {
+			return fmt.Errorf("invalid crf %d, valid range is 0-%d", config.CRF, maxCRF)
+		}
+	default:
+		return fmt.Errorf("invalid rate control %s, valid values are cbr|vbr|crf", config.RateControl)
+	}
+	return nil
+}
+
+func (config EncoderConfig) applyOpus(params *opusParams) error {
+	if config.OpusBitrate < 0 {
+		return fmt.Errorf("invalid bitrate %d", config.OpusBitrate)
+	}
+	if config.OpusBitrate > 0 {
+		params.BitRate = config.OpusBitrate
+	}
+
+	if config.OpusFrameDuration != 0 {
+		valid := false
+		for _, duration := range opusFrameDurations {
+			if config.OpusFrameDuration == duration {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("invalid frame duration %s, valid values are 2.5ms|5ms|10ms|20ms|40ms|60ms", config.OpusFrameDuration)
+		}
+		params.Latency = config.OpusFrameDuration
+	}
+
+	if config.OpusComplexity < -1 || config.OpusComplexity > 10 {
+		return fmt.Errorf("invalid complexity %d, valid range is 0-10", config.OpusComplexity)
+	}
+	params.Complexity = config.OpusComplexity
+	params.DTX = config.OpusDTX
+
+	return nil
+}
+
+// audioChannels returns the number of channels the audio is mixed to before encoding
+func (config EncoderConfig) audioChannels() int {
+	if config.OpusStereo {
+		return 2
+	}
+	return 1
+}
+
+// svcLayerBitrates splits the bitrate of a VP9 stream between its layers, in the order of the
+// layer_target_bitrate of libvpx: the temporal layers of the first spatial layer, then the ones of
+// the next. Each spatial layer has twice the bitrate of the one below it, and the bitrates of its
+// temporal layers include the layers below them, with 60% for the base of two layers, or 40% and
+// 60% for the lower two of three.
+func svcLayerBitrates(bitrate int, spatialLayers int, temporalLayers int) []int {
+	temporalShares := map[int][]int{1: {100}, 2: {60, 100}, 3: {40, 60, 100}}[temporalLayers]
+
+	bitrates := make([]int, 0, spatialLayers*temporalLayers)
+	spatialShares := 1<<spatialLayers - 1
+	for s := 0; s < spatialLayers; s++ {
+		spatialBitrate := bitrate * (1 << s) / spatialShares
+		for _, share := range temporalShares {
+			bitrates = append(bitrates, spatialBitrate*share/100)
+		}
+	}
+	return bitrates
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/pion/mediadevices/pkg/wave"
+)
+
+func TestSVCLayerBitrates(t *testing.T) {
+	tests := []struct {
+		spatial, temporal int
+		expected          []int
+	}{
+		{1, 1, []int{1400}},
+		{1, 2, []int{840, 1400}},
+		{1, 3, []int{560, 840, 1400}},
+		{2, 1, []int{466, 933}},
+		{3, 2, []int{120, 200, 240, 400, 480, 800}},
+	}
+	for _, test := range tests {
+		if bitrates := svcLayerBitrates(1400, test.spatial, test.temporal); !reflect.DeepEqual(bitrates, test.expected) {
+			t.Errorf("%d spatial and %d temporal layers: got %v, expected %v", test.spatial, test.temporal, bitrates, test.expected)
+		}
+	}
+}
+
+func TestVP9LayersConfig(t *testing.T) {
+	tests := []struct {
+		names  []string
+		config EncoderConfig
+		valid  bool
+	}{
+		{[]string{"vp9"}, EncoderConfig{VP9TemporalLayers: 3, VP9SpatialLayers: 2}, true},
+		{[]string{"vp9", "vp8"}, EncoderConfig{VP9TemporalLayers: 2, RateControl: "cbr"}, true},
+		{[]string{"vp8"}, EncoderConfig{VP9TemporalLayers: 2}, false},
+		{[]string{"vp9"}, EncoderConfig{VP9SpatialLayers: 4}, false},
+		{[]string{"vp9"}, EncoderConfig{VP9SpatialLayers: 2, RateControl: "vbr"}, false},
+	}
+	for _, test := range tests {
+		_, err := newVideoEncoders(test.names, test.config)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%v %+v: got error %v", test.names, test.config, err)
+		}
+	}
+}
+
+func TestVideoEncodersConfig(t *testing.T) {
+	tests := []struct {
+		names  []string
+		config EncoderConfig
+		valid  bool
+	}{
+		{[]string{"vp8", "vp9", "h264"}, EncoderConfig{RateControl: "crf", CRF: 40}, true},
+		{[]string{"h264"}, EncoderConfig{RateControl: "crf", CRF: 52}, false},
+		{[]string{"vp9"}, EncoderConfig{RateControl: "crf", CRF: 63}, true},
+		{[]string{"vp8", "av1"}, EncoderConfig{RateControl: "cbr"}, false},
+		{[]string{"av1"}, EncoderConfig{}, true},
+		{[]string{"vp8"}, EncoderConfig{RateControl: "abr"}, false},
+		{[]string{"vp8"}, EncoderConfig{VPXCPUUsed: -16}, true},
+		{[]string{"vp9"}, EncoderConfig{VPXCPUUsed: 10}, false},
+		{[]string{"vp8"}, EncoderConfig{VPXDeadline: -time.Millisecond}, false},
+		{[]string{"h264"}, EncoderConfig{X264Preset: "veryfast", X264Profile: "main", X264Tune: "film,fastdecode"}, true},
+		{[]string{"h264"}, EncoderConfig{X264Preset: "quick"}, false},
+		{[]string{"h264"}, EncoderConfig{X264Profile: "high10"}, false},
+		{[]string{"h264"}, EncoderConfig{X264Tune: "film,cartoon"}, false},
+	}
+	for _, test := range tests {
+		_, err := newVideoEncoders(test.names, test.config)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%v %+v: got error %v", test.names, test.config, err)
+		}
+	}
+}
+
+func TestX264ProfileLevelID(t *testing.T) {
+	tests := []struct {
+		profile string
+		fmtp    string
+	}{
+		{"", "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+		{"baseline", "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+		{"main", "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=4d001f"},
+		{"high", "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=64001f"},
+	}
+	for _, test := range tests {
+		params := newX264Params()
+		params.Profile = test.profile
+		if fmtp := params.RTPCodec().SDPFmtpLine; fmtp != test.fmtp {
+			t.Errorf("profile %q: got %s, expected %s", test.profile, fmtp, test.fmtp)
+		}
+	}
+}
+
+func TestOpusConfig(t *testing.T) {
+	tests := []struct {
+		config EncoderConfig
+		valid  bool
+	}{
+		{EncoderConfig{OpusComplexity: -1}, true},
+		{EncoderConfig{OpusComplexity: 10, OpusDTX: true}, true},
+		{EncoderConfig{OpusComplexity: 11}, false},
+		{EncoderConfig{OpusComplexity: -1, OpusFrameDuration: 30 * time.Millisecond}, false},
+	}
+	for _, test := range tests {
+		_, err := newAudioEncoders(test.config)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%+v: got error %v", test.config, err)
+		}
+	}
+}
+
+func TestOpusDTX(t *testing.T) {
+	silence := audio.ReaderFunc(func() (wave.Audio, func(), error) {
+		return wave.NewInt16Interleaved(wave.ChunkInfo{Len: 960, Channels: 1, SamplingRate: 48000}), func() {}, nil
+	})
+	params := newOpusParams()
+	params.DTX = true
+	if fmtp := params.RTPCodec().SDPFmtpLine; fmtp != "minptime=10;useinbandfec=1;usedtx=1" {
+		t.Errorf("got fmtp %s", fmtp)
+	}
+	encoder, err := params.BuildAudioEncoder(silence, prop.Media{Audio: prop.Audio{SampleRate: 48000, ChannelCount: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+
+	// libopus starts the discontinuous transmission after 200ms of silence
+	dtx := 0
+	for i := 0; i < 50; i++ {
+		data, _, err := encoder.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) <= 2 {
+			dtx++
+		}
+	}
+	if dtx == 0 {
+		t.Error("no frame of silence was encoded as a DTX frame")
+	}
+}
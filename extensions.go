@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/wave"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	absSendTimeURI      = "http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time"
+	transportCCURI      = "http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01"
+	audioLevelURI       = "urn:ietf:params:rtp-hdrext:ssrc-audio-level"
+	videoOrientationURI = "urn:3gpp:video-orientation"
+)
+
+type headerExtension struct {
+	uri   string
+	kinds []webrtc.RTPCodecType
+}
+
+// headerExtensions are the RTP header extensions that can be enabled by name
+var headerExtensions = map[string]headerExtension{
+	"abs-send-time":     {absSendTimeURI, []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio}},
+	"transport-cc":      {transportCCURI, []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio}},
+	"audio-level":       {audioLevelURI, []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio}},
+	"video-orientation": {videoOrientationURI, []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo}},
+}
+
+// parseHeaderExtensions validates a comma separated list of header extension names
+func parseHeaderExtensions(list string) ([]string, error) {
+	var names []string
+
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := headerExtensions[name]; !ok {
+			return nil, fmt.Errorf("unsupported header extension %s, valid values are abs-send-time|transport-cc|audio-level|video-orientation", name)
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// validateRotation checks the rotation is one of the values that can be signaled with CVO
+func validateRotation(degrees int) error {
+	switch degrees {
+	case 0, 90, 180, 270:
+		return nil
+	default:
+		return fmt.Errorf("invalid rotation %d, valid values are 0|90|180|270", degrees)
+	}
+}
+
+// RegisterInterceptors adds the sender reports used by the receivers to synchronize the tracks,
+// the interceptors needed by the enabled header extensions and the pacer
+func (selector *CodecSelector) RegisterInterceptors(mediaEngine *webrtc.MediaEngine, registry *interceptor.Registry) error {
+	if err := webrtc.ConfigureRTCPReports(registry); err != nil {
+		return err
+	}
+
+	for _, name := range selector.headerExtensions {
+		if name == "transport-cc" {
+			// the transport wide sequence numbers are set by the interceptor, not by the track
+			if err := webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, registry); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the last interceptor registered is the first one to see the packets, so the others see
+	// them leaving the pacer
+	if selector.pacer != nil {
+		registry.Add(selector.pacer)
+	}
+	return nil
+}
+
+// audioLevelReader is implemented by the readers that know the audio level of the last read
+type audioLevelReader interface {
+	AudioLevel() uint8
+}
+
+// headerExtensionWriter sets the negotiated header extensions on the outgoing packets of a track
+type headerExtensionWriter struct {
+	absSendTimeID      uint8
+	audioLevelID       uint8
+	videoOrientationID uint8
+	orientation        byte
+}
+
+func newHeaderExtensionWriter(negotiated []webrtc.RTPHeaderExtensionParameter, rotation int) *headerExtensionWriter {
+	writer := &headerExtensionWriter{
+		// R1 R0 bits of the CVO byte
+		orientation: byte(rotation/90) & 0x03,
+	}
+
+	for _, extension := range negotiated {
+		switch extension.URI {
+		case absSendTimeURI:
+			writer.absSendTimeID = uint8(extension.ID)
+		case audioLevelURI:
+			writer.audioLevelID = uint8(extension.ID)
+		case videoOrientationURI:
+			writer.videoOrientationID = uint8(extension.ID)
+		}
+	}
+
+	return writer
+}
+
+// apply sets the extensions on the header, level is the audio level of the packet in -dBov
+func (writer *headerExtensionWriter) apply(header *rtp.Header, level uint8) {
+	if writer.absSendTimeID != 0 {
+		if payload, err := rtp.NewAbsSendTimeExtension(time.Now()).Marshal(); err == nil {
+			header.SetExtension(writer.absSendTimeID, payload)
+		}
+	}
+
+	if writer.audioLevelID != 0 {
+		if payload, err := (rtp.AudioLevelExtension{Level: level}).Marshal(); err == nil {
+			header.SetExtension(writer.audioLevelID, payload)
+		}
+	}
+
+	// CVO only needs to be in the last packet of each frame
+	if writer.videoOrientationID != 0 && header.Marker {
+		header.SetExtension(writer.videoOrientationID, []byte{writer.orientation})
+	}
+}
+
+// audioLevelMeter measures the level of the PCM chunks read since the last call to AudioLevel
+type audioLevelMeter struct {
+	mu      sync.Mutex
+	energy  float64
+	samples int
+}
+
+func (meter *audioLevelMeter) wrap(reader audio.Reader) audio.Reader {
+	return audio.ReaderFunc(func() (chunk wave.Audio, release func(), err error) {
+		chunk, release, err = reader.Read()
+		if err == nil {
+			meter.observe(chunk)
+		}
+		return chunk, release, err
+	})
+}
+
+func (meter *audioLevelMeter) observe(chunk wave.Audio) {
+	var energy float64
+	var samples int
+
+	switch chunk := chunk.(type) {
+	case *wave.Int16Interleaved:
+		for _, sample := range chunk.Data {
+			normalized := float64(sample) / math.MaxInt16
+			energy += normalized * normalized
+		}
+		samples = len(chunk.Data)
+	case *wave.Float32Interleaved:
+		for _, sample := range chunk.Data {
+			energy += float64(sample) * float64(sample)
+		}
+		samples = len(chunk.Data)
+	default:
+		return
+	}
+
+	meter.mu.Lock()
+	meter.energy += energy
+	meter.samples += samples
+	meter.mu.Unlock()
+}
+
+// AudioLevel returns the level in -dBov as defined in RFC 6464, from 0 (loudest) to 127 (silence)
+func (meter *audioLevelMeter) AudioLevel() uint8 {
+	meter.mu.Lock()
+	energy, samples := meter.energy, meter.samples
+	meter.energy, meter.samples = 0, 0
+	meter.mu.Unlock()
+
+	if samples == 0 || energy == 0 {
+		return 127
+	}
+
+	dBov := 10 * math.Log10(energy/float64(samples))
+	return uint8(math.Min(127, math.Max(0, math.Round(-dBov))))
+}
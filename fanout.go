@@ -0,0 +1,198 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/rtp"
+)
+
+// sharedEncoderQueue is the number of packet groups queued for each peer connection of a shared
+// encoder, a peer connection that doesn't keep up loses the oldest ones instead of stalling the
+// others
+const sharedEncoderQueue = 64
+
+// WithSharedEncoder encodes each track once for all the peer connections using the same codec,
+// f.e. when publishing to several WHIP endpoints, instead of once per peer connection. The
+// keyframes requested by any of them are sent to all of them.
+func WithSharedEncoder(shared bool) CodecSelectorOption {
+	return func(t *CodecSelector) {
+		t.sharedEncoder = shared
+	}
+}
+
+// sharedEncoder sends the packets of an encoder to several peer connections, each one with its
+// own queue
+type sharedEncoder struct {
+	track  *baseTrack
+	key    string
+	reader mediadevices.RTPReadCloser
+	levels audioLevelReader
+	// limiter applies the keyframe policy to the requests of all the peer connections, so they
+	// don't get more keyframes than a single one
+	limiter *keyFrameLimiter
+
+	mu          sync.Mutex
+	subscribers map[string]*frameQueue
+	err         error
+	// stopped is set when the encoder fails or the last peer connection leaves, the encoder is
+	// closed by run so it isn't closed during a read
+	stopped bool
+}
+
+type sharedPackets struct {
+	pkts  []*rtp.Packet
+	level uint8
+}
+
+// sharedEncoderReader is the reader of a peer connection of a shared encoder
+type sharedEncoderReader struct {
+	*rtpReadCloserImpl
+	limiter *keyFrameLimiter
+}
+
+// sharedRTPReader returns a reader of the shared encoder of the codec, starting it for the first
+// peer connection or when the previous one failed. It must be called with track.mu held.
+func (track *baseTrack) sharedRTPReader(id string, mimeType string, specializedTrack mediadevices.Track) (mediadevices.RTPReadCloser, error) {
+	key := strings.ToLower(mimeType)
+	var queue *frameQueue
+	encoder, ok := track.sharedEncoders[key]
+	if ok {
+		queue = encoder.subscribe(id)
+	}
+	if queue == nil {
+		// the SSRC is replaced with the one of each peer connection when the packets are written
+		reader, err := specializedTrack.NewRTPReader(mimeType, 0, rtpOutboundMTU)
+		if err != nil {
+			return nil, err
+		}
+		encoder = &sharedEncoder{track: track, key: key, reader: reader, subscribers: make(map[string]*frameQueue)}
+		encoder.levels, _ = reader.(audioLevelReader)
+		if controller, ok := reader.Controller().(codec.KeyFrameController); ok {
+			encoder.limiter = newKeyFrameLimiter(controller, track.selector.keyFramePolicy)
+		}
+		track.sharedEncoders[key] = encoder
+		queue = encoder.subscribe(id)
+		go encoder.run()
+	} else if encoder.limiter != nil {
+		// the new peer connection starts decoding at a keyframe, within the keyframe policy
+		if err := encoder.limiter.ForceKeyFrame(); err != nil {
+			return nil, err
+		}
+	}
+
+	level := uint8(127)
+	return &sharedEncoderReader{rtpReadCloserImpl: &rtpReadCloserImpl{
+		readFn: func() ([]*rtp.Packet, func(), error) {
+			select {
+			case item := <-queue.items:
+				packets := item.(sharedPackets)
+				level = packets.level
+				return packets.pkts, func() {}, nil
+			case <-queue.done:
+				encoder.mu.Lock()
+				defer encoder.mu.Unlock()
+				return nil, func() {}, encoder.err
+			}
+		},
+		closeFn: func() error {
+			track.mu.Lock()
+			defer track.mu.Unlock()
+			encoder.mu.Lock()
+			defer encoder.mu.Unlock()
+
+			delete(encoder.subscribers, id)
+			queue.close()
+			if len(encoder.subscribers) == 0 {
+				encoder.stopped = true
+				if track.sharedEncoders[key] == encoder {
+					delete(track.sharedEncoders, key)
+				}
+			}
+			return nil
+		},
+		controllerFn: func() codec.EncoderController {
+			return encoder.reader.Controller()
+		},
+		audioLevelFn: func() uint8 { return level },
+	}, limiter: encoder.limiter}, nil
+}
+
+// subscribe adds the queue of a peer connection, it returns nil once the encoder is stopped
+func (encoder *sharedEncoder) subscribe(id string) *frameQueue {
+	encoder.mu.Lock()
+	defer encoder.mu.Unlock()
+
+	if encoder.stopped {
+		return nil
+	}
+	queue := newFrameQueue(sharedEncoderQueue, DropOldest)
+	encoder.subscribers[id] = queue
+	return queue
+}
+
+// run reads the packets of the encoder and queues them for every peer connection. The packets
+// are shared, so the peer connections must not modify them. A single peer connection paces the
+// encoder like an encoder of its own, several ones lose their oldest packets instead of waiting
+// for the slowest.
+func (encoder *sharedEncoder) run() {
+	defer func() {
+		encoder.reader.Close()
+		if encoder.limiter != nil {
+			encoder.limiter.Close()
+		}
+	}()
+
+	for {
+		pkts, release, err := encoder.reader.Read()
+		if err != nil {
+			// the next peer connection starts a new encoder
+			encoder.track.mu.Lock()
+			if encoder.track.sharedEncoders[encoder.key] == encoder {
+				delete(encoder.track.sharedEncoders, encoder.key)
+			}
+			encoder.track.mu.Unlock()
+		}
+
+		encoder.mu.Lock()
+		if err != nil || encoder.stopped {
+			encoder.err, encoder.stopped = err, true
+			for _, queue := range encoder.subscribers {
+				queue.close()
+			}
+			encoder.mu.Unlock()
+			return
+		}
+		release()
+
+		level := uint8(127)
+		if encoder.levels != nil {
+			level = encoder.levels.AudioLevel()
+		}
+		queues := make([]*frameQueue, 0, len(encoder.subscribers))
+		peerConnections := 0
+		for id, queue := range encoder.subscribers {
+			queues = append(queues, queue)
+			// the encoder of EncodeFrames reads its packets right away
+			if id != encodedFramesID {
+				peerConnections++
+			}
+		}
+		encoder.mu.Unlock()
+
+		// the queues are closed by the peer connections leaving, which releases a waiting push
+		packets := sharedPackets{pkts: pkts, level: level}
+		for _, queue := range queues {
+			if peerConnections > 1 {
+				queue.push(packets)
+				continue
+			}
+			select {
+			case queue.items <- packets:
+			case <-queue.done:
+			}
+		}
+	}
+}
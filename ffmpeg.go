@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/wave"
+)
+
+func init() {
+	RegisterSource("ffmpeg", SourceFactory{
+		Description: "raw media decoded by an ffmpeg child process with the given input arguments, f.e. \"ffmpeg:-re -i input.mp4\". The same URI in -v and -a shares the process",
+		Kinds:       bothKinds,
+		Options: []SourceOption{
+			{"binary", "ffmpeg", "ffmpeg executable"},
+			{"width", "1280", "width the video is scaled to"},
+			{"height", "720", "height the video is scaled to"},
+			{"sample-rate", "48000", "sample rate the audio is resampled to"},
+			{"channels", "1", "channels of the audio"},
+			{"video-map", "0:v:0", "ffmpeg stream specifier of the video"},
+			{"audio-map", "0:a:0", "ffmpeg stream specifier of the audio"},
+			{"restart-delay", "1s", "time to wait before restarting ffmpeg when it exits"},
+		},
+		NewTrack: newFFmpegTrack,
+	})
+}
+
+// ffmpegMaxLogLine is the longest line of the ffmpeg log that is logged
+const ffmpegMaxLogLine = 1 << 20
+
+var (
+	ffmpegProcessesMu sync.Mutex
+	ffmpegProcesses   = make(map[string]*ffmpegProcess)
+)
+
+// ffmpegProcess runs ffmpeg with the raw video and audio outputs written to the pipes passed as
+// extra file descriptors, and restarts it whenever it exits
+type ffmpegProcess struct {
+	key          string
+	name         string
+	binary       string
+	args         []string
+	videoMap     string
+	audioMap     string
+	width        int
+	height       int
+	sampleRate   int
+	channels     int
+	restartDelay time.Duration
+
+	mu      sync.Mutex
+	started bool
+	outputs map[mediadevices.MediaDeviceType]chan io.ReadCloser
+	// cmd is the running ffmpeg, restart is set when it's killed to add the output of a track
+	cmd     *exec.Cmd
+	restart bool
+	// refs are the outputs not closed yet, the process is killed once they are all closed
+	refs   int
+	done   chan struct{}
+	exited chan struct{}
+}
+
+// ffmpegOutput is the stream of one kind of the ffmpeg process
+type ffmpegOutput struct {
+	process   *ffmpegProcess
+	kind      mediadevices.MediaDeviceType
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (output *ffmpegOutput) String() string {
+	return fmt.Sprintf("%s (%s)", output.process.name, kindName(output.kind))
+}
+
+// connect starts the process on the first call, from the first read of a track, so it's started
+// with the outputs of all the tracks of the URI, and then waits for the pipe of the next run
+func (output *ffmpegOutput) connect() (io.ReadCloser, error) {
+	process := output.process
+	process.mu.Lock()
+	if !process.started {
+		process.started = true
+		go process.run()
+	}
+	pipes := process.outputs[output.kind]
+	process.mu.Unlock()
+
+	select {
+	case pipe := <-pipes:
+		return pipe, nil
+	case <-output.done:
+		return nil, errInputClosed
+	}
+}
+
+// Close stops waiting for the pipes, the process is killed with the last output
+func (output *ffmpegOutput) Close() error {
+	output.closeOnce.Do(func() {
+		close(output.done)
+		output.process.release()
+	})
+	return nil
+}
+
+func newFFmpegTrack(uri *SourceURI, kind mediadevices.MediaDeviceType, selector *CodecSelector) (mediadevices.Track, error) {
+	process, err := getFFmpegProcess(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	process.mu.Lock()
+	defer process.mu.Unlock()
+	select {
+	case <-process.done:
+		return nil, fmt.Errorf("ffmpeg input %s closed", uri)
+	default:
+	}
+	if _, ok := process.outputs[kind]; ok {
+		return nil, fmt.Errorf("ffmpeg input %s already used for %s", uri, kindName(kind))
+	}
+	process.outputs[kind] = make(chan io.ReadCloser, 1)
+	process.refs++
+	if process.cmd != nil {
+		// the track is created after the first read of another one, f.e. by a switch, ffmpeg is
+		// restarted with its output
+		process.restart = true
+		process.cmd.Process.Kill()
+	}
+
+	output := &ffmpegOutput{process: process, kind: kind, done: make(chan struct{})}
+	if kind == mediadevices.AudioInput {
+		info := wave.ChunkInfo{Len: process.sampleRate / 100, Channels: process.channels, SamplingRate: process.sampleRate}
+		return newAudioTrackFromReader(newReconnectingAudioReader(output, func(r io.Reader) audio.Reader {
+			return newRawAudioReader(r, process.sampleRate, process.channels)
+		}, selector.clock, info), selector), nil
+	}
+	return newVideoTrackFromReader(newReconnectingVideoReader(output, func(r io.Reader) video.Reader {
+		return newRawVideoReader(r, process.width, process.height)
+	}, selector.clock, image.Pt(process.width, process.height)), selector), nil
+}
+
+// getFFmpegProcess returns the process shared by the tracks of the same URI
+func getFFmpegProcess(uri *SourceURI) (*ffmpegProcess, error) {
+	key := uri.String() + "?" + fmt.Sprint(uri.options)
+
+	ffmpegProcessesMu.Lock()
+	defer ffmpegProcessesMu.Unlock()
+
+	if process, ok := ffmpegProcesses[key]; ok {
+		return process, nil
+	}
+
+	args, err := splitArguments(uri.Path)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("missing ffmpeg input arguments")
+	}
+	if _, err := exec.LookPath(uri.Option("binary")); err != nil {
+		return nil, err
+	}
+
+	process := &ffmpegProcess{
+		key:      key,
+		name:     uri.String(),
+		binary:   uri.Option("binary"),
+		args:     args,
+		videoMap: uri.Option("video-map"),
+		audioMap: uri.Option("audio-map"),
+		outputs:  make(map[mediadevices.MediaDeviceType]chan io.ReadCloser),
+		done:     make(chan struct{}),
+		exited:   make(chan struct{}),
+	}
+	for name, value := range map[string]*int{"width": &process.width, "height": &process.height, "sample-rate": &process.sampleRate, "channels": &process.channels} {
+		if *value, err = uri.IntOption(name); err != nil {
+			return nil, err
+		}
+		if *value <= 0 {
+			return nil, fmt.Errorf("invalid %s option %d of ffmpeg input", name, *value)
+		}
+	}
+	if process.restartDelay, err = time.ParseDuration(uri.Option("restart-delay")); err != nil {
+		return nil, fmt.Errorf("invalid restart-delay option of ffmpeg input: %w", err)
+	}
+
+	ffmpegProcesses[key] = process
+	return process, nil
+}
+
+// command builds the ffmpeg command line, the outputs are written to the file descriptors
+// following stderr in the order of kinds
+func (process *ffmpegProcess) command(kinds []mediadevices.MediaDeviceType) *exec.Cmd {
+	args := append([]string{"-hide_banner", "-nostdin", "-loglevel", "warning"}, process.args...)
+
+	for i, kind := range kinds {
+		fd := strconv.Itoa(3 + i)
+		if kind == mediadevices.VideoInput {
+			args = append(args, "-map", process.videoMap, "-f", "rawvideo", "-pix_fmt", "yuv420p",
+				"-s", fmt.Sprintf("%dx%d", process.width, process.height), "pipe:"+fd)
+		} else {
+			args = append(args, "-map", process.audioMap, "-f", "s16le", "-acodec", "pcm_s16le",
+				"-ar", strconv.Itoa(process.sampleRate), "-ac", strconv.Itoa(process.channels), "pipe:"+fd)
+		}
+	}
+
+	return exec.Command(process.binary, args...)
+}
+
+// run runs ffmpeg until the process is released, restarting it whenever it exits
+func (process *ffmpegProcess) run() {
+	defer close(process.exited)
+
+	for {
+		err := process.runOnce()
+
+		process.mu.Lock()
+		restart := process.restart
+		process.restart = false
+		process.mu.Unlock()
+		select {
+		case <-process.done:
+			return
+		default:
+		}
+		if restart {
+			log.Printf("Restarting input %s with the outputs of all the tracks", process.name)
+			continue
+		}
+
+		if err != nil {
+			log.Printf("Input %s exited: %v", process.name, err)
+		} else {
+			log.Printf("Input %s exited", process.name)
+		}
+		select {
+		case <-time.After(process.restartDelay):
+		case <-process.done:
+			return
+		}
+		log.Printf("Restarting input %s", process.name)
+	}
+}
+
+// release kills the process and waits for it to exit once the outputs of all the tracks are
+// closed
+func (process *ffmpegProcess) release() {
+	ffmpegProcessesMu.Lock()
+	process.mu.Lock()
+	process.refs--
+	last := process.refs == 0
+	if last {
+		if ffmpegProcesses[process.key] == process {
+			delete(ffmpegProcesses, process.key)
+		}
+		close(process.done)
+		if process.cmd != nil {
+			process.cmd.Process.Kill()
+		}
+	}
+	started := process.started
+	process.mu.Unlock()
+	ffmpegProcessesMu.Unlock()
+
+	if last && started {
+		<-process.exited
+	}
+}
+
+func (process *ffmpegProcess) runOnce() error {
+	process.mu.Lock()
+	defer process.mu.Unlock()
+	select {
+	case <-process.done:
+		return nil
+	default:
+	}
+
+	var kinds []mediadevices.MediaDeviceType
+	for _, kind := range []mediadevices.MediaDeviceType{mediadevices.VideoInput, mediadevices.AudioInput} {
+		if _, ok := process.outputs[kind]; ok {
+			kinds = append(kinds, kind)
+		}
+	}
+	cmd := process.command(kinds)
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	var readers, writers []*os.File
+	closeAll := func(files []*os.File) {
+		for _, file := range files {
+			file.Close()
+		}
+	}
+	for range kinds {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			closeAll(readers)
+			closeAll(writers)
+			return err
+		}
+		readers = append(readers, reader)
+		writers = append(writers, writer)
+	}
+	cmd.ExtraFiles = writers
+
+	err = cmd.Start()
+	// the child has its own copy of the write ends, so the readers get EOF when it exits
+	closeAll(writers)
+	if err != nil {
+		closeAll(readers)
+		return err
+	}
+
+	for i, kind := range kinds {
+		process.deliver(kind, readers[i])
+	}
+	process.cmd = cmd
+	process.mu.Unlock()
+
+	scanner := bufio.NewScanner(stderr)
+	scanner.Buffer(make([]byte, 64<<10), ffmpegMaxLogLine)
+	for scanner.Scan() {
+		log.Printf("ffmpeg: %s", scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("ffmpeg: %v, the rest of the log is discarded", err)
+	}
+	// ffmpeg blocks once the pipe is full, so it's drained even when a line is too long
+	io.Copy(ioutil.Discard, stderr)
+	err = cmd.Wait()
+
+	process.mu.Lock()
+	process.cmd = nil
+	return err
+}
+
+// deliver hands the pipe of the current run to the reader, replacing the one of a previous run
+// that wasn't read. It must be called with process.mu held.
+func (process *ffmpegProcess) deliver(kind mediadevices.MediaDeviceType, pipe io.ReadCloser) {
+	pipes := process.outputs[kind]
+	select {
+	case stale := <-pipes:
+		stale.Close()
+	default:
+	}
+	pipes <- pipe
+}
+
+// splitArguments splits a command line on spaces, except inside single or double quotes
+func splitArguments(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	var quote rune
+	inArg := false
+
+	for _, c := range line {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteRune(c)
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote in ffmpeg arguments")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/mediadevices"
+)
+
+// fakeFFmpegEnv is set to the file the runs are recorded in when the test binary is started as a
+// fake ffmpeg
+const fakeFFmpegEnv = "WHIP_GO_FAKE_FFMPEG"
+
+func TestMain(m *testing.M) {
+	if runs := os.Getenv(fakeFFmpegEnv); runs != "" {
+		fakeFFmpeg(runs, os.Args[1:])
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeFFmpeg records the kinds of the outputs of the run, logs a line longer than the log buffer,
+// and writes a 2x2 I420 frame and 10ms of 8kHz mono audio to the output descriptors. The first
+// run exits right away so it's restarted, the next ones keep running until they are killed.
+func fakeFFmpeg(runs string, args []string) {
+	var kinds []string
+	var outputs []*os.File
+	for i, arg := range args {
+		if !strings.HasPrefix(arg, "pipe:") || i < 2 {
+			continue
+		}
+		fd, _ := strconv.Atoi(strings.TrimPrefix(arg, "pipe:"))
+		outputs = append(outputs, os.NewFile(uintptr(fd), arg))
+		// the format is the last -f before the output
+		for j := i - 1; j > 0; j-- {
+			if args[j-1] == "-f" {
+				kinds = append(kinds, map[bool]string{true: "video", false: "audio"}[args[j] == "rawvideo"])
+				break
+			}
+		}
+	}
+
+	file, err := os.OpenFile(runs, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		os.Exit(1)
+	}
+	fmt.Fprintln(file, strings.Join(kinds, " "))
+	file.Close()
+
+	os.Stderr.Write(append(bytes.Repeat([]byte{'x'}, 2*ffmpegMaxLogLine), '\n'))
+	for i, output := range outputs {
+		if kinds[i] == "video" {
+			output.Write(make([]byte, 6))
+		} else {
+			output.Write(make([]byte, 160))
+		}
+	}
+
+	if recorded, _ := ioutil.ReadFile(runs); bytes.Count(recorded, []byte{'\n'}) > 1 {
+		time.Sleep(time.Minute)
+	}
+}
+
+func TestFFmpegTracks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ffmpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runs := filepath.Join(dir, "runs")
+	os.Setenv(fakeFFmpegEnv, runs)
+	defer os.Unsetenv(fakeFFmpegEnv)
+	binary, err := filepath.Abs(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri, _, err := ParseSourceURI("ffmpeg:-i test.mp4?binary=" + binary + "&width=2&height=2&sample-rate=8000&channels=1&restart-delay=100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selector := NewCodecSelector()
+	videoTrack, err := newFFmpegTrack(uri, mediadevices.VideoInput, selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	process, err := getFFmpegProcess(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readFrames := func(read func() (bool, func(), error), count int) chan error {
+		done := make(chan error, 1)
+		go func() {
+			for frames := 0; frames < count; {
+				filler, release, err := read()
+				if err != nil {
+					done <- err
+					return
+				}
+				if !filler {
+					frames++
+				}
+				release()
+			}
+			done <- nil
+		}()
+		return done
+	}
+	wait := func(done chan error, what string) {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout reading %s", what)
+		}
+	}
+
+	// a frame of each run, the first one exits before the second one is started
+	videoReader := videoTrack.(*VideoTrack).NewReader(false)
+	readVideo := func() (bool, func(), error) {
+		img, release, err := videoReader.Read()
+		return isFiller(img), release, err
+	}
+	wait(readFrames(readVideo, 2), "the video of the first two runs")
+
+	// the audio track added while the second run is running restarts it with both outputs
+	audioTrack, err := newFFmpegTrack(uri, mediadevices.AudioInput, selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audioReader := audioTrack.(*AudioTrack).NewReader(false)
+	readAudio := func() (bool, func(), error) {
+		chunk, release, err := audioReader.Read()
+		return isFiller(chunk), release, err
+	}
+	wait(readFrames(readAudio, 1), "the audio of the restarted run")
+	wait(readFrames(readVideo, 1), "the video of the restarted run")
+
+	recorded, err := ioutil.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "video\nvideo\nvideo audio\n"; string(recorded) != expected {
+		t.Fatalf("got the runs %q, expected %q", recorded, expected)
+	}
+
+	// the running process is killed with the last track
+	videoTrack.Close()
+	select {
+	case <-process.exited:
+		t.Fatal("process exited with a track still open")
+	default:
+	}
+	audioTrack.Close()
+	select {
+	case <-process.exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the process to be killed")
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/mediadevices/pkg/io/video"
+)
+
+// videoScalers are the scaling algorithms by name, from the fastest to the sharpest
+var videoScalers = map[string]video.Scaler{
+	"nearest":    video.ScalerNearestNeighbor,
+	"box":        video.ScalerFastBoxSampling,
+	"bilinear":   video.ScalerBiLinear,
+	"catmullrom": video.ScalerCatmullRom,
+}
+
+// parseVideoFilters parses a comma separated chain of filters applied in order, f.e.
+// "crop=1280:720,rotate=90,scale=640:-1:bilinear,pad=1280:720,fps=30"
+func parseVideoFilters(chain string) (video.TransformFunc, error) {
+	var transforms []video.TransformFunc
+
+	for _, filter := range strings.Split(chain, ",") {
+		filter = strings.TrimSpace(filter)
+		if filter == "" {
+			continue
+		}
+
+		name, params := filter, ""
+		if i := strings.Index(filter, "="); i >= 0 {
+			name, params = filter[:i], filter[i+1:]
+		}
+		transform, err := newVideoFilter(strings.ToLower(name), strings.Split(params, ":"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid video filter %s: %w", filter, err)
+		}
+		transforms = append(transforms, transform)
+	}
+
+	if len(transforms) == 0 {
+		return nil, nil
+	}
+	return video.Merge(transforms...), nil
+}
+
+func newVideoFilter(name string, params []string) (video.TransformFunc, error) {
+	ints := func(from int, count int) ([]int, error) {
+		if len(params) < from+count {
+			return nil, fmt.Errorf("expected %d parameters", from+count)
+		}
+		values := make([]int, count)
+		for i := range values {
+			value, err := strconv.Atoi(params[from+i])
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	}
+
+	switch name {
+	case "crop":
+		// crop=width:height[:x:y], centered by default
+		if len(params) != 2 && len(params) != 4 {
+			return nil, fmt.Errorf("expected 2 or 4 parameters")
+		}
+		size, err := ints(0, 2)
+		if err != nil {
+			return nil, err
+		}
+		x, y := -1, -1
+		if len(params) == 4 {
+			position, err := ints(2, 2)
+			if err != nil {
+				return nil, err
+			}
+			x, y = position[0], position[1]
+		}
+		if size[0] <= 0 || size[1] <= 0 {
+			return nil, fmt.Errorf("invalid size %dx%d", size[0], size[1])
+		}
+		return frameFilter(func(frame *image.YCbCr) *image.YCbCr {
+			return cropFrame(frame, size[0], size[1], x, y)
+		}), nil
+
+	case "scale":
+		// scale=width:height[:algorithm], -1 keeps the aspect ratio
+		size, err := ints(0, 2)
+		if err != nil {
+			return nil, err
+		}
+		if size[0] == 0 || size[1] == 0 || size[0] < -1 || size[1] < -1 || (size[0] == -1 && size[1] == -1) {
+			return nil, fmt.Errorf("invalid size %dx%d", size[0], size[1])
+		}
+		scaler, err := parseScaler(params[2:])
+		if err != nil {
+			return nil, err
+		}
+		return scaleFilter(size[0], size[1], scaler), nil
+
+	case "pad":
+		// pad=width:height[:algorithm], letterboxes the frame keeping its aspect ratio
+		size, err := ints(0, 2)
+		if err != nil {
+			return nil, err
+		}
+		if size[0] <= 0 || size[1] <= 0 {
+			return nil, fmt.Errorf("invalid size %dx%d", size[0], size[1])
+		}
+		scaler, err := parseScaler(params[2:])
+		if err != nil {
+			return nil, err
+		}
+		return padFilter(size[0], size[1], scaler), nil
+
+	case "rotate":
+		// rotate=90|180|270, clockwise
+		degrees, err := ints(0, 1)
+		if err != nil {
+			return nil, err
+		}
+		if degrees[0] != 90 && degrees[0] != 180 && degrees[0] != 270 {
+			return nil, fmt.Errorf("invalid rotation %d, valid values are 90|180|270", degrees[0])
+		}
+		return frameFilter(func(frame *image.YCbCr) *image.YCbCr {
+			return rotateFrame(frame, degrees[0])
+		}), nil
+
+	case "fps":
+		rate, err := ints(0, 1)
+		if err != nil {
+			return nil, err
+		}
+		if rate[0] <= 0 {
+			return nil, fmt.Errorf("invalid frame rate %d", rate[0])
+		}
+		return frameRateFilter(rate[0]), nil
+
+	default:
+		return nil, fmt.Errorf("unknown filter, valid filters are crop|scale|pad|rotate|fps")
+	}
+}
+
+func parseScaler(params []string) (video.Scaler, error) {
+	if len(params) == 0 || params[0] == "" {
+		return video.ScalerFastBoxSampling, nil
+	}
+	scaler, ok := videoScalers[strings.ToLower(params[0])]
+	if !ok {
+		return nil, fmt.Errorf("unknown scaling algorithm %s, valid values are nearest|box|bilinear|catmullrom", params[0])
+	}
+	return scaler, nil
+}
+
+// frameFilter applies fn to every frame converted to 4:2:0, keeping its presentation timestamp
+func frameFilter(fn func(*image.YCbCr) *image.YCbCr) video.TransformFunc {
+	return func(r video.Reader) video.Reader {
+		return video.ReaderFunc(func() (img image.Image, release func(), err error) {
+			img, release, err = r.Read()
+			if err != nil {
+				return img, release, err
+			}
+
+			img, pts, ok := splitPresentationTimestamp(img)
+			img = fn(toYCbCr420(img))
+			if ok {
+				img = WithPresentationTimestamp(img, pts)
+			}
+			return img, release, nil
+		})
+	}
+}
+
+// scaleFilter scales the frames with the mediadevices scaler, the size is computed again when
+// the input size changes
+func scaleFilter(width int, height int, scaler video.Scaler) video.TransformFunc {
+	return func(r video.Reader) video.Reader {
+		var current image.Image
+		var size image.Point
+		var scaled video.Reader
+		source := video.ReaderFunc(func() (image.Image, func(), error) {
+			return current, func() {}, nil
+		})
+
+		return video.ReaderFunc(func() (img image.Image, release func(), err error) {
+			img, release, err = r.Read()
+			if err != nil {
+				return img, release, err
+			}
+			defer release()
+
+			img, pts, ok := splitPresentationTimestamp(img)
+			current = toYCbCr420(img)
+
+			target := scaledSize(current.Bounds().Size(), width, height)
+			if scaled == nil || target != size {
+				size = target
+				scaled = video.Scale(size.X, size.Y, scaler)(source)
+			}
+
+			img, _, err = scaled.Read()
+			if err != nil {
+				return img, func() {}, err
+			}
+			if ok {
+				img = WithPresentationTimestamp(img, pts)
+			}
+			return img, func() {}, nil
+		})
+	}
+}
+
+// scaledSize resolves the -1 dimensions keeping the aspect ratio, rounded to even sizes for 4:2:0
+func scaledSize(source image.Point, width int, height int) image.Point {
+	if width == -1 {
+		width = source.X * height / source.Y
+	}
+	if height == -1 {
+		height = source.Y * width / source.X
+	}
+	return image.Pt(even(width), even(height))
+}
+
+func even(value int) int {
+	if value < 2 {
+		return 2
+	}
+	return value &^ 1
+}
+
+// padFilter scales the frames to fit in width x height keeping the aspect ratio and centers them
+// on black bars
+func padFilter(width int, height int, scaler video.Scaler) video.TransformFunc {
+	return func(r video.Reader) video.Reader {
+		var inputSize image.Point
+		var scaled video.Reader
+		var current image.Image
+		source := video.ReaderFunc(func() (image.Image, func(), error) {
+			return current, func() {}, nil
+		})
+
+		return video.ReaderFunc(func() (img image.Image, release func(), err error) {
+			img, release, err = r.Read()
+			if err != nil {
+				return img, release, err
+			}
+			defer release()
+
+			img, pts, ok := splitPresentationTimestamp(img)
+			current = toYCbCr420(img)
+
+			if size := current.Bounds().Size(); scaled == nil || size != inputSize {
+				inputSize = size
+				fitWidth, fitHeight := width, size.Y*width/size.X
+				if fitHeight > height {
+					fitWidth, fitHeight = size.X*height/size.Y, height
+				}
+				scaled = video.Scale(even(fitWidth), even(fitHeight), scaler)(source)
+			}
+
+			img, _, err = scaled.Read()
+			if err != nil {
+				return img, func() {}, err
+			}
+			img = padFrame(toYCbCr420(img), width, height)
+			if ok {
+				img = WithPresentationTimestamp(img, pts)
+			}
+			return img, func() {}, nil
+		})
+	}
+}
+
+// frameRateFilter converts the frames to a constant frame rate, dropping the frames of faster
+// inputs and duplicating the frames of slower ones
+func frameRateFilter(rate int) video.TransformFunc {
+	interval := time.Second / time.Duration(rate)
+
+	type timedFrame struct {
+		img *image.YCbCr
+		pts time.Duration
+	}
+
+	return func(r video.Reader) video.Reader {
+		var last, pending *timedFrame
+		var next time.Duration
+
+		return video.ReaderFunc(func() (image.Image, func(), error) {
+			for {
+				if pending == nil {
+					img, release, err := r.Read()
+					if err != nil {
+						return img, release, err
+					}
+					img, pts, _ := splitPresentationTimestamp(img)
+					// the frame is kept while the next one is read, so it can't share the buffers
+					// of the upstream reader
+					pending = &timedFrame{copyYCbCr(toYCbCr420(img)), pts}
+					release()
+				}
+
+				// start the grid at the first frame and again after the input stalls, instead of
+				// sending a burst of duplicates
+				if last == nil || pending.pts-next > time.Second || next-pending.pts > time.Second {
+					next = pending.pts
+				}
+
+				if last != nil && pending.pts > next+interval/2 {
+					// the input is slower, repeat the last frame in this slot
+					pts := next
+					next += interval
+					return WithPresentationTimestamp(last.img, pts), func() {}, nil
+				}
+
+				last, pending = pending, nil
+				if last.pts < next-interval/2 {
+					// the input is faster, this slot was already sent
+					continue
+				}
+
+				pts := next
+				next += interval
+				return WithPresentationTimestamp(last.img, pts), func() {}, nil
+			}
+		})
+	}
+}
+
+// toYCbCr420 returns the frame as a 4:2:0 image starting at the origin, converting it if needed
+func toYCbCr420(img image.Image) *image.YCbCr {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	switch img := img.(type) {
+	case *image.YCbCr:
+		if img.SubsampleRatio == image.YCbCrSubsampleRatio420 && img.Rect.Min == (image.Point{}) {
+			return img
+		}
+		// the luma is copied by rows, the chroma is sampled at the top left pixel of each 2x2 block
+		yuv := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+		for y := 0; y < height; y++ {
+			src := img.YOffset(bounds.Min.X, bounds.Min.Y+y)
+			copy(yuv.Y[y*yuv.YStride:y*yuv.YStride+width], img.Y[src:src+width])
+		}
+		for y := 0; y < (height+1)/2; y++ {
+			for x := 0; x < (width+1)/2; x++ {
+				src := img.COffset(bounds.Min.X+x*2, bounds.Min.Y+y*2)
+				yuv.Cb[y*yuv.CStride+x] = img.Cb[src]
+				yuv.Cr[y*yuv.CStride+x] = img.Cr[src]
+			}
+		}
+		return yuv
+
+	case *image.RGBA:
+		yuv := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+		for y := 0; y < height; y++ {
+			pix := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+			for x := 0; x < width; x++ {
+				luma, cb, cr := color.RGBToYCbCr(pix[x*4], pix[x*4+1], pix[x*4+2])
+				yuv.Y[y*yuv.YStride+x] = luma
+				if x%2 == 0 && y%2 == 0 {
+					i := yuv.COffset(x, y)
+					yuv.Cb[i] = cb
+					yuv.Cr[i] = cr
+				}
+			}
+		}
+		return yuv
+	}
+
+	yuv := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.YCbCrModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.YCbCr)
+			yuv.Y[yuv.YOffset(x, y)] = c.Y
+			if x%2 == 0 && y%2 == 0 {
+				i := yuv.COffset(x, y)
+				yuv.Cb[i] = c.Cb
+				yuv.Cr[i] = c.Cr
+			}
+		}
+	}
+	return yuv
+}
+
+func copyYCbCr(frame *image.YCbCr) *image.YCbCr {
+	copied := *frame
+	copied.Y = append([]byte(nil), frame.Y...)
+	copied.Cb = append([]byte(nil), frame.Cb...)
+	copied.Cr = append([]byte(nil), frame.Cr...)
+	return &copied
+}
+
+// cropFrame cuts a width x height rectangle at x, y, or centered when x and y are negative
+func cropFrame(frame *image.YCbCr, width int, height int, x int, y int) *image.YCbCr {
+	size := frame.Rect.Size()
+	if width > size.X {
+		width = size.X
+	}
+	if height > size.Y {
+		height = size.Y
+	}
+	if x < 0 || y < 0 {
+		x, y = (size.X-width)/2, (size.Y-height)/2
+	}
+	// chroma samples cover 2x2 pixels
+	x, y = x&^1, y&^1
+	if x+width > size.X {
+		x = (size.X - width) &^ 1
+	}
+	if y+height > size.Y {
+		y = (size.Y - height) &^ 1
+	}
+
+	cropped := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+	for row := 0; row < height; row++ {
+		copy(cropped.Y[row*cropped.YStride:row*cropped.YStride+width], frame.Y[frame.YOffset(x, y+row):])
+	}
+	chromaWidth := (width + 1) / 2
+	for row := 0; row < (height+1)/2; row++ {
+		src := frame.COffset(x, y+row*2)
+		copy(cropped.Cb[row*cropped.CStride:row*cropped.CStride+chromaWidth], frame.Cb[src:])
+		copy(cropped.Cr[row*cropped.CStride:row*cropped.CStride+chromaWidth], frame.Cr[src:])
+	}
+	return cropped
+}
+
+// padFrame centers the frame on a black width x height frame
+func padFrame(frame *image.YCbCr, width int, height int) *image.YCbCr {
+	padded := newBlackFrame(image.Rect(0, 0, width, height))
+	size := frame.Rect.Size()
+	x, y := ((width-size.X)/2)&^1, ((height-size.Y)/2)&^1
+	if x < 0 || y < 0 {
+		return cropFrame(frame, width, height, -1, -1)
+	}
+
+	pasteFrame(padded, frame, image.Pt(x, y))
+	return padded
+}
+
+// rotateFrame rotates the frame clockwise by a multiple of 90 degrees
+func rotateFrame(frame *image.YCbCr, degrees int) *image.YCbCr {
+	size := frame.Rect.Size()
+	rect := image.Rect(0, 0, size.Y, size.X)
+	if degrees == 180 {
+		rect = image.Rect(0, 0, size.X, size.Y)
+	}
+
+	rotated := image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+	rotatePlane(rotated.Y, rotated.YStride, frame.Y, frame.YStride, size.X, size.Y, degrees)
+	chroma := image.Pt((size.X+1)/2, (size.Y+1)/2)
+	rotatePlane(rotated.Cb, rotated.CStride, frame.Cb, frame.CStride, chroma.X, chroma.Y, degrees)
+	rotatePlane(rotated.Cr, rotated.CStride, frame.Cr, frame.CStride, chroma.X, chroma.Y, degrees)
+	return rotated
+}
+
+func rotatePlane(dst []byte, dstStride int, src []byte, srcStride int, width int, height int, degrees int) {
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch degrees {
+			case 90:
+				dx, dy = height-1-y, x
+			case 180:
+				dx, dy = width-1-x, height-1-y
+			default:
+				dx, dy = y, width-1-x
+			}
+			dst[dy*dstStride+dx] = src[y*srcStride+x]
+		}
+	}
+}
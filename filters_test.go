@@ -0,0 +1,253 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pion/mediadevices/pkg/io/video"
+)
+
+// newTestFrame returns a 4:2:0 frame whose samples encode their position, 16*y+x
+func newTestFrame(width int, height int) *image.YCbCr {
+	frame := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			frame.Y[frame.YOffset(x, y)] = uint8(16*y + x)
+		}
+	}
+	for y := 0; y < (height+1)/2; y++ {
+		for x := 0; x < (width+1)/2; x++ {
+			frame.Cb[y*frame.CStride+x] = uint8(16*y + x)
+			frame.Cr[y*frame.CStride+x] = uint8(255 - 16*y - x)
+		}
+	}
+	return frame
+}
+
+func TestCropFrame(t *testing.T) {
+	tests := []struct {
+		name                string
+		width, height, x, y int
+		// expected is the rectangle of the source that is kept
+		expected image.Rectangle
+	}{
+		{"centered", 4, 4, -1, -1, image.Rect(2, 2, 6, 6)},
+		{"positioned", 4, 2, 2, 4, image.Rect(2, 4, 6, 6)},
+		{"rounded to the chroma", 4, 4, 3, 1, image.Rect(2, 0, 6, 4)},
+		{"moved inside", 4, 4, 6, 6, image.Rect(4, 4, 8, 8)},
+		{"clamped", 16, 16, 0, 0, image.Rect(0, 0, 8, 8)},
+	}
+	for _, test := range tests {
+		frame := newTestFrame(8, 8)
+		cropped := cropFrame(frame, test.width, test.height, test.x, test.y)
+		if cropped.Rect != image.Rect(0, 0, test.expected.Dx(), test.expected.Dy()) {
+			t.Errorf("%s: got a %v frame, expected %v", test.name, cropped.Rect, test.expected)
+			continue
+		}
+		if cropped.YCbCrAt(0, 0) != frame.YCbCrAt(test.expected.Min.X, test.expected.Min.Y) ||
+			cropped.YCbCrAt(cropped.Rect.Dx()-1, cropped.Rect.Dy()-1) != frame.YCbCrAt(test.expected.Max.X-1, test.expected.Max.Y-1) {
+			t.Errorf("%s: the corners don't match the source at %v", test.name, test.expected)
+		}
+	}
+}
+
+func TestRotateFrame(t *testing.T) {
+	const width, height = 4, 2
+	tests := []struct {
+		degrees int
+		size    image.Point
+		// position maps a pixel of the source to the rotated frame
+		position func(x, y int) (int, int)
+	}{
+		{90, image.Pt(height, width), func(x, y int) (int, int) { return height - 1 - y, x }},
+		{180, image.Pt(width, height), func(x, y int) (int, int) { return width - 1 - x, height - 1 - y }},
+		{270, image.Pt(height, width), func(x, y int) (int, int) { return y, width - 1 - x }},
+	}
+	for _, test := range tests {
+		frame := newTestFrame(width, height)
+		rotated := rotateFrame(frame, test.degrees)
+		if size := rotated.Rect.Size(); size != test.size {
+			t.Errorf("%d: got a %v frame, expected %v", test.degrees, size, test.size)
+			continue
+		}
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				dx, dy := test.position(x, y)
+				if got, expected := rotated.Y[rotated.YOffset(dx, dy)], frame.Y[frame.YOffset(x, y)]; got != expected {
+					t.Errorf("%d: got %d at %d,%d, expected %d", test.degrees, got, dx, dy, expected)
+				}
+			}
+		}
+	}
+}
+
+func TestScaledSize(t *testing.T) {
+	tests := []struct {
+		source        image.Point
+		width, height int
+		expected      image.Point
+	}{
+		{image.Pt(1920, 1080), 1280, 720, image.Pt(1280, 720)},
+		{image.Pt(1920, 1080), 640, -1, image.Pt(640, 360)},
+		{image.Pt(1920, 1080), -1, 480, image.Pt(852, 480)},
+		{image.Pt(640, 480), 321, -1, image.Pt(320, 240)},
+		{image.Pt(640, 480), 1, -1, image.Pt(2, 2)},
+	}
+	for _, test := range tests {
+		if size := scaledSize(test.source, test.width, test.height); size != test.expected {
+			t.Errorf("%v scaled to %dx%d: got %v, expected %v", test.source, test.width, test.height, size, test.expected)
+		}
+	}
+}
+
+func TestFrameRateFilter(t *testing.T) {
+	const ms = time.Millisecond
+	tests := []struct {
+		name string
+		rate int
+		// input are the timestamps of the input frames, output the timestamps and the indexes of
+		// the input frames sent
+		input  []time.Duration
+		output []time.Duration
+		frames []uint8
+	}{
+		{"same rate", 10, []time.Duration{0, 100 * ms, 200 * ms}, []time.Duration{0, 100 * ms, 200 * ms}, []uint8{0, 1, 2}},
+		{"faster", 10, []time.Duration{0, 50 * ms, 100 * ms, 150 * ms, 200 * ms}, []time.Duration{0, 100 * ms, 200 * ms}, []uint8{0, 1, 3}},
+		{"slower", 10, []time.Duration{0, 250 * ms}, []time.Duration{0, 100 * ms, 200 * ms}, []uint8{0, 0, 1}},
+		{"stalled", 10, []time.Duration{0, 2000 * ms}, []time.Duration{0, 2000 * ms}, []uint8{0, 1}},
+	}
+	for _, test := range tests {
+		input := test.input
+		r := frameRateFilter(test.rate)(video.ReaderFunc(func() (image.Image, func(), error) {
+			if len(input) == 0 {
+				return nil, func() {}, io.EOF
+			}
+			frame := newTestFrame(2, 2)
+			frame.Y[0] = uint8(len(test.input) - len(input))
+			pts := input[0]
+			input = input[1:]
+			return WithPresentationTimestamp(frame, pts), func() {}, nil
+		}))
+
+		for i := 0; ; i++ {
+			img, release, err := r.Read()
+			if err != nil {
+				if i != len(test.output) {
+					t.Errorf("%s: got %d frames, expected %d", test.name, i, len(test.output))
+				}
+				break
+			}
+			release()
+			if i >= len(test.output) {
+				continue
+			}
+			img, pts, _ := splitPresentationTimestamp(img)
+			if frame := img.(*image.YCbCr).Y[0]; pts != test.output[i] || frame != test.frames[i] {
+				t.Errorf("%s: got the frame %d at %s, expected %d at %s", test.name, frame, pts, test.frames[i], test.output[i])
+			}
+		}
+	}
+}
+
+func TestParseVideoFilters(t *testing.T) {
+	tests := []struct {
+		chain string
+		// expected is the size of a filtered 16x8 frame, zero for invalid chains
+		expected image.Point
+	}{
+		{"crop=8:4", image.Pt(8, 4)},
+		{"crop=8:4:2:2", image.Pt(8, 4)},
+		{"crop=8:4:2", image.Point{}},
+		{"crop=8", image.Point{}},
+		{"crop=0:4", image.Point{}},
+		{"rotate=90", image.Pt(8, 16)},
+		{"Rotate=180", image.Pt(16, 8)},
+		{"rotate=45", image.Point{}},
+		{"scale=8:-1", image.Pt(8, 4)},
+		{"scale=8:4:bilinear", image.Pt(8, 4)},
+		{"scale=8:4:lanczos", image.Point{}},
+		{"scale=-1:-1", image.Point{}},
+		{"pad=32:32", image.Pt(32, 32)},
+		{"fps=30", image.Pt(16, 8)},
+		{"fps=0", image.Point{}},
+		{"crop=8:8, rotate=90 ,scale=4:-1", image.Pt(4, 4)},
+		{"blur=1", image.Point{}},
+	}
+	for _, test := range tests {
+		transform, err := parseVideoFilters(test.chain)
+		if test.expected == (image.Point{}) {
+			if err == nil {
+				t.Errorf("%s: invalid chain accepted", test.chain)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.chain, err)
+			continue
+		}
+
+		r := transform(video.ReaderFunc(func() (image.Image, func(), error) {
+			return newTestFrame(16, 8), func() {}, nil
+		}))
+		img, _, err := r.Read()
+		if err != nil {
+			t.Errorf("%s: %v", test.chain, err)
+			continue
+		}
+		img, _, _ = splitPresentationTimestamp(img)
+		if size := img.Bounds().Size(); size != test.expected {
+			t.Errorf("%s: got a %v frame, expected %v", test.chain, size, test.expected)
+		}
+	}
+
+	if transform, err := parseVideoFilters(" , "); transform != nil || err != nil {
+		t.Errorf("got %v, %v for an empty chain", transform, err)
+	}
+}
+
+func TestToYCbCr420(t *testing.T) {
+	rgba := image.NewRGBA(image.Rect(0, 0, 7, 5))
+	yuv444 := image.NewYCbCr(image.Rect(0, 0, 7, 5), image.YCbCrSubsampleRatio444)
+	gray := image.NewGray(image.Rect(0, 0, 7, 5))
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 7; x++ {
+			rgba.Set(x, y, color.RGBA{uint8(x * 30), uint8(y * 50), uint8(x * y * 7), 255})
+			yuv444.Y[yuv444.YOffset(x, y)] = uint8(x * 30)
+			yuv444.Cb[yuv444.COffset(x, y)] = uint8(y * 50)
+			yuv444.Cr[yuv444.COffset(x, y)] = uint8(x * y * 7)
+			gray.SetGray(x, y, color.Gray{uint8(x*30 + y)})
+		}
+	}
+
+	tests := []struct {
+		name string
+		img  image.Image
+	}{
+		{"rgba", rgba},
+		{"rgba sub image", rgba.SubImage(image.Rect(1, 1, 6, 4))},
+		{"4:4:4", yuv444},
+		{"4:2:0 sub image", newTestFrame(7, 5).SubImage(image.Rect(1, 1, 6, 4))},
+		{"gray", gray},
+	}
+	for _, test := range tests {
+		bounds := test.img.Bounds()
+		converted := toYCbCr420(test.img)
+		if converted.Rect != image.Rect(0, 0, bounds.Dx(), bounds.Dy()) || converted.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+			t.Errorf("%s: got a %v %v frame", test.name, converted.SubsampleRatio, converted.Rect)
+			continue
+		}
+		// the chroma of each 2x2 block is the one of its top left pixel
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				expected := color.YCbCrModel.Convert(test.img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.YCbCr)
+				got := converted.YCbCrAt(x, y)
+				if got.Y != expected.Y || (x%2 == 0 && y%2 == 0 && got != expected) {
+					t.Errorf("%s: got %v at %d,%d, expected %v", test.name, got, x, y, expected)
+				}
+			}
+		}
+	}
+}
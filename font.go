@@ -0,0 +1,95 @@
+package main
+
+import (
+	"image"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// textFace is the font bundled with the binary for the timecodes and the overlays
+var textFace = basicfont.Face7x13
+
+// textSize returns the size of the text drawn with the given scale
+func textSize(text string, scale int) image.Point {
+	return image.Pt(len([]rune(text))*textFace.Advance*scale, textFace.Height*scale)
+}
+
+// renderText draws the text on an alpha mask at scale 1
+func renderText(text string) *image.Alpha {
+	mask := image.NewAlpha(image.Rectangle{Max: textSize(text, 1)})
+	drawer := font.Drawer{
+		Dst:  mask,
+		Src:  image.Opaque,
+		Face: textFace,
+		Dot:  fixed.P(0, textFace.Ascent),
+	}
+	drawer.DrawString(text)
+	return mask
+}
+
+// drawText draws the text on the luma plane at the given position, every pixel of the font is
+// scaled to a scale x scale square
+func drawText(frame *image.YCbCr, text string, at image.Point, scale int, luma uint8) {
+	blendMask(frame, renderText(text), at, scale, luma, 128, 128, 1)
+}
+
+// blendMask blends a color through an alpha mask scaled by scale, with opacity from 0 to 1
+func blendMask(frame *image.YCbCr, mask *image.Alpha, at image.Point, scale int, y, cb, cr uint8, opacity float64) {
+	size := mask.Rect.Size()
+	for my := 0; my < size.Y; my++ {
+		for mx := 0; mx < size.X; mx++ {
+			alpha := float64(mask.Pix[my*mask.Stride+mx]) / 255 * opacity
+			if alpha == 0 {
+				continue
+			}
+			rect := image.Rect(at.X+mx*scale, at.Y+my*scale, at.X+(mx+1)*scale, at.Y+(my+1)*scale)
+			blendRect(frame, rect, y, cb, cr, alpha)
+		}
+	}
+}
+
+// blendRect blends a color over a rectangle of a 4:2:0 frame with alpha from 0 to 1
+func blendRect(frame *image.YCbCr, rect image.Rectangle, y, cb, cr uint8, alpha float64) {
+	rect = rect.Intersect(frame.Rect)
+	for py := rect.Min.Y; py < rect.Max.Y; py++ {
+		for px := rect.Min.X; px < rect.Max.X; px++ {
+			i := frame.YOffset(px, py)
+			frame.Y[i] = blend(frame.Y[i], y, alpha)
+			if px%2 == 0 && py%2 == 0 {
+				c := frame.COffset(px, py)
+				frame.Cb[c] = blend(frame.Cb[c], cb, alpha)
+				frame.Cr[c] = blend(frame.Cr[c], cr, alpha)
+			}
+		}
+	}
+}
+
+func blend(dst uint8, src uint8, alpha float64) uint8 {
+	return uint8(float64(dst)*(1-alpha) + float64(src)*alpha + 0.5)
+}
+
+// fillLuma sets the luma of a rectangle of the frame
+func fillLuma(frame *image.YCbCr, rect image.Rectangle, luma uint8) {
+	rect = rect.Intersect(frame.Rect)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		row := frame.YOffset(rect.Min.X, y)
+		for i := 0; i < rect.Dx(); i++ {
+			frame.Y[row+i] = luma
+		}
+	}
+}
+
+// fillRect sets the color of a rectangle of a 4:2:0 frame
+func fillRect(frame *image.YCbCr, rect image.Rectangle, y, cb, cr uint8) {
+	rect = rect.Intersect(frame.Rect)
+	fillLuma(frame, rect, y)
+	for cy := rect.Min.Y / 2; cy < (rect.Max.Y+1)/2; cy++ {
+		for cx := rect.Min.X / 2; cx < (rect.Max.X+1)/2; cx++ {
+			i := frame.COffset(cx*2, cy*2)
+			frame.Cb[i] = cb
+			frame.Cr[i] = cr
+		}
+	}
+}
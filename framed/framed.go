@@ -0,0 +1,349 @@
+// Package framed implements a small framing protocol to send raw video and audio frames of
+// variable size, together with their timing and format, over a byte stream like a pipe, a FIFO
+// or a socket.
+//
+// Every frame starts with a 16 byte header, all the fields are big endian:
+//
+//	magic   [2]byte  "WF"
+//	type    uint8    1 video, 2 audio
+//	flags   uint8    bit 0 set when the format block follows the header
+//	length  uint32   length of the payload
+//	pts     int64    presentation timestamp in microseconds
+//
+// The optional 6 byte format block is
+//
+//	video   width uint16, height uint16, format uint8, reserved uint8
+//	audio   sample rate uint32, channels uint8, format uint8
+//
+// The format applies to the frame and to all the following frames of the same type until a new
+// format block is sent. The payload of a video frame is a full picture in the given pixel format,
+// of a non zero size, and the payload of an audio frame is a chunk of interleaved samples.
+package framed
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// FrameType is the kind of media carried by a frame
+type FrameType uint8
+
+const (
+	FrameTypeVideo FrameType = 1
+	FrameTypeAudio FrameType = 2
+)
+
+// VideoFormat is the pixel format of a video frame
+type VideoFormat uint8
+
+const (
+	// VideoFormatI420 is planar YUV 4:2:0, the Y plane followed by the U and V planes
+	VideoFormatI420 VideoFormat = 1
+	// VideoFormatNV12 is semi planar YUV 4:2:0, the Y plane followed by interleaved U and V
+	VideoFormatNV12 VideoFormat = 2
+)
+
+// AudioFormat is the sample format of an audio frame
+type AudioFormat uint8
+
+const (
+	// AudioFormatS16LE is signed 16 bits little endian samples
+	AudioFormatS16LE AudioFormat = 1
+	// AudioFormatF32LE is 32 bits float little endian samples
+	AudioFormatF32LE AudioFormat = 2
+)
+
+const (
+	headerSize      = 16
+	formatBlockSize = 6
+
+	flagFormat = 1 << 0
+
+	// MaxPayloadSize limits the memory allocated for a frame, it fits a 4K I420 picture
+	MaxPayloadSize = 64 << 20
+)
+
+var magic = [2]byte{'W', 'F'}
+
+// ErrPayloadTooLarge is returned when writing a payload over MaxPayloadSize
+var ErrPayloadTooLarge = errors.New("framed: payload too large")
+
+// VideoInfo is the format of the video frames
+type VideoInfo struct {
+	Width  int
+	Height int
+	Format VideoFormat
+}
+
+// AudioInfo is the format of the audio frames
+type AudioInfo struct {
+	SampleRate int
+	Channels   int
+	Format     AudioFormat
+}
+
+// Frame is a frame read from the stream
+type Frame struct {
+	Type FrameType
+	PTS  time.Duration
+	// Video is the format of the frame when Type is FrameTypeVideo
+	Video VideoInfo
+	// Audio is the format of the frame when Type is FrameTypeAudio
+	Audio AudioInfo
+	// FormatChanged is set when the frame carried a format block different to the previous one
+	FormatChanged bool
+	Payload       []byte
+}
+
+// Size returns the expected payload size of a video frame with this format
+func (info VideoInfo) Size() int {
+	area := info.Width * info.Height
+	return area + 2*((info.Width+1)/2)*((info.Height+1)/2)
+}
+
+func (info VideoInfo) valid() bool {
+	return info.Width > 0 && info.Height > 0 && info.Width <= math.MaxUint16 && info.Height <= math.MaxUint16 &&
+		(info.Format == VideoFormatI420 || info.Format == VideoFormatNV12)
+}
+
+func (info AudioInfo) valid() bool {
+	return info.SampleRate > 0 && info.Channels > 0 && info.Channels <= math.MaxUint8 &&
+		(info.Format == AudioFormatS16LE || info.Format == AudioFormatF32LE)
+}
+
+// BytesPerSample returns the size of a single sample of one channel
+func (info AudioInfo) BytesPerSample() int {
+	if info.Format == AudioFormatF32LE {
+		return 4
+	}
+	return 2
+}
+
+// Reader reads frames from a stream. It keeps the last format of each frame type and resyncs
+// to the next frame header when the stream is corrupted.
+type Reader struct {
+	reader *bufio.Reader
+	video  *VideoInfo
+	audio  *AudioInfo
+
+	// OnResync is called with the number of bytes skipped to find the next header
+	OnResync func(skipped int)
+}
+
+// NewReader creates a Reader for the given stream
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		reader: bufio.NewReaderSize(r, 64<<10),
+	}
+}
+
+// ReadFrame reads the next video or audio frame, the frames of unknown types are skipped. A
+// header with a length over MaxPayloadSize or not matching the format, an invalid format, f.e.
+// with a zero width, or a frame received before its format, f.e. when the stream is joined in
+// the middle, is taken as corrupted and the stream is resynced.
+func (r *Reader) ReadFrame() (*Frame, error) {
+	skipped := 0
+	defer func() {
+		if skipped > 0 && r.OnResync != nil {
+			r.OnResync(skipped)
+		}
+	}()
+
+	for {
+		n, err := r.sync()
+		skipped += n
+		if err != nil {
+			return nil, err
+		}
+
+		peek, err := r.reader.Peek(headerSize)
+		if err != nil {
+			return nil, err
+		}
+		var header [headerSize]byte
+		copy(header[:], peek)
+
+		frame := &Frame{
+			Type: FrameType(header[2]),
+			PTS:  time.Duration(int64(binary.BigEndian.Uint64(header[8:16]))) * time.Microsecond,
+		}
+		hasFormat := header[3]&flagFormat != 0
+		length := binary.BigEndian.Uint32(header[4:8])
+		known := frame.Type == FrameTypeVideo || frame.Type == FrameTypeAudio
+
+		var block [formatBlockSize]byte
+		size := headerSize
+		if hasFormat {
+			size += formatBlockSize
+			peek, err := r.reader.Peek(size)
+			if err != nil {
+				return nil, err
+			}
+			copy(block[:], peek[headerSize:])
+		}
+
+		// the length must match the format of the frame, so a magic found in the payload of a
+		// corrupted frame is seldom taken for a header
+		valid := length <= MaxPayloadSize
+		if valid && known {
+			video, audio := r.video, r.audio
+			if hasFormat && frame.Type == FrameTypeVideo {
+				video = parseVideoFormat(block)
+			} else if hasFormat {
+				audio = parseAudioFormat(block)
+			}
+			if frame.Type == FrameTypeVideo {
+				valid = video != nil && video.valid() && int(length) == video.Size()
+				frame.FormatChanged = valid && hasFormat && (r.video == nil || *r.video != *video)
+			} else {
+				valid = audio != nil && audio.valid() && int(length)%(audio.BytesPerSample()*audio.Channels) == 0
+				frame.FormatChanged = valid && hasFormat && (r.audio == nil || *r.audio != *audio)
+			}
+			if valid {
+				r.video, r.audio = video, audio
+			}
+		}
+		if !valid {
+			// the magic isn't the start of a valid frame, the search goes on after it
+			r.reader.Discard(1)
+			skipped++
+			continue
+		}
+		r.reader.Discard(size)
+
+		if !known {
+			// unknown frame types are skipped so the protocol can be extended
+			if _, err := r.reader.Discard(int(length)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if frame.Type == FrameTypeVideo {
+			frame.Video = *r.video
+		} else {
+			frame.Audio = *r.audio
+		}
+
+		frame.Payload = make([]byte, length)
+		if _, err := io.ReadFull(r.reader, frame.Payload); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+}
+
+// sync skips bytes until the magic of a header is found
+func (r *Reader) sync() (int, error) {
+	skipped := 0
+	for {
+		peek, err := r.reader.Peek(2)
+		if err != nil {
+			return skipped, err
+		}
+		if peek[0] == magic[0] && peek[1] == magic[1] {
+			return skipped, nil
+		}
+		r.reader.Discard(1)
+		skipped++
+	}
+}
+
+func parseVideoFormat(block [formatBlockSize]byte) *VideoInfo {
+	return &VideoInfo{
+		Width:  int(binary.BigEndian.Uint16(block[0:2])),
+		Height: int(binary.BigEndian.Uint16(block[2:4])),
+		Format: VideoFormat(block[4]),
+	}
+}
+
+func parseAudioFormat(block [formatBlockSize]byte) *AudioInfo {
+	return &AudioInfo{
+		SampleRate: int(binary.BigEndian.Uint32(block[0:4])),
+		Channels:   int(block[4]),
+		Format:     AudioFormat(block[5]),
+	}
+}
+
+// Writer writes frames to a stream. The format block is only sent when it changes.
+type Writer struct {
+	writer io.Writer
+	video  *VideoInfo
+	audio  *AudioInfo
+}
+
+// NewWriter creates a Writer for the given stream
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		writer: w,
+	}
+}
+
+// WriteVideo writes a video frame, payload must be a full picture in the given format
+func (w *Writer) WriteVideo(info VideoInfo, pts time.Duration, payload []byte) error {
+	if !info.valid() {
+		return fmt.Errorf("framed: invalid video format %+v", info)
+	}
+	if len(payload) != info.Size() {
+		return fmt.Errorf("framed: invalid video payload size %d, expected %d", len(payload), info.Size())
+	}
+
+	var block []byte
+	if w.video == nil || *w.video != info {
+		block = make([]byte, formatBlockSize)
+		binary.BigEndian.PutUint16(block[0:2], uint16(info.Width))
+		binary.BigEndian.PutUint16(block[2:4], uint16(info.Height))
+		block[4] = byte(info.Format)
+		w.video = &info
+	}
+
+	return w.write(FrameTypeVideo, pts, block, payload)
+}
+
+// WriteAudio writes an audio frame, payload must contain interleaved samples in the given format
+func (w *Writer) WriteAudio(info AudioInfo, pts time.Duration, payload []byte) error {
+	if !info.valid() {
+		return fmt.Errorf("framed: invalid audio format %+v", info)
+	}
+	if len(payload)%(info.BytesPerSample()*info.Channels) != 0 {
+		return fmt.Errorf("framed: invalid audio payload size %d", len(payload))
+	}
+
+	var block []byte
+	if w.audio == nil || *w.audio != info {
+		block = make([]byte, formatBlockSize)
+		binary.BigEndian.PutUint32(block[0:4], uint32(info.SampleRate))
+		block[4] = byte(info.Channels)
+		block[5] = byte(info.Format)
+		w.audio = &info
+	}
+
+	return w.write(FrameTypeAudio, pts, block, payload)
+}
+
+func (w *Writer) write(frameType FrameType, pts time.Duration, block []byte, payload []byte) error {
+	if len(payload) > MaxPayloadSize {
+		return ErrPayloadTooLarge
+	}
+
+	buffer := make([]byte, headerSize, headerSize+len(block)+len(payload))
+	buffer[0] = magic[0]
+	buffer[1] = magic[1]
+	buffer[2] = byte(frameType)
+	if block != nil {
+		buffer[3] = flagFormat
+	}
+	binary.BigEndian.PutUint32(buffer[4:8], uint32(len(payload)))
+	binary.BigEndian.PutUint64(buffer[8:16], uint64(pts/time.Microsecond))
+	buffer = append(buffer, block...)
+	buffer = append(buffer, payload...)
+
+	// a single write keeps the frames atomic in pipes and sockets shared by several writers
+	_, err := w.writer.Write(buffer)
+	return err
+}
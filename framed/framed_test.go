@@ -0,0 +1,244 @@
+package framed
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+func videoPayload(info VideoInfo, value byte) []byte {
+	return bytes.Repeat([]byte{value}, info.Size())
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	var stream bytes.Buffer
+	w := NewWriter(&stream)
+
+	small := VideoInfo{Width: 4, Height: 2, Format: VideoFormatI420}
+	large := VideoInfo{Width: 6, Height: 4, Format: VideoFormatNV12}
+	audio := AudioInfo{SampleRate: 48000, Channels: 2, Format: AudioFormatS16LE}
+
+	if err := w.WriteVideo(small, 0, videoPayload(small, 1)); err != nil {
+		t.Fatal(err)
+	}
+	withFormat := stream.Len()
+	if err := w.WriteVideo(small, 33*time.Millisecond, videoPayload(small, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if size := stream.Len() - withFormat; size != withFormat-formatBlockSize {
+		t.Fatalf("unchanged format sent again, frame size %d", size)
+	}
+	if err := w.WriteAudio(audio, 10*time.Millisecond, make([]byte, 480*4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteVideo(large, 66*time.Millisecond, videoPayload(large, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		frameType     FrameType
+		pts           time.Duration
+		video         VideoInfo
+		audio         AudioInfo
+		formatChanged bool
+		payload       byte
+	}{
+		{FrameTypeVideo, 0, small, AudioInfo{}, true, 1},
+		{FrameTypeVideo, 33 * time.Millisecond, small, AudioInfo{}, false, 2},
+		{FrameTypeAudio, 10 * time.Millisecond, VideoInfo{}, audio, true, 0},
+		{FrameTypeVideo, 66 * time.Millisecond, large, AudioInfo{}, true, 3},
+	}
+
+	r := NewReader(&stream)
+	r.OnResync = func(skipped int) {
+		t.Fatalf("unexpected resync, skipped %d bytes", skipped)
+	}
+	for i, want := range expected {
+		frame, err := r.ReadFrame()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if frame.Type != want.frameType || frame.PTS != want.pts || frame.Video != want.video || frame.Audio != want.audio || frame.FormatChanged != want.formatChanged {
+			t.Fatalf("frame %d: got %+v", i, frame)
+		}
+		if frame.Payload[0] != want.payload {
+			t.Fatalf("frame %d: got payload %d, expected %d", i, frame.Payload[0], want.payload)
+		}
+	}
+	if _, err := r.ReadFrame(); err != io.EOF {
+		t.Fatalf("got %v at the end of the stream, expected EOF", err)
+	}
+}
+
+func TestResyncAfterGarbage(t *testing.T) {
+	info := VideoInfo{Width: 2, Height: 2, Format: VideoFormatI420}
+	var frames bytes.Buffer
+	w := NewWriter(&frames)
+	w.WriteVideo(info, 0, videoPayload(info, 1))
+	first := frames.Len()
+	w.WriteVideo(info, time.Millisecond, videoPayload(info, 2))
+
+	// garbage with the header of a frame without format, and the stream joined in the middle
+	// of the first frame
+	garbage := []byte("xxWF\x01\x00\x00\x00\x00\x01yy")
+	var stream bytes.Buffer
+	stream.Write(garbage)
+	stream.Write(frames.Bytes()[3:first])
+	stream.Write(frames.Bytes())
+
+	skipped := 0
+	r := NewReader(&stream)
+	r.OnResync = func(n int) {
+		skipped += n
+	}
+	frame, err := r.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Payload[0] != 1 {
+		t.Fatalf("got payload %d, expected 1", frame.Payload[0])
+	}
+	if expected := len(garbage) + first - 3; skipped != expected {
+		t.Fatalf("skipped %d bytes, expected %d", skipped, expected)
+	}
+}
+
+func TestResyncFrameBeforeFormat(t *testing.T) {
+	info := VideoInfo{Width: 2, Height: 2, Format: VideoFormatI420}
+	var stream bytes.Buffer
+	w := NewWriter(&stream)
+	w.WriteVideo(info, 0, videoPayload(info, 1))
+	first := stream.Len()
+	w.WriteVideo(info, time.Millisecond, videoPayload(info, 2))
+	second := stream.Len() - first
+	w.WriteVideo(VideoInfo{Width: 4, Height: 2, Format: VideoFormatI420}, 2*time.Millisecond, bytes.Repeat([]byte{3}, 12))
+
+	// joined after the format block, the frames until the next one are skipped
+	stream.Next(first)
+	skipped := 0
+	r := NewReader(&stream)
+	r.OnResync = func(n int) {
+		skipped += n
+	}
+	frame, err := r.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Payload[0] != 3 || !frame.FormatChanged {
+		t.Fatalf("got %+v, expected the frame with the format", frame)
+	}
+	if skipped != second {
+		t.Fatalf("skipped %d bytes, expected %d", skipped, second)
+	}
+}
+
+func TestUnknownTypes(t *testing.T) {
+	info := AudioInfo{SampleRate: 8000, Channels: 1, Format: AudioFormatS16LE}
+	var stream bytes.Buffer
+	w := NewWriter(&stream)
+	if err := w.write(FrameType(7), 0, make([]byte, formatBlockSize), []byte("metadata")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteAudio(info, time.Millisecond, []byte{1, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(&stream)
+	r.OnResync = func(skipped int) {
+		t.Fatalf("unexpected resync, skipped %d bytes", skipped)
+	}
+	frame, err := r.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != FrameTypeAudio || frame.Audio != info {
+		t.Fatalf("got %+v, expected the audio frame", frame)
+	}
+}
+
+func TestSizeLimit(t *testing.T) {
+	w := NewWriter(&bytes.Buffer{})
+	if err := w.write(FrameTypeAudio, 0, nil, make([]byte, MaxPayloadSize+1)); err != ErrPayloadTooLarge {
+		t.Fatalf("got %v writing a payload over the limit, expected ErrPayloadTooLarge", err)
+	}
+
+	// a header with a length over the limit is skipped as corrupted
+	var stream bytes.Buffer
+	header := make([]byte, headerSize)
+	copy(header, magic[:])
+	header[2] = byte(FrameTypeAudio)
+	binary.BigEndian.PutUint32(header[4:8], MaxPayloadSize+1)
+	stream.Write(header)
+	info := AudioInfo{SampleRate: 8000, Channels: 1, Format: AudioFormatS16LE}
+	NewWriter(&stream).WriteAudio(info, 0, []byte{1, 0})
+
+	skipped := 0
+	r := NewReader(&stream)
+	r.OnResync = func(n int) {
+		skipped += n
+	}
+	frame, err := r.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != FrameTypeAudio || len(frame.Payload) != 2 {
+		t.Fatalf("got %+v, expected the audio frame", frame)
+	}
+	if skipped != headerSize {
+		t.Fatalf("skipped %d bytes, expected %d", skipped, headerSize)
+	}
+}
+
+func TestInvalidFrames(t *testing.T) {
+	info := VideoInfo{Width: 2, Height: 2, Format: VideoFormatI420}
+	header := func(frameType FrameType, length int, block []byte) []byte {
+		buffer := make([]byte, headerSize, headerSize+len(block))
+		copy(buffer, magic[:])
+		buffer[2] = byte(frameType)
+		if block != nil {
+			buffer[3] = flagFormat
+		}
+		binary.BigEndian.PutUint32(buffer[4:8], uint32(length))
+		return append(buffer, block...)
+	}
+
+	tests := []struct {
+		name    string
+		corrupt []byte
+	}{
+		{"video length not matching the format", header(FrameTypeVideo, 5, []byte{0, 2, 0, 2, 1, 0})},
+		{"zero width", header(FrameTypeVideo, 0, []byte{0, 0, 0, 2, 1, 0})},
+		{"zero height", header(FrameTypeVideo, 0, []byte{0, 2, 0, 0, 1, 0})},
+		{"unknown pixel format", header(FrameTypeVideo, 6, []byte{0, 2, 0, 2, 9, 0})},
+		{"audio length not matching the format", header(FrameTypeAudio, 3, []byte{0, 0, 0x1f, 0x40, 1, 1})},
+		{"no audio channels", header(FrameTypeAudio, 0, []byte{0, 0, 0x1f, 0x40, 0, 1})},
+	}
+	for _, test := range tests {
+		var stream bytes.Buffer
+		stream.Write(test.corrupt)
+		NewWriter(&stream).WriteVideo(info, 0, videoPayload(info, 1))
+
+		skipped := 0
+		r := NewReader(&stream)
+		r.OnResync = func(n int) {
+			skipped += n
+		}
+		frame, err := r.ReadFrame()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if frame.Video != info || frame.Payload[0] != 1 || skipped != len(test.corrupt) {
+			t.Errorf("%s: got %+v after skipping %d bytes, expected the valid frame after %d", test.name, frame, skipped, len(test.corrupt))
+		}
+	}
+
+	w := NewWriter(&bytes.Buffer{})
+	if err := w.WriteVideo(VideoInfo{Width: 0, Height: 2, Format: VideoFormatI420}, 0, nil); err == nil {
+		t.Error("a video frame with a zero width was written")
+	}
+	if err := w.WriteAudio(AudioInfo{SampleRate: 8000, Format: AudioFormatS16LE}, 0, nil); err == nil {
+		t.Error("an audio frame without channels was written")
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"sync"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/wave"
+
+	"whip-go/framed"
+)
+
+const (
+	// framedVideoQueue and framedAudioQueue are the frames of each kind queued by a framed stream,
+	// a track that isn't read loses the oldest ones instead of stalling the other one
+	framedVideoQueue = 2
+	framedAudioQueue = 10
+)
+
+var (
+	framedStreamsMu sync.Mutex
+	framedStreams   = make(map[string]*framedStream)
+)
+
+// framedStream reads a framed stream once for the video and the audio tracks of the same URI, and
+// queues the frames of each kind for its track. It's read from the first read of a track, so
+// both tracks are created by then.
+type framedStream struct {
+	key   string
+	name  string
+	clock *mediaClock
+	in    *reconnectingInput
+
+	mu     sync.Mutex
+	queues map[mediadevices.MediaDeviceType]*frameQueue
+	refs   int
+}
+
+// newFramedTrack creates a track reading the frames of its kind of the framed stream of the uri,
+// the stream is read with the connector created by newConnector for the first track
+func newFramedTrack(uri *SourceURI, kind mediadevices.MediaDeviceType, selector *CodecSelector, newConnector func() (streamConnector, error)) (mediadevices.Track, error) {
+	// the fillers sent while the producer is disconnected have the format of the raw options
+	width, height, sampleRate, channels, err := streamFormat(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	key := uri.String() + "?" + fmt.Sprint(uri.options)
+	framedStreamsMu.Lock()
+	defer framedStreamsMu.Unlock()
+
+	stream, ok := framedStreams[key]
+	if !ok {
+		connector, err := newConnector()
+		if err != nil {
+			return nil, err
+		}
+		stream = &framedStream{
+			key:    key,
+			name:   uri.String(),
+			clock:  selector.clock,
+			in:     newReconnectingInput(connector),
+			queues: make(map[mediadevices.MediaDeviceType]*frameQueue),
+		}
+		framedStreams[key] = stream
+	}
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if _, ok := stream.queues[kind]; ok {
+		return nil, fmt.Errorf("framed input %s already used for %s", uri, kindName(kind))
+	}
+	stream.refs++
+
+	if kind == mediadevices.AudioInput {
+		queue := newFrameQueue(framedAudioQueue, DropOldest)
+		stream.queues[kind] = queue
+		info := wave.ChunkInfo{Len: sampleRate / 100, Channels: channels, SamplingRate: sampleRate}
+		reader := newFillingAudioReader(stream.in, queue.items, selector.clock, info)
+		return newAudioTrackFromReader(&closableAudioReader{Reader: audio.ReaderFunc(func() (wave.Audio, func(), error) {
+			stream.in.start(stream.read)
+			return reader.Read()
+		}), Closer: stream}, selector), nil
+	}
+	queue := newFrameQueue(framedVideoQueue, DropOldest)
+	stream.queues[kind] = queue
+	reader := newFillingVideoReader(stream.in, queue.items, selector.clock, image.Pt(width, height))
+	return newVideoTrackFromReader(&closableVideoReader{Reader: video.ReaderFunc(func() (image.Image, func(), error) {
+		stream.in.start(stream.read)
+		return reader.Read()
+	}), Closer: stream}, selector), nil
+}
+
+// Close closes the input once the tracks of both kinds are closed
+func (stream *framedStream) Close() error {
+	framedStreamsMu.Lock()
+	defer framedStreamsMu.Unlock()
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	if stream.refs--; stream.refs > 0 {
+		return nil
+	}
+	if framedStreams[stream.key] == stream {
+		delete(framedStreams, stream.key)
+	}
+	return stream.in.Close()
+}
+
+// read queues the frames of a connection of the stream until it ends
+func (stream *framedStream) read(r io.Reader) {
+	reader := newFramedReader(r)
+	var video framed.VideoInfo
+	var audio framed.AudioInfo
+
+	for {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			log.Printf("Input %s disconnected: %v", stream.name, err)
+			return
+		}
+
+		var item interface{}
+		kind := mediadevices.VideoInput
+		switch frame.Type {
+		case framed.FrameTypeVideo:
+			if frame.FormatChanged && video != (framed.VideoInfo{}) {
+				log.Printf("Framed video input changed from %dx%d to %dx%d", video.Width, video.Height, frame.Video.Width, frame.Video.Height)
+			}
+			video = frame.Video
+
+			yuv, err := framedVideoImage(frame)
+			if err != nil {
+				// drop the frame, the next header resyncs the stream
+				log.Println(err)
+				continue
+			}
+			item = streamImage{WithPresentationTimestamp(yuv, stream.clock.fromInput(frame.PTS)), func() {}}
+		case framed.FrameTypeAudio:
+			if frame.FormatChanged && audio != (framed.AudioInfo{}) {
+				log.Printf("Framed audio input changed from %dHz %d channels to %dHz %d channels", audio.SampleRate, audio.Channels, frame.Audio.SampleRate, frame.Audio.Channels)
+			}
+			audio = frame.Audio
+
+			chunk, err := framedAudioChunk(frame)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			item = streamChunk{WithAudioPresentationTimestamp(chunk, stream.clock.fromInput(frame.PTS)), func() {}}
+			kind = mediadevices.AudioInput
+		}
+
+		// the frames of a kind without track are dropped
+		stream.mu.Lock()
+		queue := stream.queues[kind]
+		stream.mu.Unlock()
+		if queue != nil {
+			queue.push(item)
+		}
+	}
+}
+
+// streamOnce is the connector of a stream that is only read once, f.e. a file, the input ends
+// with the stream
+type streamOnce struct {
+	name   string
+	stream io.ReadCloser
+	read   bool
+}
+
+func newStreamOnce(name string, stream io.Reader) *streamOnce {
+	closer, ok := stream.(io.Closer)
+	if !ok {
+		closer = ioutil.NopCloser(nil)
+	}
+	return &streamOnce{name: name, stream: struct {
+		io.Reader
+		io.Closer
+	}{stream, closer}}
+}
+
+func (once *streamOnce) connect() (io.ReadCloser, error) {
+	if once.read {
+		return nil, io.EOF
+	}
+	once.read = true
+	return once.stream, nil
+}
+
+func (once *streamOnce) Close() error {
+	return once.stream.Close()
+}
+
+func (once *streamOnce) String() string {
+	return once.name
+}
+
+func newFramedReader(r io.Reader) *framed.Reader {
+	reader := framed.NewReader(r)
+	reader.OnResync = func(skipped int) {
+		log.Printf("Framed input out of sync, skipped %d bytes", skipped)
+	}
+	return reader
+}
+
+func framedVideoImage(frame *framed.Frame) (image.Image, error) {
+	info := frame.Video
+	if len(frame.Payload) != info.Size() {
+		return nil, fmt.Errorf("invalid framed video payload size %d for %dx%d", len(frame.Payload), info.Width, info.Height)
+	}
+
+	yuv := image.NewYCbCr(image.Rect(0, 0, info.Width, info.Height), image.YCbCrSubsampleRatio420)
+	area := len(yuv.Y)
+	chroma := len(yuv.Cb)
+	copy(yuv.Y, frame.Payload[:area])
+
+	switch info.Format {
+	case framed.VideoFormatI420:
+		copy(yuv.Cb, frame.Payload[area:area+chroma])
+		copy(yuv.Cr, frame.Payload[area+chroma:])
+	case framed.VideoFormatNV12:
+		uv := frame.Payload[area:]
+		for i := 0; i < chroma; i++ {
+			yuv.Cb[i] = uv[2*i]
+			yuv.Cr[i] = uv[2*i+1]
+		}
+	default:
+		return nil, fmt.Errorf("unsupported framed video format %d", info.Format)
+	}
+
+	return yuv, nil
+}
+
+func framedAudioChunk(frame *framed.Frame) (wave.Audio, error) {
+	info := frame.Audio
+	frameSize := info.BytesPerSample() * info.Channels
+	if frameSize == 0 || len(frame.Payload)%frameSize != 0 {
+		return nil, fmt.Errorf("invalid framed audio payload size %d for %d channels", len(frame.Payload), info.Channels)
+	}
+
+	chunkInfo := wave.ChunkInfo{
+		Len:          len(frame.Payload) / frameSize,
+		Channels:     info.Channels,
+		SamplingRate: info.SampleRate,
+	}
+
+	switch info.Format {
+	case framed.AudioFormatS16LE:
+		chunk := wave.NewInt16Interleaved(chunkInfo)
+		for i := range chunk.Data {
+			chunk.Data[i] = int16(binary.LittleEndian.Uint16(frame.Payload[2*i:]))
+		}
+		return chunk, nil
+	case framed.AudioFormatF32LE:
+		chunk := wave.NewFloat32Interleaved(chunkInfo)
+		for i := range chunk.Data {
+			chunk.Data[i] = math.Float32frombits(binary.LittleEndian.Uint32(frame.Payload[4*i:]))
+		}
+		return chunk, nil
+	default:
+		return nil, fmt.Errorf("unsupported framed audio format %d", info.Format)
+	}
+}
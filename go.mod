@@ -24,4 +24,5 @@ require (
 	github.com/pion/webrtc/v3 v3.1.47
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/satori/go.uuid v1.2.0 // indirect
+	golang.org/x/image v0.0.0-20220902085622-e7cb96979f69
 )
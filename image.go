@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/io/video"
+)
+
+func init() {
+	RegisterSource("image", SourceFactory{
+		Description: "PNG or JPEG still image sent as video, f.e. a slate for the switch source, image:/tmp/slate.png",
+		Kinds:       videoKinds,
+		Options: []SourceOption{
+			{"fps", "5", "frame rate of the video"},
+		},
+		NewTrack: func(uri *SourceURI, kind mediadevices.MediaDeviceType, selector *CodecSelector) (mediadevices.Track, error) {
+			frameRate, err := uri.IntOption("fps")
+			if err != nil {
+				return nil, err
+			}
+			if frameRate <= 0 {
+				return nil, fmt.Errorf("invalid fps option %d of image input", frameRate)
+			}
+			reader, err := newImageReader(uri.Path, frameRate, selector)
+			if err != nil {
+				return nil, err
+			}
+			return newVideoTrackFromReader(reader, selector), nil
+		},
+	})
+}
+
+// newImageReader sends the image converted to 4:2:0 at the frame rate, timestamped on the media
+// clock
+func newImageReader(path string, frameRate int, selector *CodecSelector) (video.Reader, error) {
+	frame, err := loadImageFrame(path)
+	if err != nil {
+		return nil, err
+	}
+
+	frameDuration := time.Second / time.Duration(frameRate)
+	var start time.Duration
+	var frames int64
+
+	return video.ReaderFunc(func() (img image.Image, release func(), err error) {
+		if frames == 0 {
+			start = selector.clock.now()
+		}
+		pts := start + time.Duration(frames)*frameDuration
+		if wait := pts - selector.clock.now(); wait > 0 {
+			time.Sleep(wait)
+		}
+		frames++
+
+		// the filters and the overlays may draw on the frame
+		return WithPresentationTimestamp(copyYCbCr(frame), pts), func() {}, nil
+	}), nil
+}
+
+// loadImageFrame decodes a PNG or JPEG image as a 4:2:0 frame of even size
+func loadImageFrame(path string) (*image.YCbCr, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image %s: %w", path, err)
+	}
+	// chroma samples cover 2x2 pixels
+	size := img.Bounds().Size()
+	return cropFrame(toYCbCr420(img), even(size.X), even(size.Y), 0, 0), nil
+}
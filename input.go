@@ -7,8 +7,8 @@ import (
 	"fmt"
 	"image"
 	"io"
+	"log"
 	"math"
-	"os"
 	"strings"
 	"sync"
 	"time"
@@ -26,22 +26,86 @@ import (
 	"github.com/pion/webrtc/v3"
 )
 
-func GetInputMediaStream(audio string, video string, codecSelector *CodecSelector) (mediadevices.MediaStream, error) {
+// MediaStreamOption is a type for specifying the options of GetInputMediaStream
+type MediaStreamOption func(*mediaStreamConfig)
+
+type mediaStreamConfig struct {
+	streamID string
+	audioIDs []string
+	videoIDs []string
+}
+
+// WithStreamID sets the ID of the stream, the msid grouping the tracks in the SDP
+func WithStreamID(id string) MediaStreamOption {
+	return func(config *mediaStreamConfig) {
+		config.streamID = id
+	}
+}
+
+// WithAudioTrackIDs sets the IDs of the audio tracks in the order of the inputs, the tracks
+// without ID are labeled audio-<position>
+func WithAudioTrackIDs(ids ...string) MediaStreamOption {
+	return func(config *mediaStreamConfig) {
+		config.audioIDs = ids
+	}
+}
+
+// WithVideoTrackIDs sets the IDs of the video tracks in the order of the inputs, the tracks
+// without ID are labeled video-<position>
+func WithVideoTrackIDs(ids ...string) MediaStreamOption {
+	return func(config *mediaStreamConfig) {
+		config.videoIDs = ids
+	}
+}
+
+// GetInputMediaStream builds a stream with a track for each of the given audio and video input
+// URIs. Every input, including screen capture and test sources, is encoded with its own encoder
+// using the codecs in codecSelector. The tracks share the stream ID, so they are grouped in one
+// msid in the SDP. The IDs are random for the stream and labels by kind and position for the
+// tracks, f.e. video-0, video-1 and audio-0, unless they are set with the options.
+func GetInputMediaStream(audios []string, videos []string, codecSelector *CodecSelector, opts ...MediaStreamOption) (mediadevices.MediaStream, error) {
+	if err := validateInputs(audios, videos, codecSelector); err != nil {
+		return nil, err
+	}
+
+	config := mediaStreamConfig{}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if config.streamID == "" {
+		config.streamID = newRandomID()
+	}
+	audioIDs, err := trackIDs(config.audioIDs, len(audios), "audio")
+	if err != nil {
+		return nil, err
+	}
+	videoIDs, err := trackIDs(config.videoIDs, len(videos), "video")
+	if err != nil {
+		return nil, err
+	}
+	if err := validateIDs(config.streamID, append(audioIDs, videoIDs...)); err != nil {
+		return nil, err
+	}
+
 	tracks := make([]mediadevices.Track, 0)
 
-	if len(audio) > 0 {
+	for i, audio := range audios {
 		track, err := GetAudioTrack(audio, codecSelector)
 		if err != nil {
 			return nil, err
 		}
+		setTrackIDs(track, audioIDs[i], config.streamID)
+		registerMutableTrack(track)
 		tracks = append(tracks, track)
 	}
 
-	if len(video) > 0 {
+	for i, video := range videos {
 		track, err := GetVideoTrack(video, codecSelector)
 		if err != nil {
 			return nil, err
 		}
+		setTrackIDs(track, videoIDs[i], config.streamID)
+		registerMutableTrack(track)
 		tracks = append(tracks, track)
 	}
 
@@ -53,43 +117,161 @@ func GetInputMediaStream(audio string, video string, codecSelector *CodecSelecto
 	return stream, nil
 }
 
+// trackIDs returns the IDs of count tracks of a kind, labeling the ones without ID
+func trackIDs(ids []string, count int, kind string) ([]string, error) {
+	if len(ids) > count {
+		return nil, fmt.Errorf("%d %s track IDs given for %d %s inputs", len(ids), kind, count, kind)
+	}
+	labels := make([]string, count)
+	for i := range labels {
+		labels[i] = fmt.Sprintf("%s-%d", kind, i)
+		if i < len(ids) && ids[i] != "" {
+			labels[i] = ids[i]
+		}
+	}
+	return labels, nil
+}
+
+// validateIDs checks the IDs are valid msid identifiers, up to 64 token characters as in
+// RFC 8830, and the track IDs are unique
+func validateIDs(streamID string, trackIDs []string) error {
+	seen := make(map[string]bool)
+	for i, id := range append([]string{streamID}, trackIDs...) {
+		if len(id) == 0 || len(id) > 64 {
+			return fmt.Errorf("invalid ID %q, it must have from 1 to 64 characters", id)
+		}
+		for _, c := range id {
+			if c <= ' ' || c >= 0x7f || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c) {
+				return fmt.Errorf("invalid ID %q, it can't contain %q", id, c)
+			}
+		}
+		if i > 0 && seen[id] {
+			return fmt.Errorf("duplicated track ID %s", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+func newRandomID() string {
+	generator, err := uuid.NewRandom()
+	if err != nil {
+		panic(err)
+	}
+	return generator.String()
+}
+
+// validateInputs rejects the combinations of inputs and codecs that can't be published
+func validateInputs(audios []string, videos []string, codecSelector *CodecSelector) error {
+	if len(audios) == 0 && len(videos) == 0 {
+		return errors.New("no audio or video input specified")
+	}
+
+	if len(audios) > 0 && len(codecSelector.audioEncoders) == 0 {
+		return errors.New("audio input specified but no audio encoder configured")
+	}
+	for _, audio := range audios {
+		if err := validateSource(audio, mediadevices.AudioInput); err != nil {
+			return err
+		}
+	}
+
+	if len(videos) > 0 && len(codecSelector.videoEncoders) == 0 {
+		return errors.New("video input specified but no video encoder configured")
+	}
+	for _, video := range videos {
+		if err := validateSource(video, mediadevices.VideoInput); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetAudioTrack creates the track of an audio input URI, see RegisterSource
 func GetAudioTrack(name string, codecSelector *CodecSelector) (mediadevices.Track, error) {
-	pipe, _ := os.Open(name)
-	data := make([]byte, 480*2)
+	return newSourceTrack(name, mediadevices.AudioInput, codecSelector)
+}
+
+// GetVideoTrack creates the track of a video input URI, see RegisterSource
+func GetVideoTrack(name string, codecSelector *CodecSelector) (mediadevices.Track, error) {
+	return newSourceTrack(name, mediadevices.VideoInput, codecSelector)
+}
+
+// newRawAudioReader reads 10ms chunks of S16LE samples
+func newRawAudioReader(r io.Reader, sampleRate int, channels int) audio.Reader {
 	chunkInfo := wave.ChunkInfo{
-		Len:          480,
-		Channels:     1,
-		SamplingRate: 48000,
+		Len:          sampleRate / 100,
+		Channels:     channels,
+		SamplingRate: sampleRate,
 	}
+	data := make([]byte, chunkInfo.Len*channels*2)
 
-	reader := audio.ReaderFunc(func() (chunk wave.Audio, release func(), err error) {
-		_, err = io.ReadFull(pipe, data)
+	return audio.ReaderFunc(func() (chunk wave.Audio, release func(), err error) {
+		_, err = io.ReadFull(r, data)
 		buffer := wave.NewInt16Interleaved(chunkInfo)
 		binary.Read(bytes.NewReader(data), binary.LittleEndian, buffer.Data)
 		chunk = buffer
 		return chunk, func() {}, err
 	})
-	track := newAudioTrackFromReader(reader, codecSelector)
-	return track, nil
 }
 
-func GetVideoTrack(name string, codecSelector *CodecSelector) (mediadevices.Track, error) {
-	pipe, _ := os.Open(name)
-	area := 1280 * 720
-	data := make([]byte, 1280*720*1.5)
+// newRawVideoReader reads I420 frames
+func newRawVideoReader(r io.Reader, width int, height int) video.Reader {
+	rect := image.Rect(0, 0, width, height)
+	area := width * height
+	chroma := ((width + 1) / 2) * ((height + 1) / 2)
+	data := make([]byte, area+2*chroma)
 
-	reader := video.ReaderFunc(func() (img image.Image, release func(), err error) {
-		_, err = io.ReadFull(pipe, data)
-		yuv := image.NewYCbCr(image.Rect(0, 0, 1280, 720), image.YCbCrSubsampleRatio420)
+	return video.ReaderFunc(func() (img image.Image, release func(), err error) {
+		_, err = io.ReadFull(r, data)
+		yuv := image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
 
 		copy(yuv.Y, data[0:area])
-		copy(yuv.Cb, data[area:area+area/4])
-		copy(yuv.Cr, data[area+area/4:area+area/4+area/4])
+		copy(yuv.Cb, data[area:area+chroma])
+		copy(yuv.Cr, data[area+chroma:area+2*chroma])
 		img = yuv
 		return img, func() {}, err
 	})
-	track := newVideoTrackFromReader(reader, codecSelector)
-	return track, nil
+}
+
+func getScreenVideoTrack(codecSelector *CodecSelector) (mediadevices.Track, error) {
+	stream, err := mediadevices.GetDisplayMedia(mediadevices.MediaStreamConstraints{
+		Video: func(constraint *mediadevices.MediaTrackConstraints) {},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return newVideoTrackFromDevice(stream.GetVideoTracks(), codecSelector)
+}
+
+// newVideoTrackFromDevice reads the raw frames captured by a mediadevices driver so they are
+// encoded with our own CodecSelector like any other input.
+func newVideoTrackFromDevice(tracks []mediadevices.Track, codecSelector *CodecSelector) (mediadevices.Track, error) {
+	if len(tracks) == 0 {
+		return nil, errors.New("no video track captured")
+	}
+	deviceTrack, ok := tracks[0].(*mediadevices.VideoTrack)
+	if !ok {
+		return nil, fmt.Errorf("unexpected video track type %T", tracks[0])
+	}
+
+	return newVideoTrackFromReader(deviceTrack.NewReader(false), codecSelector), nil
+}
+
+// newAudioTrackFromDevice reads the raw chunks captured by a mediadevices driver so they are
+// encoded with our own CodecSelector like any other input.
+func newAudioTrackFromDevice(tracks []mediadevices.Track, codecSelector *CodecSelector) (mediadevices.Track, error) {
+	if len(tracks) == 0 {
+		return nil, errors.New("no audio track captured")
+	}
+	deviceTrack, ok := tracks[0].(*mediadevices.AudioTrack)
+	if !ok {
+		return nil, fmt.Errorf("unexpected audio track type %T", tracks[0])
+	}
+
+	return newAudioTrackFromReader(deviceTrack.NewReader(false), codecSelector), nil
 }
 
 type baseTrack struct {
@@ -101,6 +283,52 @@ type baseTrack struct {
 	kind                  mediadevices.MediaDeviceType
 	selector              *CodecSelector
 	activePeerConnections map[string]chan<- chan<- struct{}
+	// keyFrameControllers are the encoders of the active peer connections
+	keyFrameControllers map[string]codec.KeyFrameController
+	// sharedEncoders are the encoders shared by the peer connections, by codec
+	sharedEncoders map[string]*sharedEncoder
+	// id and streamID are the msid of the track in the SDP, the stream ID is random for the
+	// tracks that are not part of a stream
+	id       string
+	streamID string
+	// closer releases the input read by the track, f.e. the connection of a socket input
+	closer    io.Closer
+	closeOnce sync.Once
+
+	// frameEncoder is the encoder of EncodeFrames
+	frameEncoder *frameEncoder
+
+	encodedMu sync.Mutex
+	// encodedHandlers receive the encoded frames of the encoder of EncodeFrames, f.e. the recorder
+	encodedHandlers []func(EncodedFrame)
+	// encodedSource is the reader of the encoder of EncodeFrames, the frames of the other encoders
+	// are not passed to the handlers
+	encodedSource mediadevices.EncodedReadCloser
+}
+
+// EncodedFrame is an encoded video frame or audio packet sent to a peer connection. Data is only
+// valid during the call of the handler.
+type EncodedFrame struct {
+	MimeType  string
+	ClockRate uint32
+	Data      []byte
+	// PTS is the presentation timestamp on the media clock shared by the tracks
+	PTS      time.Duration
+	KeyFrame bool
+	// Width and Height are the size of the video frames
+	Width  int
+	Height int
+}
+
+// setTrackIDs sets the msid of the tracks built on baseTrack, other tracks keep their own
+func setTrackIDs(track mediadevices.Track, id string, streamID string) {
+	if track, ok := track.(interface{ setIDs(string, string) }); ok {
+		track.setIDs(id, streamID)
+	}
+}
+
+func (track *baseTrack) setIDs(id string, streamID string) {
+	track.id, track.streamID = id, streamID
 }
 
 func newBaseTrack(kind mediadevices.MediaDeviceType, selector *CodecSelector) *baseTrack {
@@ -109,14 +337,19 @@ func newBaseTrack(kind mediadevices.MediaDeviceType, selector *CodecSelector) *b
 		kind:                  kind,
 		selector:              selector,
 		activePeerConnections: make(map[string]chan<- chan<- struct{}),
+		keyFrameControllers:   make(map[string]codec.KeyFrameController),
+		sharedEncoders:        make(map[string]*sharedEncoder),
+		streamID:              newRandomID(),
 	}
 }
 
+// InputSource is the mediadevices.Source of the tracks, its ID is generated once
 type InputSource struct {
+	id string
 }
 
 func NewSource() InputSource {
-	return InputSource{}
+	return InputSource{id: newRandomID()}
 }
 
 func (source InputSource) Close() error {
@@ -124,30 +357,41 @@ func (source InputSource) Close() error {
 }
 
 func (source InputSource) ID() string {
-	generator, err := uuid.NewRandom()
-	if err != nil {
-		panic(err)
-	}
-
-	return generator.String()
+	return source.id
 }
 
 type AudioTrack struct {
 	*baseTrack
 	*audio.Broadcaster
+	*trackMute
 }
 
 type VideoTrack struct {
 	*baseTrack
 	*video.Broadcaster
+	*trackMute
 	shouldCopyFrames bool
+	bitrate          *bitrateMeter
 }
 
 const (
 	rtpOutboundMTU = 1200
 	rtcpInboundMTU = 1500
+
+	maxAudioClockLag = time.Second
 )
 
+// Close stops reading the input of the track
+func (track *baseTrack) Close() error {
+	var err error
+	track.closeOnce.Do(func() {
+		if track.closer != nil {
+			err = track.closer.Close()
+		}
+	})
+	return err
+}
+
 // Kind returns track's kind
 func (track *baseTrack) Kind() webrtc.RTPCodecType {
 	switch track.kind {
@@ -160,14 +404,17 @@ func (track *baseTrack) Kind() webrtc.RTPCodecType {
 	}
 }
 
-func (track *baseTrack) StreamID() string {
-	// TODO: StreamID should be used to group multiple tracks. Should get this information from mediastream instead.
-	generator, err := uuid.NewRandom()
-	if err != nil {
-		panic(err)
+// ID returns the label of the track
+func (track *baseTrack) ID() string {
+	if track.id != "" {
+		return track.id
 	}
+	return track.Source.ID()
+}
 
-	return generator.String()
+// StreamID returns the ID grouping the tracks of the stream
+func (track *baseTrack) StreamID() string {
+	return track.streamID
 }
 
 // RID is only relevant if you wish to use Simulcast
@@ -205,6 +452,198 @@ func (track *baseTrack) onError(err error) {
 	}
 }
 
+// ForceKeyFrame asks the encoders of all the peer connections for a keyframe right away,
+// regardless of the keyframe policy
+func (track *baseTrack) ForceKeyFrame() error {
+	track.mu.Lock()
+	defer track.mu.Unlock()
+
+	for _, controller := range track.keyFrameControllers {
+		if err := controller.ForceKeyFrame(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OnEncodedFrame adds a handler called with every frame of the encoder started by EncodeFrames, so
+// what is published can be recorded as it is. The handler is called from the encoding goroutine,
+// so it should not block.
+func (track *baseTrack) OnEncodedFrame(handler func(EncodedFrame)) {
+	track.encodedMu.Lock()
+	defer track.encodedMu.Unlock()
+	track.encodedHandlers = append(track.encodedHandlers, handler)
+}
+
+// encodedFramesID is the ID of the encoder of EncodeFrames among the peer connections
+const encodedFramesID = "encoded-frames"
+
+// frameEncoder is the encoder whose frames are passed to the handlers of OnEncodedFrame
+type frameEncoder struct {
+	mimeType string
+	reader   mediadevices.RTPReadCloser
+	users    int
+	stop     chan struct{}
+}
+
+// frameEncoderUser releases the encoder of EncodeFrames once
+type frameEncoderUser struct {
+	track   *baseTrack
+	encoder *frameEncoder
+	once    sync.Once
+}
+
+func (user *frameEncoderUser) Close() error {
+	user.once.Do(func() {
+		user.track.releaseFrameEncoder(user.encoder)
+	})
+	return nil
+}
+
+// EncodeFrames runs an encoder of the codec whose frames are passed to the handlers of
+// OnEncodedFrame, also while no peer connection is bound. With WithSharedEncoder it is the encoder
+// of the peer connections using the codec, otherwise an encoder of its own, so the handlers get
+// the frames of a single encoder. The callers share it until they all close it, and it can't be
+// started with another codec meanwhile.
+func (track *VideoTrack) EncodeFrames(mimeType string) (io.Closer, error) {
+	return track.encodeFrames(mimeType, track)
+}
+
+// EncodeFrames runs an encoder of the codec whose frames are passed to the handlers of
+// OnEncodedFrame, see VideoTrack.EncodeFrames
+func (track *AudioTrack) EncodeFrames(mimeType string) (io.Closer, error) {
+	return track.encodeFrames(mimeType, track)
+}
+
+// encoderMimeTypes returns the codecs of the encoders of the track, in the order of the selector
+func (track *baseTrack) encoderMimeTypes() []string {
+	var mimeTypes []string
+	if track.kind == mediadevices.VideoInput {
+		for _, encoder := range track.selector.videoEncoders {
+			mimeTypes = append(mimeTypes, encoder.RTPCodec().MimeType)
+		}
+	} else {
+		for _, encoder := range track.selector.audioEncoders {
+			mimeTypes = append(mimeTypes, encoder.RTPCodec().MimeType)
+		}
+	}
+	return mimeTypes
+}
+
+func (track *baseTrack) encodeFrames(mimeType string, specializedTrack mediadevices.Track) (io.Closer, error) {
+	track.mu.Lock()
+	defer track.mu.Unlock()
+
+	encoder := track.frameEncoder
+	if encoder != nil && !strings.EqualFold(encoder.mimeType, mimeType) {
+		return nil, fmt.Errorf("the frames of the track are already encoded with %s", encoder.mimeType)
+	}
+	if encoder == nil {
+		var reader mediadevices.RTPReadCloser
+		var err error
+		if track.selector.sharedEncoder {
+			reader, err = track.sharedRTPReader(encodedFramesID, mimeType, specializedTrack)
+		} else {
+			reader, err = specializedTrack.NewRTPReader(mimeType, 0, rtpOutboundMTU)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// the frames are identified by the reader of the encoder, which is shared with the peer
+		// connections with WithSharedEncoder
+		source, _ := reader.(*rtpReadCloserImpl)
+		if _, ok := reader.(*sharedEncoderReader); ok {
+			source, _ = track.sharedEncoders[strings.ToLower(mimeType)].reader.(*rtpReadCloserImpl)
+		}
+		encoder = &frameEncoder{mimeType: mimeType, reader: reader, stop: make(chan struct{})}
+		track.frameEncoder = encoder
+		if controller, ok := reader.Controller().(codec.KeyFrameController); ok {
+			track.keyFrameControllers[encodedFramesID] = controller
+		}
+		track.encodedMu.Lock()
+		if source != nil {
+			track.encodedSource = source.encoded
+		}
+		track.encodedMu.Unlock()
+		go track.runFrameEncoder(encoder)
+	}
+	encoder.users++
+	return &frameEncoderUser{track: track, encoder: encoder}, nil
+}
+
+// releaseFrameEncoder stops the encoder of EncodeFrames once all its users closed it
+func (track *baseTrack) releaseFrameEncoder(encoder *frameEncoder) {
+	track.mu.Lock()
+	defer track.mu.Unlock()
+
+	if encoder.users--; encoder.users == 0 && track.frameEncoder == encoder {
+		track.stopFrameEncoder(encoder)
+	}
+}
+
+// stopFrameEncoder must be called with track.mu held, the encoder is closed by runFrameEncoder so
+// it isn't closed during a read
+func (track *baseTrack) stopFrameEncoder(encoder *frameEncoder) {
+	track.frameEncoder = nil
+	delete(track.keyFrameControllers, encodedFramesID)
+	track.encodedMu.Lock()
+	track.encodedSource = nil
+	track.encodedMu.Unlock()
+	close(encoder.stop)
+}
+
+// runFrameEncoder reads the encoder of EncodeFrames, its reader passes the frames to the handlers
+func (track *baseTrack) runFrameEncoder(encoder *frameEncoder) {
+	defer encoder.reader.Close()
+
+	for {
+		select {
+		case <-encoder.stop:
+			return
+		default:
+		}
+
+		_, release, err := encoder.reader.Read()
+		if err != nil {
+			// the next call of EncodeFrames starts a new encoder
+			track.mu.Lock()
+			if track.frameEncoder == encoder {
+				track.stopFrameEncoder(encoder)
+			}
+			track.mu.Unlock()
+			return
+		}
+		release()
+	}
+}
+
+func (track *baseTrack) emitEncoded(mimeType string, clockRate uint32, data []byte, reader mediadevices.EncodedReadCloser) {
+	track.encodedMu.Lock()
+	handlers := track.encodedHandlers
+	source := track.encodedSource
+	track.encodedMu.Unlock()
+	if len(handlers) == 0 || reader != source {
+		return
+	}
+
+	frame := EncodedFrame{
+		MimeType:  mimeType,
+		ClockRate: clockRate,
+		Data:      data,
+		KeyFrame:  isKeyFrame(mimeType, data),
+	}
+	if timestamps, ok := reader.(presentationTimestampReader); ok {
+		frame.PTS = timestamps.PresentationTimestamp()
+	}
+	if sizes, ok := reader.(frameSizeReader); ok {
+		size := sizes.FrameSize()
+		frame.Width, frame.Height = size.X, size.Y
+	}
+	for _, handler := range handlers {
+		handler(frame)
+	}
+}
+
 func (track *VideoTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
 	return track.bind(ctx, track)
 }
@@ -226,7 +665,7 @@ func (track *baseTrack) bind(ctx webrtc.TrackLocalContext, specializedTrack medi
 	defer track.mu.Unlock()
 
 	signalCh := make(chan chan<- struct{})
-	var stopRead chan struct{}
+	stopRead := make(chan struct{})
 	track.activePeerConnections[ctx.ID()] = signalCh
 
 	var encodedReader mediadevices.RTPReadCloser
@@ -235,7 +674,11 @@ func (track *baseTrack) bind(ctx webrtc.TrackLocalContext, specializedTrack medi
 	var errReasons []string
 	for _, wantedCodec := range ctx.CodecParameters() {
 		// logger.Debugf("trying to build %s rtp reader", wantedCodec.MimeType)
-		encodedReader, err = specializedTrack.NewRTPReader(wantedCodec.MimeType, uint32(ctx.SSRC()), rtpOutboundMTU)
+		if track.selector.sharedEncoder {
+			encodedReader, err = track.sharedRTPReader(ctx.ID(), wantedCodec.MimeType, specializedTrack)
+		} else {
+			encodedReader, err = specializedTrack.NewRTPReader(wantedCodec.MimeType, uint32(ctx.SSRC()), rtpOutboundMTU)
+		}
 		if err == nil {
 			selectedCodec = wantedCodec
 			break
@@ -247,6 +690,10 @@ func (track *baseTrack) bind(ctx webrtc.TrackLocalContext, specializedTrack medi
 	if encodedReader == nil {
 		return webrtc.RTPCodecParameters{}, errors.New(strings.Join(errReasons, "\n\n"))
 	}
+	log.Printf("Sending %s track with codec %s", track.Kind(), selectedCodec.MimeType)
+
+	extensions := newHeaderExtensionWriter(ctx.HeaderExtensions(), track.selector.videoRotation)
+	levels, _ := encodedReader.(audioLevelReader)
 
 	go func() {
 		var doneCh chan<- struct{}
@@ -263,6 +710,19 @@ func (track *baseTrack) bind(ctx webrtc.TrackLocalContext, specializedTrack medi
 			}
 		}()
 
+		write := func(pkt *rtp.Packet, level uint8) error {
+			// the packets of a shared encoder are sent to other peer connections too, so the
+			// header is copied
+			header := pkt.Header
+			header.Extensions = append([]rtp.Extension(nil), pkt.Header.Extensions...)
+			header.SSRC = uint32(ctx.SSRC())
+			// The answer may map the codec to a different payload type than the encoder default
+			header.PayloadType = uint8(selectedCodec.PayloadType)
+			extensions.apply(&header, level)
+			_, err := writer.WriteRTP(&header, pkt.Payload)
+			return err
+		}
+
 		for {
 			select {
 			case doneCh = <-signalCh:
@@ -276,9 +736,13 @@ func (track *baseTrack) bind(ctx webrtc.TrackLocalContext, specializedTrack medi
 				return
 			}
 
+			level := uint8(127)
+			if levels != nil {
+				level = levels.AudioLevel()
+			}
+
 			for _, pkt := range pkts {
-				_, err = writer.WriteRTP(&pkt.Header, pkt.Payload)
-				if err != nil {
+				if err := write(pkt, level); err != nil {
 					track.onError(err)
 					return
 				}
@@ -288,8 +752,26 @@ func (track *baseTrack) bind(ctx webrtc.TrackLocalContext, specializedTrack medi
 
 	keyFrameController, ok := encodedReader.Controller().(codec.KeyFrameController)
 	if ok {
-		stopRead = make(chan struct{})
-		go track.rtcpReadLoop(ctx.RTCPReader(), keyFrameController, stopRead)
+		var limiter *keyFrameLimiter
+		ownLimiter := true
+		if shared, ok := encodedReader.(*sharedEncoderReader); ok && shared.limiter != nil {
+			// the peer connections of a shared encoder share its limiter, which is closed with it
+			limiter, ownLimiter = shared.limiter, false
+		} else {
+			limiter = newKeyFrameLimiter(keyFrameController, track.selector.keyFramePolicy)
+		}
+		track.keyFrameControllers[ctx.ID()] = keyFrameController
+		go func() {
+			<-stopRead
+			if ownLimiter {
+				limiter.Close()
+			}
+
+			track.mu.Lock()
+			delete(track.keyFrameControllers, ctx.ID())
+			track.mu.Unlock()
+		}()
+		go track.rtcpReadLoop(ctx.RTCPReader(), limiter, stopRead)
 	}
 
 	return selectedCodec, nil
@@ -360,7 +842,39 @@ func (track *baseTrack) removeActivePeerConnection(id string) chan<- chan<- stru
 }
 
 func (track *AudioTrack) newEncodedReader(codecNames ...string) (mediadevices.EncodedReadCloser, *codec.RTPCodec, error) {
-	reader := track.NewReader(false)
+	var startPTS time.Duration
+	started := false
+	// inputEnd is the end of the last chunk read by the encoder, inputChunk its duration
+	var inputEnd, inputChunk time.Duration
+	source := track.NewReader(false)
+	// The encoder reads from the same goroutine calling Read on the encoded reader so there is
+	// no need to synchronize the access to the timestamps
+	timestampedReader := audio.ReaderFunc(func() (chunk wave.Audio, release func(), err error) {
+		chunk, release, err = source.Read()
+		if err != nil {
+			return chunk, release, err
+		}
+
+		chunk, pts, ok := splitAudioPresentationTimestamp(chunk)
+		if ok && !started {
+			startPTS = pts
+			started = true
+		}
+		if info := chunk.ChunkInfo(); ok && info.SamplingRate > 0 {
+			inputChunk = time.Duration(info.Len) * time.Second / time.Duration(info.SamplingRate)
+			inputEnd = pts + inputChunk
+		}
+		if track.selector.trackBuffer.CopyFrames {
+			samples, isFloat := pcmSamples(chunk)
+			chunk = pcmChunk(samples, chunk.ChunkInfo(), isFloat)
+			release()
+			release = func() {}
+		}
+		return chunk, release, err
+	})
+
+	meter := &audioLevelMeter{}
+	reader := meter.wrap(timestampedReader)
 	inputProp, err := detectCurrentAudioProp(track.Broadcaster)
 	if err != nil {
 		return nil, nil, err
@@ -372,6 +886,9 @@ func (track *AudioTrack) newEncodedReader(codecNames ...string) (mediadevices.En
 	}
 
 	sample := newAudioSampler(selectedCodec.ClockRate, selectedCodec.Latency)
+	// Once started the audio timestamps follow the media clock of the samples encoded
+	var encoded int64
+	var pts time.Duration
 
 	return &encodedReadCloserImpl{
 		readFn: func() (mediadevices.EncodedBuffer, func(), error) {
@@ -380,10 +897,23 @@ func (track *AudioTrack) newEncodedReader(codecNames ...string) (mediadevices.En
 				Data:    data,
 				Samples: sample(),
 			}
+			pts = startPTS + time.Duration(encoded)*selectedCodec.Latency
+			// The encoder holds less than a frame and a chunk of the input, the timestamps are
+			// anchored again to the input when it jumps further, f.e. after a stall
+			if started {
+				latency := selectedCodec.Latency
+				if drift := inputEnd - latency - pts; drift > inputChunk+latency || drift < -latency {
+					startPTS += drift
+					pts += drift
+				}
+			}
+			encoded++
 			return buffer, release, err
 		},
 		closeFn:      encodedReader.Close,
 		controllerFn: encodedReader.Controller,
+		audioLevelFn: meter.AudioLevel,
+		timestampFn:  func() time.Duration { return pts },
 	}, selectedCodec, nil
 }
 
@@ -408,7 +938,13 @@ func (track *AudioTrack) NewRTPReader(codecName string, ssrc uint32, mtu int) (m
 
 	packetizer := rtp.NewPacketizer(uint16(mtu), uint8(selectedCodec.PayloadType), ssrc, selectedCodec.Payloader, rtp.NewRandomSequencer(), selectedCodec.ClockRate)
 
+	levels := encodedReader.(audioLevelReader)
+	level := uint8(127)
+	timestamps := encodedReader.(presentationTimestampReader)
+	var lastTicks uint32
+
 	return &rtpReadCloserImpl{
+		encoded: encodedReader,
 		readFn: func() ([]*rtp.Packet, func(), error) {
 			encoded, release, err := encodedReader.Read()
 			if err != nil {
@@ -418,11 +954,22 @@ func (track *AudioTrack) NewRTPReader(codecName string, ssrc uint32, mtu int) (m
 			}
 			defer release()
 
-			pkts := packetizer.Packetize(encoded.Data, encoded.Samples)
+			level = levels.AudioLevel()
+			track.emitEncoded(selectedCodec.MimeType, selectedCodec.ClockRate, encoded.Data, encodedReader)
+			// with DTX the frames of silence are encoded in 1 or 2 bytes that are not sent, the
+			// timestamp of the next packet skips them
+			if len(encoded.Data) <= 2 {
+				return nil, func() {}, nil
+			}
+			ticks := clockTicks(timestamps.PresentationTimestamp(), selectedCodec.ClockRate)
+			packetizer.SkipSamples(ticks - lastTicks)
+			lastTicks = ticks
+			pkts := packetizer.Packetize(encoded.Data, 0)
 			return pkts, release, err
 		},
 		closeFn:      encodedReader.Close,
 		controllerFn: encodedReader.Controller,
+		audioLevelFn: func() uint8 { return level },
 	}, nil
 }
 
@@ -432,7 +979,7 @@ func detectCurrentAudioProp(broadcaster *audio.Broadcaster) (prop.Media, error)
 	// Since broadcaster has a ring buffer internally, a new reader will either read the last
 	// buffered frame or a new frame from the source. This also implies that no frame will be lost
 	// in any case.
-	metaReader := broadcaster.NewReader(false)
+	metaReader := stripAudioPresentationTimestamps(broadcaster.NewReader(false))
 	metaReader = audio.DetectChanges(0, func(p prop.Media) { currentProp = p })(metaReader)
 	_, _, err := metaReader.Read()
 
@@ -445,7 +992,7 @@ func detectCurrentVideoProp(broadcaster *video.Broadcaster) (prop.Media, error)
 	// Since broadcaster has a ring buffer internally, a new reader will either read the last
 	// buffered frame or a new frame from the source. This also implies that no frame will be lost
 	// in any case.
-	metaReader := broadcaster.NewReader(false)
+	metaReader := stripPresentationTimestamps(broadcaster.NewReader(false))
 	metaReader = video.DetectChanges(0, 0, func(p prop.Media) { currentProp = p })(metaReader)
 	_, _, err := metaReader.Read()
 
@@ -461,23 +1008,32 @@ func newAudioSampler(clockRate uint32, latency time.Duration) samplerFunc {
 	})
 }
 
-// newVideoSampler creates a video sampler that uses the actual video frame rate and
-// the codec's clock rate to come up with a duration for each sample.
-func newVideoSampler(clockRate uint32) samplerFunc {
-	clockRateFloat := float64(clockRate)
-	lastTimestamp := time.Now()
+func (track *VideoTrack) newEncodedReader(codecNames ...string) (mediadevices.EncodedReadCloser, *codec.RTPCodec, error) {
+	var framePTS time.Duration
+	var frameSize image.Point
+	// the frames are copied here, the broadcaster copy doesn't know the timestamped frames
+	source := track.NewReader(false)
+	// The encoder reads from the same goroutine calling Read on the encoded reader and returns
+	// the frame read, so the timestamp of the last frame read is the one of the encoded frame
+	reader := video.ReaderFunc(func() (img image.Image, release func(), err error) {
+		img, release, err = source.Read()
+		if err != nil {
+			return img, release, err
+		}
 
-	return samplerFunc(func() uint32 {
-		now := time.Now()
-		duration := now.Sub(lastTimestamp).Seconds()
-		samples := uint32(math.Round(clockRateFloat * duration))
-		lastTimestamp = now
-		return samples
+		img, pts, ok := splitPresentationTimestamp(img)
+		if ok {
+			framePTS = pts
+		}
+		frameSize = img.Bounds().Size()
+		if track.shouldCopyFrames {
+			img = copyYCbCr(toYCbCr420(img))
+			release()
+			release = func() {}
+		}
+		return img, release, err
 	})
-}
 
-func (track *VideoTrack) newEncodedReader(codecNames ...string) (mediadevices.EncodedReadCloser, *codec.RTPCodec, error) {
-	reader := track.NewReader(track.shouldCopyFrames)
 	inputProp, err := detectCurrentVideoProp(track.Broadcaster)
 	if err != nil {
 		return nil, nil, err
@@ -488,19 +1044,26 @@ func (track *VideoTrack) newEncodedReader(codecNames ...string) (mediadevices.En
 		return nil, nil, err
 	}
 
-	sample := newVideoSampler(selectedCodec.ClockRate)
+	var pts time.Duration
+	var lastTicks uint32
 
 	return &encodedReadCloserImpl{
 		readFn: func() (mediadevices.EncodedBuffer, func(), error) {
 			data, release, err := encodedReader.Read()
+			pts = framePTS
+			track.bitrate.add(len(data))
+			ticks := clockTicks(pts, selectedCodec.ClockRate)
 			buffer := mediadevices.EncodedBuffer{
 				Data:    data,
-				Samples: sample(),
+				Samples: ticks - lastTicks,
 			}
+			lastTicks = ticks
 			return buffer, release, err
 		},
 		closeFn:      encodedReader.Close,
 		controllerFn: encodedReader.Controller,
+		timestampFn:  func() time.Duration { return pts },
+		frameSizeFn:  func() image.Point { return frameSize },
 	}, selectedCodec, nil
 }
 
@@ -510,7 +1073,11 @@ func (track *VideoTrack) NewEncodedReader(codecName string) (mediadevices.Encode
 }
 
 func (track *VideoTrack) NewEncodedIOReader(codecName string) (io.ReadCloser, error) {
-	panic("not implemented NewEncodedIOReader")
+	encodedReader, _, err := track.newEncodedReader(codecName)
+	if err != nil {
+		return nil, err
+	}
+	return newEncodedIOReadCloserImpl(encodedReader), nil
 }
 
 func (track *VideoTrack) NewRTPReader(codecName string, ssrc uint32, mtu int) (mediadevices.RTPReadCloser, error) {
@@ -522,6 +1089,7 @@ func (track *VideoTrack) NewRTPReader(codecName string, ssrc uint32, mtu int) (m
 	packetizer := rtp.NewPacketizer(uint16(mtu), uint8(selectedCodec.PayloadType), ssrc, selectedCodec.Payloader, rtp.NewRandomSequencer(), selectedCodec.ClockRate)
 
 	return &rtpReadCloserImpl{
+		encoded: encodedReader,
 		readFn: func() ([]*rtp.Packet, func(), error) {
 			encoded, release, err := encodedReader.Read()
 			if err != nil {
@@ -531,7 +1099,11 @@ func (track *VideoTrack) NewRTPReader(codecName string, ssrc uint32, mtu int) (m
 			}
 			defer release()
 
-			pkts := packetizer.Packetize(encoded.Data, encoded.Samples)
+			track.emitEncoded(selectedCodec.MimeType, selectedCodec.ClockRate, encoded.Data, encodedReader)
+			// Samples is the distance to the previous frame, the timestamp of the first frame is
+			// relative to the shared media clock
+			packetizer.SkipSamples(encoded.Samples)
+			pkts := packetizer.Packetize(encoded.Data, 0)
 			return pkts, release, err
 		},
 		closeFn:      encodedReader.Close,
@@ -541,48 +1113,104 @@ func (track *VideoTrack) NewRTPReader(codecName string, ssrc uint32, mtu int) (m
 
 func newAudioTrackFromReader(reader audio.Reader, selector *CodecSelector) mediadevices.Track {
 	base := newBaseTrack(mediadevices.AudioInput, selector)
+	if selector.stallTimeout > 0 {
+		reader = newStallAudioReader(reader, selector.stallTimeout, selector.clock, base.ID)
+	}
+	base.closer, _ = reader.(io.Closer)
+	var start time.Duration
+	var samples int64
+	started := false
 	wrappedReader := audio.ReaderFunc(func() (chunk wave.Audio, release func(), err error) {
 		chunk, _, err = reader.Read()
 		if err != nil {
 			// base.onError(err)
+			return chunk, func() {}, err
+		}
+
+		// Chunks without timestamp follow the media clock of the samples read
+		if _, _, ok := splitAudioPresentationTimestamp(chunk); !ok && chunk.ChunkInfo().SamplingRate > 0 {
+			info := chunk.ChunkInfo()
+			now := selector.clock.now()
+			pts := start + time.Duration(samples)*time.Second/time.Duration(info.SamplingRate)
+			// restart the count after the input stalls so the gap shows up in the timestamps
+			if !started || now-pts > maxAudioClockLag {
+				start, samples, pts = now, 0, now
+				started = true
+			}
+			samples += int64(info.Len)
+			chunk = WithAudioPresentationTimestamp(chunk, pts)
 		}
 		return chunk, func() {}, err
 	})
 
-	// TODO: Allow users to configure broadcaster
-	broadcaster := audio.NewBroadcaster(wrappedReader, nil)
+	var source audio.Reader = wrappedReader
+	if selector.audioFilters != nil {
+		source = selector.audioFilters(source)
+	}
+	mute := &trackMute{}
+	source = mute.audioFilter(source)
+
+	broadcaster := audio.NewBroadcaster(source, selector.trackBuffer.audioBroadcaster())
 
 	return &AudioTrack{
 		baseTrack:   base,
 		Broadcaster: broadcaster,
+		trackMute:   mute,
 	}
 }
 
 func newVideoTrackFromReader(reader video.Reader, selector *CodecSelector) mediadevices.Track {
 	base := newBaseTrack(mediadevices.VideoInput, selector)
+	if selector.stallTimeout > 0 {
+		reader = newStallVideoReader(reader, selector.stallTimeout, selector.clock, base.ID)
+	}
+	base.closer, _ = reader.(io.Closer)
 	wrappedReader := video.ReaderFunc(func() (img image.Image, release func(), err error) {
 		img, _, err = reader.Read()
 		if err != nil {
 			// base.onError(err)
+			return img, func() {}, err
+		}
+
+		// Frames without timestamp are timestamped when captured, not when encoded
+		if _, _, ok := splitPresentationTimestamp(img); !ok {
+			img = WithPresentationTimestamp(img, selector.clock.now())
 		}
 		return img, func() {}, err
 	})
 
-	// TODO: Allow users to configure broadcaster
-	broadcaster := video.NewBroadcaster(wrappedReader, nil)
+	var source video.Reader = wrappedReader
+	if selector.videoFilters != nil {
+		source = selector.videoFilters(source)
+	}
+	bitrate := &bitrateMeter{}
+	if selector.overlays != nil {
+		source = selector.overlays.filter(selector, bitrate)(source)
+	}
+	// the overlays are hidden too while muted
+	mute := &trackMute{}
+	source = mute.videoFilter(source)
+
+	broadcaster := video.NewBroadcaster(source, selector.trackBuffer.videoBroadcaster())
 
 	return &VideoTrack{
-		baseTrack:   base,
-		Broadcaster: broadcaster,
+		baseTrack:        base,
+		Broadcaster:      broadcaster,
+		trackMute:        mute,
+		shouldCopyFrames: selector.trackBuffer.CopyFrames,
+		bitrate:          bitrate,
 	}
 }
 
 // rtpreader.go
 
 type rtpReadCloserImpl struct {
+	// encoded is the reader of the encoder, which identifies its frames in emitEncoded
+	encoded      mediadevices.EncodedReadCloser
 	readFn       func() ([]*rtp.Packet, func(), error)
 	closeFn      func() error
 	controllerFn func() codec.EncoderController
+	audioLevelFn func() uint8
 }
 
 func (r *rtpReadCloserImpl) Read() ([]*rtp.Packet, func(), error) {
@@ -597,12 +1225,22 @@ func (r *rtpReadCloserImpl) Controller() codec.EncoderController {
 	return r.controllerFn()
 }
 
+func (r *rtpReadCloserImpl) AudioLevel() uint8 {
+	if r.audioLevelFn == nil {
+		return 127
+	}
+	return r.audioLevelFn()
+}
+
 // ioreader.go
 
 type encodedReadCloserImpl struct {
 	readFn       func() (mediadevices.EncodedBuffer, func(), error)
 	closeFn      func() error
 	controllerFn func() codec.EncoderController
+	audioLevelFn func() uint8
+	timestampFn  func() time.Duration
+	frameSizeFn  func() image.Point
 }
 
 func (r *encodedReadCloserImpl) Read() (mediadevices.EncodedBuffer, func(), error) {
@@ -617,6 +1255,30 @@ func (r *encodedReadCloserImpl) Controller() codec.EncoderController {
 	return r.controllerFn()
 }
 
+func (r *encodedReadCloserImpl) AudioLevel() uint8 {
+	if r.audioLevelFn == nil {
+		return 127
+	}
+	return r.audioLevelFn()
+}
+
+func (r *encodedReadCloserImpl) PresentationTimestamp() time.Duration {
+	return r.timestampFn()
+}
+
+// frameSizeReader is implemented by the encoded video readers that know the size of the last
+// frame read
+type frameSizeReader interface {
+	FrameSize() image.Point
+}
+
+func (r *encodedReadCloserImpl) FrameSize() image.Point {
+	if r.frameSizeFn == nil {
+		return image.Point{}
+	}
+	return r.frameSizeFn()
+}
+
 type encodedIOReadCloserImpl struct {
 	readFn     func([]byte) (int, error)
 	closeFn    func() error
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+)
+
+const ivfClockRate = 90000
+
+var ivfMimeTypes = map[string]string{
+	"VP80": webrtc.MimeTypeVP8,
+	"VP90": webrtc.MimeTypeVP9,
+	"AV01": webrtc.MimeTypeAV1,
+}
+
+func init() {
+	RegisterSource("ivf", SourceFactory{
+		Description: "VP8, VP9 or AV1 IVF file sent without encoding it again, its codec must be one of the video codecs, f.e. ivf:/tmp/video.ivf",
+		Kinds:       videoKinds,
+		Options: []SourceOption{
+			{"loop", "false", "start again from the beginning at the end of the file"},
+		},
+		NewTrack: func(uri *SourceURI, kind mediadevices.MediaDeviceType, selector *CodecSelector) (mediadevices.Track, error) {
+			loop, err := uri.BoolOption("loop")
+			if err != nil {
+				return nil, err
+			}
+			return newIVFTrack(uri.Path, loop, selector)
+		},
+	})
+}
+
+// ivfTrack sends the frames of an IVF file as they are, so key frames can't be requested and
+// the encoder options don't apply
+type ivfTrack struct {
+	*baseTrack
+	path     string
+	loop     bool
+	mimeType string
+}
+
+func newIVFTrack(path string, loop bool, selector *CodecSelector) (mediadevices.Track, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	_, header, err := ivfreader.NewWith(file)
+	if err != nil {
+		return nil, err
+	}
+	mimeType, ok := ivfMimeTypes[header.FourCC]
+	if !ok {
+		return nil, fmt.Errorf("unsupported IVF codec %s", header.FourCC)
+	}
+
+	return &ivfTrack{
+		baseTrack: newBaseTrack(mediadevices.VideoInput, selector),
+		path:      path,
+		loop:      loop,
+		mimeType:  mimeType,
+	}, nil
+}
+
+func (track *ivfTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	return track.bind(ctx, track)
+}
+
+func (track *ivfTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	return track.unbind(ctx)
+}
+
+func (track *ivfTrack) NewEncodedReader(codecName string) (mediadevices.EncodedReadCloser, error) {
+	if !strings.EqualFold(codecName, track.mimeType) {
+		return nil, fmt.Errorf("the IVF file is %s, it can't be sent as %s", track.mimeType, codecName)
+	}
+
+	var file *os.File
+	var reader *ivfreader.IVFReader
+	var header *ivfreader.IVFFileHeader
+	open := func() error {
+		if file != nil {
+			file.Close()
+		}
+
+		var err error
+		file, err = os.Open(track.path)
+		if err != nil {
+			return err
+		}
+		reader, header, err = ivfreader.NewWith(file)
+		return err
+	}
+	if err := open(); err != nil {
+		return nil, err
+	}
+	if header.TimebaseNumerator == 0 || header.TimebaseDenominator == 0 {
+		file.Close()
+		return nil, errors.New("invalid IVF timebase")
+	}
+
+	// the timestamps are in timebase units, usually one per frame
+	toDuration := func(timestamp uint64) time.Duration {
+		return time.Duration(timestamp*uint64(header.TimebaseNumerator)) * time.Second / time.Duration(header.TimebaseDenominator)
+	}
+
+	var start, loopOffset, filePTS, pts time.Duration
+	var lastTicks uint32
+	started := false
+
+	return &encodedReadCloserImpl{
+		readFn: func() (mediadevices.EncodedBuffer, func(), error) {
+			frame, frameHeader, err := reader.ParseNextFrame()
+			if err == io.EOF && track.loop {
+				// continue one frame after the last one
+				loopOffset += filePTS + toDuration(1)
+				if err = open(); err == nil {
+					frame, frameHeader, err = reader.ParseNextFrame()
+				}
+			}
+			if err != nil {
+				track.onError(err)
+				return mediadevices.EncodedBuffer{}, func() {}, err
+			}
+
+			// files are read much faster than real time, so the frames are sent at their timestamps
+			if !started {
+				start = track.selector.clock.now()
+				started = true
+			}
+			filePTS = toDuration(frameHeader.Timestamp)
+			pts = start + loopOffset + filePTS
+			if wait := pts - track.selector.clock.now(); wait > 0 {
+				time.Sleep(wait)
+			}
+
+			ticks := clockTicks(pts, ivfClockRate)
+			buffer := mediadevices.EncodedBuffer{
+				Data:    frame,
+				Samples: ticks - lastTicks,
+			}
+			lastTicks = ticks
+			return buffer, func() {}, nil
+		},
+		closeFn: func() error {
+			return file.Close()
+		},
+		controllerFn: func() codec.EncoderController { return nil },
+		timestampFn:  func() time.Duration { return pts },
+		frameSizeFn: func() image.Point {
+			return image.Pt(int(header.Width), int(header.Height))
+		},
+	}, nil
+}
+
+func (track *ivfTrack) NewEncodedIOReader(codecName string) (io.ReadCloser, error) {
+	encodedReader, err := track.NewEncodedReader(codecName)
+	if err != nil {
+		return nil, err
+	}
+	return newEncodedIOReadCloserImpl(encodedReader), nil
+}
+
+// encoderMimeTypes returns the codec of the file
+func (track *ivfTrack) encoderMimeTypes() []string {
+	return []string{track.mimeType}
+}
+
+// EncodeFrames passes the frames of the file to the handlers of OnEncodedFrame, see
+// VideoTrack.EncodeFrames
+func (track *ivfTrack) EncodeFrames(mimeType string) (io.Closer, error) {
+	return track.encodeFrames(mimeType, track)
+}
+
+func (track *ivfTrack) NewRTPReader(codecName string, ssrc uint32, mtu int) (mediadevices.RTPReadCloser, error) {
+	encodedReader, err := track.NewEncodedReader(codecName)
+	if err != nil {
+		return nil, err
+	}
+
+	var payloader rtp.Payloader
+	switch track.mimeType {
+	case webrtc.MimeTypeVP8:
+		payloader = &codecs.VP8Payloader{EnablePictureID: true}
+	case webrtc.MimeTypeVP9:
+		payloader = &codecs.VP9Payloader{}
+	default:
+		payloader = &codecs.AV1Payloader{}
+	}
+	// the payload type is replaced with the negotiated one when the packets are written
+	packetizer := rtp.NewPacketizer(uint16(mtu), 0, ssrc, payloader, rtp.NewRandomSequencer(), ivfClockRate)
+
+	return &rtpReadCloserImpl{
+		encoded: encodedReader,
+		readFn: func() ([]*rtp.Packet, func(), error) {
+			encoded, release, err := encodedReader.Read()
+			if err != nil {
+				encodedReader.Close()
+				return nil, func() {}, err
+			}
+			defer release()
+
+			track.emitEncoded(track.mimeType, ivfClockRate, encoded.Data, encodedReader)
+			packetizer.SkipSamples(encoded.Samples)
+			return packetizer.Packetize(encoded.Data, 0), func() {}, nil
+		},
+		closeFn:      encodedReader.Close,
+		controllerFn: encodedReader.Controller,
+	}, nil
+}
+
+// ivfWriter writes the frames of a video track to an IVF file, with millisecond timestamps
+type ivfWriter struct {
+	file   *os.File
+	frames uint32
+}
+
+func newIVFWriter(file *os.File, format EncodedFrame) (*ivfWriter, error) {
+	fourCC := ""
+	for code, mimeType := range ivfMimeTypes {
+		if strings.EqualFold(mimeType, format.MimeType) {
+			fourCC = code
+		}
+	}
+	if strings.EqualFold(format.MimeType, webrtc.MimeTypeH264) {
+		fourCC = "H264"
+	}
+	if fourCC == "" {
+		return nil, fmt.Errorf("%s can't be written to an IVF file", format.MimeType)
+	}
+
+	header := make([]byte, 32)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[6:], 32)
+	copy(header[8:], fourCC)
+	binary.LittleEndian.PutUint16(header[12:], uint16(format.Width))
+	binary.LittleEndian.PutUint16(header[14:], uint16(format.Height))
+	// timebase 1/1000
+	binary.LittleEndian.PutUint32(header[16:], 1000)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	if _, err := file.Write(header); err != nil {
+		return nil, err
+	}
+	return &ivfWriter{file: file}, nil
+}
+
+func (w *ivfWriter) write(track int, frame EncodedFrame, timestamp time.Duration) error {
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(frame.Data)))
+	binary.LittleEndian.PutUint64(header[4:], uint64(timestamp/time.Millisecond))
+	if _, err := w.file.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.file.Write(frame.Data); err != nil {
+		return err
+	}
+	w.frames++
+	return nil
+}
+
+// Close writes the number of frames in the header and closes the file
+func (w *ivfWriter) Close() error {
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, w.frames)
+	if _, err := w.file.WriteAt(count, 24); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
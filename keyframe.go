@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices/pkg/codec"
+)
+
+// KeyFramePolicy configures how keyframe requests from the remote side are forwarded to the
+// encoder. Zero values disable the corresponding behavior.
+type KeyFramePolicy struct {
+	// MinInterval is the minimum time between two forced keyframes, requests received before
+	// that are delayed until the interval has elapsed
+	MinInterval time.Duration
+	// MergeWindow is the time after a forced keyframe during which new requests are considered
+	// duplicates of the one already served and are dropped
+	MergeWindow time.Duration
+	// Period forces a keyframe periodically, independently of the encoder GOP
+	Period time.Duration
+}
+
+// keyFrameLimiter applies a KeyFramePolicy to a KeyFrameController. It implements
+// codec.KeyFrameController itself so it can be used in place of the encoder one.
+type keyFrameLimiter struct {
+	controller codec.KeyFrameController
+	policy     KeyFramePolicy
+
+	mu      sync.Mutex
+	last    time.Time
+	pending *time.Timer
+	done    chan struct{}
+	closed  sync.Once
+}
+
+func newKeyFrameLimiter(controller codec.KeyFrameController, policy KeyFramePolicy) *keyFrameLimiter {
+	limiter := &keyFrameLimiter{
+		controller: controller,
+		policy:     policy,
+		done:       make(chan struct{}),
+	}
+
+	if policy.Period > 0 {
+		go limiter.periodicLoop()
+	}
+
+	return limiter
+}
+
+// ForceKeyFrame requests a keyframe, which is forced now, later or never depending on the policy
+func (limiter *keyFrameLimiter) ForceKeyFrame() error {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if limiter.pending != nil {
+		// there is already a keyframe scheduled that will serve this request too
+		return nil
+	}
+
+	elapsed := time.Since(limiter.last)
+	if elapsed < limiter.policy.MergeWindow {
+		return nil
+	}
+	if elapsed < limiter.policy.MinInterval {
+		limiter.pending = time.AfterFunc(limiter.policy.MinInterval-elapsed, func() {
+			limiter.mu.Lock()
+			defer limiter.mu.Unlock()
+
+			limiter.pending = nil
+			limiter.force()
+		})
+		return nil
+	}
+
+	return limiter.force()
+}
+
+// force asks the encoder for a keyframe, the caller must hold the lock
+func (limiter *keyFrameLimiter) force() error {
+	select {
+	case <-limiter.done:
+		return nil
+	default:
+	}
+
+	limiter.last = time.Now()
+	return limiter.controller.ForceKeyFrame()
+}
+
+func (limiter *keyFrameLimiter) periodicLoop() {
+	timer := time.NewTimer(limiter.policy.Period)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-limiter.done:
+			return
+		case <-timer.C:
+		}
+
+		// any keyframe forced in between restarts the period
+		limiter.mu.Lock()
+		next := limiter.policy.Period - time.Since(limiter.last)
+		if next <= 0 {
+			limiter.force()
+			next = limiter.policy.Period
+		}
+		limiter.mu.Unlock()
+
+		timer.Reset(next)
+	}
+}
+
+// Close stops the periodic keyframes and drops any pending request
+func (limiter *keyFrameLimiter) Close() {
+	limiter.closed.Do(func() {
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+
+		close(limiter.done)
+		if limiter.pending != nil {
+			limiter.pending.Stop()
+			limiter.pending = nil
+		}
+	})
+}
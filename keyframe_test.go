@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingKeyFrameController struct {
+	forced int32
+}
+
+func (controller *countingKeyFrameController) ForceKeyFrame() error {
+	atomic.AddInt32(&controller.forced, 1)
+	return nil
+}
+
+func TestKeyFrameLimiter(t *testing.T) {
+	const unit = 20 * time.Millisecond
+	tests := []struct {
+		name   string
+		policy KeyFramePolicy
+		// requests are the times of the keyframe requests, in units
+		requests []int
+		// closeAt is the time the limiter is closed at in units, 0 to close it at the end
+		closeAt  int
+		expected int32
+	}{
+		{"no policy", KeyFramePolicy{}, []int{0, 0, 1}, 0, 3},
+		{"merged", KeyFramePolicy{MergeWindow: 5 * unit}, []int{0, 1, 2, 6}, 0, 2},
+		{"delayed", KeyFramePolicy{MinInterval: 5 * unit}, []int{0, 1, 2}, 0, 2},
+		{"merged then delayed", KeyFramePolicy{MinInterval: 5 * unit, MergeWindow: 2 * unit}, []int{0, 1, 3, 4}, 0, 2},
+		{"after the interval", KeyFramePolicy{MinInterval: 2 * unit}, []int{0, 3, 6}, 0, 3},
+		{"pending dropped on close", KeyFramePolicy{MinInterval: 5 * unit}, []int{0, 1}, 2, 1},
+		{"periodic", KeyFramePolicy{Period: 4 * unit}, nil, 0, 2},
+		{"period restarted", KeyFramePolicy{Period: 4 * unit}, []int{3}, 0, 2},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			controller := &countingKeyFrameController{}
+			limiter := newKeyFrameLimiter(controller, test.policy)
+			start := time.Now()
+			for _, at := range test.requests {
+				time.Sleep(time.Until(start.Add(time.Duration(at) * unit)))
+				limiter.ForceKeyFrame()
+			}
+			if test.closeAt > 0 {
+				time.Sleep(time.Until(start.Add(time.Duration(test.closeAt) * unit)))
+				limiter.Close()
+			}
+			// the last request and the pending ones are served by then
+			time.Sleep(time.Until(start.Add(10*unit - unit/2)))
+			limiter.Close()
+
+			if forced := atomic.LoadInt32(&controller.forced); forced != test.expected {
+				t.Errorf("got %d keyframes, expected %d", forced, test.expected)
+			}
+		})
+	}
+}
@@ -6,103 +6,263 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
-	"github.com/pion/mediadevices"
-	"github.com/pion/mediadevices/pkg/codec/opus"
-	"github.com/pion/mediadevices/pkg/codec/vpx"
-	"github.com/pion/mediadevices/pkg/codec/x264"
+	"github.com/pion/interceptor"
 	_ "github.com/pion/mediadevices/pkg/driver/screen" // This is required to register screen adapter
-	"github.com/pion/mediadevices/pkg/prop"
 
 	//_ "github.com/pion/mediadevices/pkg/driver/camera"
 	//_ "github.com/pion/mediadevices/pkg/driver/microphone"
-	_ "github.com/pion/mediadevices/pkg/driver/audiotest"
-	_ "github.com/pion/mediadevices/pkg/driver/videotest"
 	"github.com/pion/webrtc/v3"
 )
 
 func main() {
-	video := flag.String("v", "screen", "input video device, can be \"screen\" or a named pipe")
-	audio := flag.String("a", "", "input audio device, can be a named pipe")
-	videoBitrate := flag.Int("b", 1_000_000, "video bitrate in bits per second")
+	var videos, audios stringList
+	flag.Var(&videos, "v", "input video URI, see the input sources below, repeat it to publish several video tracks (default \"screen\")")
+	flag.Var(&audios, "a", "input audio URI, see the input sources below, repeat it to publish several audio tracks")
+	streamID := flag.String("stream-id", "", "ID of the stream in the msid of the tracks, random by default")
+	videoIDs := flag.String("video-ids", "", "comma separated IDs of the video tracks in the order of -v, video-<position> by default")
+	audioIDs := flag.String("audio-ids", "", "comma separated IDs of the audio tracks in the order of -a, audio-<position> by default")
+	var recordPaths stringList
+	flag.Var(&recordPaths, "record", "file recording what is published, repeatable, .ivf for the first video track, .ogg|.opus for the first audio track, .webm|.mkv for all the tracks, H.264 only in .mkv")
+	recordSegment := flag.Duration("record-segment", 0, "duration of the recording files, a new file with the start time in its name is started at the next keyframe, 0 for a single file")
+	recordQueue := flag.Int("record-queue", 0, "frames waiting to be written to each recording, 512 when 0")
+	recordSlow := flag.String("record-slow", "drop-oldest", "frames dropped when the disk is slower than the encoders, drop-oldest|drop-newest, or block to stall the publishing instead")
+	bufferSize := flag.Uint("buffer-size", 0, "frames or audio chunks kept for the readers of each track, the mediadevices default when 0")
+	copyFrames := flag.Bool("copy-frames", false, "give every encoder its own copy of the raw frames")
+	stallTimeout := flag.Duration("stall-timeout", 2*time.Second, "time without frames after which a track sends black frames or silence until its input delivers again, 0 to disable, the switch sources fail over instead")
+	muteSlate := flag.String("mute-slate", "", "PNG or JPEG image sent instead of black frames while the video is muted")
+	muted := flag.String("mute", "", "tracks muted at the start, audio|video|all or a track ID")
+	videoBitrate := flag.Int("b", 1_000_000, "video bitrate of each video track in bits per second")
 	iceServer := flag.String("i", "stun:stun.l.google.com:19302", "ice server")
-	token := flag.String("t", "", "publishing token")
-	videoCodec := flag.String("vc", "vp8", "video codec vp8|h264")
+	var tokens stringList
+	flag.Var(&tokens, "t", "publishing token, repeat it for each endpoint in order, a single token is used for all the endpoints")
+	shareEncoder := flag.Bool("share-encoder", true, "encode each track once for all the endpoints using the same codec instead of once per endpoint")
+	videoCodec := flag.String("vc", "vp8", "video codecs in preference order, comma separated list of vp8|vp9|h264|av1")
+	vp9TemporalLayers := flag.Int("vp9-temporal-layers", 1, "number of vp9 temporal layers 1-3")
+	vp9SpatialLayers := flag.Int("vp9-spatial-layers", 1, "number of vp9 spatial layers 1-3, each one half the size of the one above it")
+	keyFrameInterval := flag.Int("kf", 0, "maximum number of frames between video keyframes, 0 for the encoder default")
+	rateControl := flag.String("rc", "", "vp8, vp9 and h264 rate control mode cbr|vbr|crf, empty for the encoder default, not supported by av1")
+	crf := flag.Int("crf", 30, "constant quality used with -rc crf, 0-63 for vp8 and vp9, 0-51 for h264")
+	vpxDeadline := flag.Duration("vpx-deadline", 0, "vp8 and vp9 encoding deadline, 0 for realtime")
+	vpxCPUUsed := flag.Int("vpx-cpu-used", 0, "vp8 and vp9 cpu-used, -16-16 for vp8 and -9-9 for vp9, higher is faster, 0 for the libvpx default")
+	x264Preset := flag.String("x264-preset", "ultrafast", "x264 preset ultrafast|superfast|veryfast|faster|fast|medium|slow|slower|veryslow|placebo")
+	x264Profile := flag.String("x264-profile", "", "x264 profile baseline|main|high, empty for high signaled as constrained baseline")
+	x264Tune := flag.String("x264-tune", "", "x264 tunes added to zerolatency, comma separated list of film|animation|grain|stillimage|psnr|ssim|fastdecode")
+	audioBitrate := flag.Int("ab", 0, "opus bitrate in bits per second, 0 for the encoder default")
+	opusFrameDuration := flag.Duration("opus-frame-duration", 0, "opus frame duration 2.5ms|5ms|10ms|20ms|40ms|60ms, 0 for the encoder default")
+	opusStereo := flag.Bool("opus-stereo", false, "encode stereo audio")
+	opusComplexity := flag.Int("opus-complexity", -1, "opus complexity 0-10, -1 for the libopus default")
+	opusDTX := flag.Bool("opus-dtx", false, "stop sending the audio during silences with the opus discontinuous transmission")
+	keyFrameMinInterval := flag.Duration("kf-min-interval", 500*time.Millisecond, "minimum time between keyframes requested by the receivers")
+	keyFrameMergeWindow := flag.Duration("kf-merge-window", 100*time.Millisecond, "time after a keyframe during which new keyframe requests are ignored")
+	keyFramePeriod := flag.Duration("kf-period", 0, "force a keyframe periodically, 0 to disable")
+	extensions := flag.String("ext", "", "RTP header extensions to enable, comma separated list of abs-send-time|transport-cc|audio-level|video-orientation")
+	pacerMultiplier := flag.Float64("pacer", 2.5, "pace the packets of each endpoint at this multiple of the target bitrate, 0 to disable pacing")
+	pacerMaxDelay := flag.Duration("pacer-max-delay", 500*time.Millisecond, "maximum time a packet waits in the pacer queue, 0 for no limit")
+	pacerMaxQueue := flag.Int("pacer-max-queue", 0, "size in bytes of the pacer queue above which the oldest packets are sent right away, 1MB when 0")
+	pacerStats := flag.Duration("pacer-stats", 0, "interval to log the pacer queue metrics, 0 to disable")
+	rotate := flag.Int("rotate", 0, "video rotation in degrees signaled with the video orientation extension 0|90|180|270")
+	videoFilterChain := flag.String("vf", "", "video filters applied in order, comma separated list of crop=w:h[:x:y]|scale=w:h[:nearest|box|bilinear|catmullrom]|pad=w:h[:algorithm]|rotate=90|180|270|fps=n, f.e. scale=-1:720,pad=1280:720,fps=30")
+	audioFilterChain := flag.String("af", "", "audio filters applied in order, comma separated list of volume=dB|resample=rate|channels=n|limiter[=dBFS]|loudnorm[=LUFS], f.e. resample=48000,loudnorm=-23,limiter=-1")
+	var overlaySpecs stringList
+	flag.Var(&overlaySpecs, "overlay", "text or image drawn on the video, repeatable, semicolon separated list of text=template|image=file.png;x=n;y=n;size=n;color=name|#rrggbb;box=0-1;opacity=0-1, negative x and y are relative to the right and bottom edges, f.e. \"text=#{{.Frame}} {{.Kbps}}kbps;x=10;y=-10\"")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] WHIP_ENDPOINT_URL...\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nInput sources, set as scheme:path?option=value&...:\n%s", SourceUsage())
+	}
 	flag.Parse()
 
-	if len(flag.Args()) != 1 {
-		log.Fatal("Invalid number of arguments, pass the publishing url as the first argument")
+	endpoints := flag.Args()
+	if len(endpoints) == 0 {
+		log.Fatal("Invalid number of arguments, pass the publishing urls as arguments")
+	}
+	if len(tokens) > 1 && len(tokens) != len(endpoints) {
+		log.Fatalf("Invalid number of tokens, pass one for all the endpoints or one per endpoint, got %d for %d endpoints", len(tokens), len(endpoints))
+	}
+	var clients []*WHIPClient
+	for i, endpoint := range endpoints {
+		token := ""
+		if len(tokens) == 1 {
+			token = tokens[0]
+		} else if len(tokens) > 0 {
+			token = tokens[i]
+		}
+		clients = append(clients, NewWHIPClient(endpoint, token))
 	}
-
-	mediaEngine := webrtc.MediaEngine{}
-	whip := NewWHIPClient(flag.Args()[0], *token)
 
 	// configure codec specific parameters
-	vpxParams, err := vpx.NewVP8Params()
+	encoderConfig := EncoderConfig{
+		VideoBitrate:      *videoBitrate,
+		KeyFrameInterval:  *keyFrameInterval,
+		RateControl:       *rateControl,
+		CRF:               *crf,
+		VPXDeadline:       *vpxDeadline,
+		VPXCPUUsed:        *vpxCPUUsed,
+		VP9TemporalLayers: *vp9TemporalLayers,
+		VP9SpatialLayers:  *vp9SpatialLayers,
+		X264Preset:        *x264Preset,
+		X264Profile:       *x264Profile,
+		X264Tune:          *x264Tune,
+		OpusBitrate:       *audioBitrate,
+		OpusFrameDuration: *opusFrameDuration,
+		OpusStereo:        *opusStereo,
+		OpusComplexity:    *opusComplexity,
+		OpusDTX:           *opusDTX,
+	}
+
+	videoCodecNames, err := parseVideoCodecs(*videoCodec)
+	if err != nil {
+		log.Fatal("Invalid video codec. ", err)
+	}
+	videoEncoders, err := newVideoEncoders(videoCodecNames, encoderConfig)
 	if err != nil {
-		panic(err)
+		log.Fatal("Invalid video encoder configuration. ", err)
+	}
+	audioEncoders, err := newAudioEncoders(encoderConfig)
+	if err != nil {
+		log.Fatal("Invalid audio encoder configuration. ", err)
 	}
-	vpxParams.BitRate = *videoBitrate
 
-	opusParams, err := opus.NewParams()
+	headerExtensionNames, err := parseHeaderExtensions(*extensions)
 	if err != nil {
-		panic(err)
+		log.Fatal("Invalid header extensions. ", err)
+	}
+	if err := validateRotation(*rotate); err != nil {
+		log.Fatal("Invalid rotation. ", err)
+	}
+	if *rotate != 0 && !strings.Contains(strings.ToLower(*extensions), "video-orientation") {
+		headerExtensionNames = append(headerExtensionNames, "video-orientation")
 	}
 
-	x264Params, err := x264.NewParams()
+	videoFilters, err := parseVideoFilters(*videoFilterChain)
 	if err != nil {
-		panic(err)
+		log.Fatal("Invalid video filters. ", err)
 	}
-	x264Params.BitRate = *videoBitrate
-	x264Params.Preset = x264.PresetUltrafast
 
-	var videoCodecSelector mediadevices.CodecSelectorOption
-	if *videoCodec == "vp8" {
-		videoCodecSelector = mediadevices.WithVideoEncoders(&vpxParams)
-	} else {
-		videoCodecSelector = mediadevices.WithVideoEncoders(&x264Params)
+	audioFilters, err := parseAudioFilters(*audioFilterChain)
+	if err != nil {
+		log.Fatal("Invalid audio filters. ", err)
 	}
-	var stream mediadevices.MediaStream
 
-	if *video == "screen" {
-		codecSelector := mediadevices.NewCodecSelector(videoCodecSelector)
-		codecSelector.Populate(&mediaEngine)
+	slowConsumer, err := ParseSlowConsumerPolicy(*recordSlow)
+	if err != nil {
+		log.Fatal("Invalid recording. ", err)
+	}
 
-		stream, err = mediadevices.GetDisplayMedia(mediadevices.MediaStreamConstraints{
-			Video: func(constraint *mediadevices.MediaTrackConstraints) {},
-			Codec: codecSelector,
-		})
+	var overlayConfigs []OverlayConfig
+	for _, spec := range overlaySpecs {
+		config, err := parseOverlay(spec)
 		if err != nil {
-			log.Fatal("Unexpected error capturing screen. ", err)
-		}
-	} else if *video == "test" {
-		codecSelector := mediadevices.NewCodecSelector(
-			videoCodecSelector,
-			mediadevices.WithAudioEncoders(&opusParams),
-		)
-		codecSelector.Populate(&mediaEngine)
-
-		stream, err = mediadevices.GetUserMedia(mediadevices.MediaStreamConstraints{
-			Video: func(constraint *mediadevices.MediaTrackConstraints) {
-				constraint.Width = prop.Int(640)
-				constraint.Height = prop.Int(480)
-			},
-			Audio: func(constraint *mediadevices.MediaTrackConstraints) {},
-			Codec: codecSelector,
+			log.Fatal("Invalid overlay. ", err)
+		}
+		overlayConfigs = append(overlayConfigs, config)
+	}
+	var overlays *Overlays
+	if len(overlayConfigs) > 0 {
+		if overlays, err = NewOverlays(overlayConfigs...); err != nil {
+			log.Fatal("Invalid overlay. ", err)
+		}
+	}
+
+	// -v "" publishes only audio
+	if videos == nil {
+		videos = stringList{"screen"}
+	}
+	videos, audios = videos.nonEmpty(), audios.nonEmpty()
+
+	// the test source publishes both a test pattern and a test tone unless another audio input is given
+	for _, video := range videos {
+		if uri, _, err := ParseSourceURI(video); err == nil && uri.Scheme == "test" && len(audios) == 0 {
+			audios = stringList{"test"}
+		}
+	}
+
+	var pacer *PacerFactory
+	if *pacerMultiplier > 0 {
+		// the opus encoder default is well below this, it is only used to size the pacing rate
+		pacedAudioBitrate := 64_000
+		if *audioBitrate > 0 {
+			pacedAudioBitrate = *audioBitrate
+		}
+		// every endpoint has its own peer connection, paced at the bitrate of the tracks
+		pacer = NewPacerFactory(PacerConfig{
+			Bitrate:       *videoBitrate*len(videos) + pacedAudioBitrate*len(audios),
+			Multiplier:    *pacerMultiplier,
+			MaxQueueDelay: *pacerMaxDelay,
+			MaxQueueBytes: *pacerMaxQueue,
 		})
-		if err != nil {
-			log.Fatal("Unexpected error capturing test source. ", err)
+
+		if *pacerStats > 0 {
+			go logPacerStats(pacer, *pacerStats)
 		}
-	} else {
-		codecSelector := NewCodecSelector(
-			WithVideoEncoders(&vpxParams),
-			WithAudioEncoders(&opusParams),
-		)
-		codecSelector.Populate(&mediaEngine)
+	}
+
+	codecSelector := NewCodecSelector(
+		WithVideoEncoders(videoEncoders...),
+		WithAudioEncoders(audioEncoders...),
+		WithAudioChannels(encoderConfig.audioChannels()),
+		WithAudioFilters(audioFilters),
+		WithKeyFramePolicy(KeyFramePolicy{
+			MinInterval: *keyFrameMinInterval,
+			MergeWindow: *keyFrameMergeWindow,
+			Period:      *keyFramePeriod,
+		}),
+		WithHeaderExtensions(headerExtensionNames...),
+		WithVideoRotation(*rotate),
+		WithVideoFilters(videoFilters),
+		WithOverlays(overlays),
+		WithPacer(pacer),
+		WithTrackBuffer(TrackBufferConfig{BufferSize: *bufferSize, CopyFrames: *copyFrames}),
+		WithSharedEncoder(*shareEncoder),
+		WithStallTimeout(*stallTimeout),
+	)
+	// every endpoint has its own peer connection, so its own media engine and interceptors
+	setupPeerConnection := func(mediaEngine *webrtc.MediaEngine, interceptorRegistry *interceptor.Registry) error {
+		codecSelector.Populate(mediaEngine)
+		return codecSelector.RegisterInterceptors(mediaEngine, interceptorRegistry)
+	}
+	if err := setupPeerConnection(&webrtc.MediaEngine{}, &interceptor.Registry{}); err != nil {
+		log.Fatal("Unexpected error configuring interceptors. ", err)
+	}
 
-		stream, err = GetInputMediaStream(*audio, *video, codecSelector)
+	stream, err := GetInputMediaStream(audios, videos, codecSelector,
+		WithStreamID(*streamID),
+		WithVideoTrackIDs(splitIDs(*videoIDs)...),
+		WithAudioTrackIDs(splitIDs(*audioIDs)...),
+	)
+	if err != nil {
+		log.Fatal("Unexpected error capturing input. ", err)
+	}
+	if *muteSlate != "" {
+		slate, err := loadImageFrame(*muteSlate)
 		if err != nil {
-			log.Fatal("Unexpected error capturing input pipe. ", err)
+			log.Fatal("Invalid mute slate. ", err)
+		}
+		for _, track := range stream.GetVideoTracks() {
+			if track, ok := track.(*VideoTrack); ok {
+				track.SetMuteSlate(slate)
+			}
+		}
+	}
+	var recorders []*Recorder
+	for _, path := range recordPaths {
+		recorder, err := NewRecorder(RecorderConfig{
+			Path:            path,
+			SegmentDuration: *recordSegment,
+			QueueSize:       *recordQueue,
+			SlowConsumer:    slowConsumer,
+		}, stream.GetTracks()...)
+		if err != nil {
+			log.Fatal("Invalid recording. ", err)
+		}
+		recorders = append(recorders, recorder)
+	}
+	if *muted != "" {
+		if err := MuteTracks(*muted, true); err != nil {
+			log.Fatal("Invalid mute. ", err)
 		}
 	}
 
@@ -112,10 +272,87 @@ func main() {
 		},
 	}
 
-	whip.Publish(stream, mediaEngine, iceServers, true)
+	notifySwitchSignal()
+	notifyMuteSignal()
+
+	// each endpoint fails and reconnects on its own, until it rejects the session
+	rejected := make(chan error)
+	for _, whip := range clients {
+		stopped := whip.PublishWithReconnect(stream, setupPeerConnection, iceServers, true)
+		go func() {
+			if err := <-stopped; err != nil {
+				rejected <- err
+			}
+		}()
+	}
+	go func() {
+		for range clients {
+			log.Println(<-rejected)
+		}
+		log.Fatal("Every endpoint rejected the session")
+	}()
+
+	fmt.Printf("Press 'Enter' to finish, or type a command:\n%s", CommandUsage())
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			break
+		}
+		if err := RunCommand(line); err != nil {
+			log.Println(err)
+		}
+	}
+
+	for _, whip := range clients {
+		whip.Close(true)
+	}
+	for _, recorder := range recorders {
+		if err := recorder.Close(); err != nil {
+			log.Println("Recording close failed. ", err)
+		}
+	}
+	// stops the inputs, f.e. the socket listeners and the ffmpeg processes
+	for _, track := range stream.GetTracks() {
+		track.Close()
+	}
+}
+
+// stringList is a flag that can be repeated
+type stringList []string
 
-	fmt.Println("Press 'Enter' to finish...")
-	bufio.NewReader(os.Stdin).ReadBytes('\n')
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
 
-	whip.Close(true)
+func (list stringList) nonEmpty() stringList {
+	var values stringList
+	for _, value := range list {
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func splitIDs(ids string) []string {
+	if ids == "" {
+		return nil
+	}
+	return strings.Split(ids, ",")
+}
+
+func logPacerStats(pacers *PacerFactory, interval time.Duration) {
+	for range time.Tick(interval) {
+		for i, pacer := range pacers.Pacers() {
+			stats := pacer.Stats()
+			log.Printf("Pacer %d queue %d packets %d bytes, delay %s, max delay %s, sent %d packets\n",
+				i, stats.QueuedPackets, stats.QueuedBytes, stats.QueueDelay, stats.MaxQueueDelay, stats.SentPackets)
+		}
+	}
 }
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/wave"
+)
+
+const (
+	// mixerChunk is the duration of the chunks of the mix
+	mixerChunk = 10 * time.Millisecond
+	// mixerLatency is the level of the buffers of the inputs the drift compensation aims at
+	mixerLatency = 60 * time.Millisecond
+	// mixerMaxLatency is the level above which the oldest samples of an input are dropped, f.e.
+	// after a burst following a stall
+	mixerMaxLatency = 500 * time.Millisecond
+	// maxDriftCorrection is the largest change of the resampling ratio of an input, 1%. It is
+	// reached half the target level away from it, so inputs drifting by less stay buffered.
+	maxDriftCorrection = 0.01
+)
+
+func init() {
+	RegisterSource("mix", SourceFactory{
+		Description: "audio inputs separated by | mixed in one track, f.e. mix:ffmpeg:-re -i program.mp4|unix:///tmp/commentary.sock?format=framed?gains=0,-3, " +
+			"the options of the mixer go after the ones of the last input",
+		Kinds: []mediadevices.MediaDeviceType{mediadevices.AudioInput},
+		Options: []SourceOption{
+			{"gains", "", "comma separated gains of the inputs in dB, 0 for the missing ones"},
+			{"sample-rate", "48000", "sample rate of the mix"},
+			{"channels", "1", "channels of the mix"},
+		},
+		NewTrack: func(uri *SourceURI, kind mediadevices.MediaDeviceType, selector *CodecSelector) (mediadevices.Track, error) {
+			return newMixerTrack(uri, selector)
+		},
+	})
+	RegisterCommand("mix-gain", Command{
+		Usage:       "<track id> <input> <dB>",
+		Description: "change the gain of an input of a mix track",
+		Run: func(args []string) error {
+			if len(args) != 3 {
+				return fmt.Errorf("invalid number of arguments")
+			}
+			gain, err := strconv.ParseFloat(args[2], 64)
+			if err != nil {
+				return fmt.Errorf("invalid gain %s", args[2])
+			}
+			return withMixerInput(args[0], args[1], func(input *mixerInput) {
+				input.mu.Lock()
+				input.gaindB = gain
+				input.mu.Unlock()
+			})
+		},
+	})
+	RegisterCommand("mix-mute", Command{
+		Usage:       "<track id> <input> [on|off]",
+		Description: "mute or unmute an input of a mix track",
+		Run: func(args []string) error {
+			if len(args) < 2 || len(args) > 3 {
+				return fmt.Errorf("invalid number of arguments")
+			}
+			muted := true
+			if len(args) == 3 {
+				switch args[2] {
+				case "on":
+				case "off":
+					muted = false
+				default:
+					return fmt.Errorf("invalid value %s", args[2])
+				}
+			}
+			return withMixerInput(args[0], args[1], func(input *mixerInput) {
+				input.mu.Lock()
+				input.muted = muted
+				input.mu.Unlock()
+			})
+		},
+	})
+}
+
+var (
+	audioMixersMu sync.Mutex
+	audioMixers   []*audioMixer
+)
+
+// withMixerInput runs fn on the input with the given index of the mixer of the track
+func withMixerInput(trackID string, index string, fn func(*mixerInput)) error {
+	i, err := strconv.Atoi(index)
+	if err != nil {
+		return fmt.Errorf("invalid input %s", index)
+	}
+
+	audioMixersMu.Lock()
+	defer audioMixersMu.Unlock()
+	for _, m := range audioMixers {
+		if m.track.ID() != trackID {
+			continue
+		}
+		if i < 0 || i >= len(m.inputs) {
+			return fmt.Errorf("invalid input %d, there are %d inputs", i, len(m.inputs))
+		}
+		fn(m.inputs[i])
+		return nil
+	}
+	return fmt.Errorf("there is no mix track %s", trackID)
+}
+
+// audioMixer sums the inputs converted to its sample rate and channels, in real time
+type audioMixer struct {
+	info   wave.ChunkInfo
+	inputs []*mixerInput
+	tracks inputTracks
+	// track is the track of the mix, its ID is set once the stream is created
+	track mediadevices.Track
+}
+
+// mixerInput buffers the samples of an input converted to the format of the mix
+type mixerInput struct {
+	name string
+
+	mu        sync.Mutex
+	buffer    []float32
+	gaindB    float64
+	muted     bool
+	buffering bool
+}
+
+func newMixerTrack(uri *SourceURI, selector *CodecSelector) (mediadevices.Track, error) {
+	m := &audioMixer{}
+
+	var values [2]int
+	for i, name := range []string{"sample-rate", "channels"} {
+		value, err := uri.IntOption(name)
+		if err != nil {
+			return nil, err
+		}
+		if value <= 0 {
+			return nil, fmt.Errorf("invalid %s option %d of %s input", name, value, uri.Scheme)
+		}
+		values[i] = value
+	}
+	m.info = wave.ChunkInfo{
+		Len:          values[0] * int(mixerChunk/time.Millisecond) / 1000,
+		Channels:     values[1],
+		SamplingRate: values[0],
+	}
+
+	names := splitSourceInputs(uri.Path)
+	if len(names) == 0 {
+		return nil, fmt.Errorf("invalid %s input: missing inputs", uri)
+	}
+
+	var gains []float64
+	if option := uri.Option("gains"); option != "" {
+		for _, value := range strings.Split(option, ",") {
+			gain, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid gains option %s of %s input", option, uri.Scheme)
+			}
+			gains = append(gains, gain)
+		}
+	}
+	if len(gains) > len(names) {
+		return nil, fmt.Errorf("invalid gains option of %s input, there are %d inputs", uri.Scheme, len(names))
+	}
+
+	// the filters of the selector are applied once, on the mix
+	inputSelector := *selector
+	inputSelector.audioFilters = nil
+	inputSelector.stallTimeout = 0
+
+	for i, name := range names {
+		track, err := newSourceTrack(name, mediadevices.AudioInput, &inputSelector)
+		if err != nil {
+			m.tracks.Close()
+			return nil, fmt.Errorf("invalid mix input %s: %w", name, err)
+		}
+		m.tracks = append(m.tracks, track)
+		audioTrack, ok := track.(*AudioTrack)
+		if !ok {
+			m.tracks.Close()
+			return nil, fmt.Errorf("invalid mix input %s: only raw audio inputs can be mixed", name)
+		}
+
+		input := &mixerInput{name: name, buffering: true}
+		if i < len(gains) {
+			input.gaindB = gains[i]
+		}
+		go input.run(audioTrack.NewReader(false), m.info)
+		m.inputs = append(m.inputs, input)
+	}
+
+	m.track = newAudioTrackFromReader(&closableAudioReader{Reader: m.reader(selector), Closer: m}, selector)
+
+	audioMixersMu.Lock()
+	audioMixers = append(audioMixers, m)
+	audioMixersMu.Unlock()
+
+	return m.track, nil
+}
+
+// Close closes the inputs and removes the mixer from the ones changed by the commands
+func (m *audioMixer) Close() error {
+	audioMixersMu.Lock()
+	for i, registered := range audioMixers {
+		if registered == m {
+			audioMixers = append(audioMixers[:i], audioMixers[i+1:]...)
+			break
+		}
+	}
+	audioMixersMu.Unlock()
+
+	return m.tracks.Close()
+}
+
+// run converts the chunks of the input to the format of the mix and appends them to the buffer.
+// The resampling ratio follows the level of the buffer, so an input whose clock runs slightly
+// faster or slower than the one of the mix doesn't fill the buffer or run out of samples.
+func (input *mixerInput) run(r audio.Reader, info wave.ChunkInfo) {
+	resample := &resampler{rate: info.SamplingRate}
+	mix := channelMixer(info.Channels)
+	target := float64(info.SamplingRate) * mixerLatency.Seconds()
+	maxLen := int(float64(info.SamplingRate)*mixerMaxLatency.Seconds()) * info.Channels
+
+	for {
+		chunk, release, err := r.Read()
+		if err != nil {
+			log.Printf("Mix input %s stopped: %v\n", input.name, err)
+			return
+		}
+		chunk, _, _ = splitAudioPresentationTimestamp(chunk)
+		samples, _ := pcmSamples(chunk)
+		chunkInfo := chunk.ChunkInfo()
+		release()
+
+		samples, chunkInfo = resample.process(samples, chunkInfo)
+		samples, _ = mix(samples, chunkInfo)
+
+		input.mu.Lock()
+		input.buffer = append(input.buffer, samples...)
+		if len(input.buffer) > maxLen {
+			input.buffer = input.buffer[len(input.buffer)-maxLen:]
+		}
+		level := float64(len(input.buffer) / info.Channels)
+		input.mu.Unlock()
+
+		// proportional to the distance from the target level
+		correction := (level - target) / (target / 2) * maxDriftCorrection
+		resample.correction = math.Max(-maxDriftCorrection, math.Min(maxDriftCorrection, correction))
+	}
+}
+
+// read removes the samples of a chunk of the mix from the buffer. After running out of samples
+// the input is silent until the buffer is filled to the target level again.
+func (input *mixerInput) read(samples int, target int) ([]float32, float64) {
+	input.mu.Lock()
+	defer input.mu.Unlock()
+
+	if input.buffering {
+		if len(input.buffer) < target {
+			return nil, 0
+		}
+		input.buffering = false
+	}
+
+	n := samples
+	if n > len(input.buffer) {
+		n = len(input.buffer)
+		input.buffering = true
+		log.Printf("Mix input %s is late, sending silence\n", input.name)
+	}
+
+	chunk := input.buffer[:n]
+	input.buffer = input.buffer[n:]
+	if input.muted {
+		return chunk, 0
+	}
+	return chunk, dBToGain(input.gaindB)
+}
+
+// reader mixes a chunk every mixerChunk, timestamped on the media clock
+func (m *audioMixer) reader(selector *CodecSelector) audio.Reader {
+	var start time.Duration
+	var samples int64
+	started := false
+	target := int(float64(m.info.SamplingRate)*mixerLatency.Seconds()) * m.info.Channels
+
+	return audio.ReaderFunc(func() (chunk wave.Audio, release func(), err error) {
+		if !started {
+			start = selector.clock.now()
+			started = true
+		}
+		pts := start + time.Duration(samples)*time.Second/time.Duration(m.info.SamplingRate)
+		if wait := pts - selector.clock.now(); wait > 0 {
+			time.Sleep(wait)
+		}
+		samples += int64(m.info.Len)
+
+		mixed := make([]float32, m.info.Len*m.info.Channels)
+		for _, input := range m.inputs {
+			buffer, gain := input.read(len(mixed), target)
+			for i, sample := range buffer {
+				mixed[i] += sample * float32(gain)
+			}
+		}
+
+		return WithAudioPresentationTimestamp(pcmChunk(mixed, m.info, false), pts), func() {}, nil
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/wave"
+)
+
+func TestMixerDrift(t *testing.T) {
+	const rate = 48000
+	info := wave.ChunkInfo{Len: rate / 100, Channels: 1, SamplingRate: rate}
+	target := float64(rate) * mixerLatency.Seconds()
+
+	tests := []struct {
+		drift float64
+		// expected is the level of the buffer once the correction compensates the drift
+		expected float64
+	}{
+		{0, target},
+		{0.005, target * (1 + 0.005/maxDriftCorrection/2)},
+		{-0.005, target * (1 - 0.005/maxDriftCorrection/2)},
+	}
+	for _, test := range tests {
+		// the chunks are pushed one by one, the next one is requested once the previous one is
+		// in the buffer
+		chunks := make(chan wave.Audio)
+		requested := make(chan struct{})
+		input := &mixerInput{name: "drift", buffering: true}
+		go input.run(audio.ReaderFunc(func() (wave.Audio, func(), error) {
+			requested <- struct{}{}
+			chunk, ok := <-chunks
+			if !ok {
+				return nil, func() {}, io.EOF
+			}
+			return chunk, func() {}, nil
+		}), info)
+
+		<-requested
+
+		// 60s of the mix, the input sends chunks of 10ms of its clock, which runs faster or
+		// slower than the one of the mix
+		var sent int
+		var levels []float64
+		underruns := 0
+		for mixed := 0; mixed < 6000; mixed++ {
+			now := time.Duration(mixed) * mixerChunk
+			for ; time.Duration(float64(sent)*float64(mixerChunk)/(1+test.drift)) <= now; sent++ {
+				chunk := wave.NewFloat32Interleaved(info)
+				for i := range chunk.Data {
+					chunk.Data[i] = float32(math.Sin(2 * math.Pi * 440 * float64(sent*info.Len+i) / rate))
+				}
+				chunks <- chunk
+				<-requested
+			}
+
+			input.mu.Lock()
+			level, buffering := float64(len(input.buffer)), input.buffering
+			input.mu.Unlock()
+			if mixed >= 5000 {
+				levels = append(levels, level)
+			}
+			if mixed > 100 && buffering {
+				underruns++
+			}
+			input.read(info.Len, int(target))
+		}
+		close(chunks)
+
+		var sum float64
+		for _, level := range levels {
+			sum += level
+		}
+		// the buffer moves by a chunk around its mean
+		if mean := sum / float64(len(levels)); math.Abs(mean-test.expected) > float64(info.Len) || underruns > 0 {
+			t.Errorf("drift %g: got a level of %.0f samples with %d underruns, expected %.0f", test.drift, mean, underruns, test.expected)
+		}
+	}
+}
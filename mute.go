@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/wave"
+)
+
+// mutedFrameInterval is the interval of the black frames or the slate sent while a video track
+// is muted, a low frame rate of still frames keeps the bitrate of the encoder close to nothing
+const mutedFrameInterval = 200 * time.Millisecond
+
+func init() {
+	RegisterCommand("mute", Command{
+		Usage:       "<track id|audio|video|all> [on|off]",
+		Description: "send silence or black frames instead of the input of the tracks, without renegotiating",
+		Run: func(args []string) error {
+			if len(args) == 0 || len(args) > 2 {
+				return fmt.Errorf("invalid number of arguments")
+			}
+			muted := true
+			if len(args) == 2 {
+				switch args[1] {
+				case "on":
+				case "off":
+					muted = false
+				default:
+					return fmt.Errorf("invalid value %s", args[1])
+				}
+			}
+			return MuteTracks(args[0], muted)
+		},
+	})
+}
+
+// mutable is implemented by the tracks that can be muted, AudioTrack and VideoTrack
+type mutable interface {
+	mediadevices.Track
+	SetMuted(muted bool)
+	Muted() bool
+}
+
+var (
+	mutableTracksMu sync.Mutex
+	mutableTracks   []mutable
+)
+
+// registerMutableTrack makes a track of the published stream available to MuteTracks, the tracks
+// of the inputs of the compose, mix and switch sources are not registered
+func registerMutableTrack(track mediadevices.Track) {
+	if track, ok := track.(mutable); ok {
+		mutableTracksMu.Lock()
+		mutableTracks = append(mutableTracks, track)
+		mutableTracksMu.Unlock()
+	}
+}
+
+// MuteTracks mutes or unmutes the tracks with the given ID, or all the tracks of a kind with
+// "audio" and "video", or all the tracks with "all"
+func MuteTracks(target string, muted bool) error {
+	return withMutableTracks(target, func(track mutable) {
+		track.SetMuted(muted)
+	})
+}
+
+// ToggleMuteTracks mutes the tracks of the target that are not muted and unmutes the others
+func ToggleMuteTracks(target string) error {
+	return withMutableTracks(target, func(track mutable) {
+		track.SetMuted(!track.Muted())
+	})
+}
+
+func withMutableTracks(target string, fn func(mutable)) error {
+	mutableTracksMu.Lock()
+	defer mutableTracksMu.Unlock()
+
+	found := false
+	for _, track := range mutableTracks {
+		if target == "all" || target == track.ID() || target == track.Kind().String() {
+			fn(track)
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("there is no track %s that can be muted", target)
+	}
+	return nil
+}
+
+// trackMute is the mute state of a track, shared with the reader replacing its frames or chunks
+type trackMute struct {
+	mu    sync.Mutex
+	muted bool
+	// slate is sent instead of the black frames of a muted video track
+	slate *image.YCbCr
+}
+
+// SetMuted sends silence or black frames instead of the input while muted. The input is still
+// read, so live producers don't block, and the session and the encoder go on. With the opus DTX
+// the silence stops the transmission of the audio after 200ms.
+func (mute *trackMute) SetMuted(muted bool) {
+	mute.mu.Lock()
+	defer mute.mu.Unlock()
+	mute.muted = muted
+}
+
+// Muted returns whether the track is muted
+func (mute *trackMute) Muted() bool {
+	mute.mu.Lock()
+	defer mute.mu.Unlock()
+	return mute.muted
+}
+
+// SetMuteSlate sends the image scaled to the size of the frames instead of black frames while the
+// video track is muted, nil goes back to the black frames
+func (track *VideoTrack) SetMuteSlate(slate image.Image) {
+	track.trackMute.mu.Lock()
+	defer track.trackMute.mu.Unlock()
+
+	track.trackMute.slate = nil
+	if slate != nil {
+		track.trackMute.slate = copyYCbCr(toYCbCr420(slate))
+	}
+}
+
+func (mute *trackMute) state() (bool, *image.YCbCr) {
+	mute.mu.Lock()
+	defer mute.mu.Unlock()
+	return mute.muted, mute.slate
+}
+
+// audioFilter replaces the chunks with silence of the same format while muted
+func (mute *trackMute) audioFilter(r audio.Reader) audio.Reader {
+	return audio.ReaderFunc(func() (chunk wave.Audio, release func(), err error) {
+		chunk, release, err = r.Read()
+		if err != nil || !mute.Muted() {
+			return chunk, release, err
+		}
+		defer release()
+
+		chunk, pts, ok := splitAudioPresentationTimestamp(chunk)
+		info := chunk.ChunkInfo()
+		_, isFloat := chunk.(*wave.Float32Interleaved)
+		chunk = pcmChunk(make([]float32, info.Len*info.Channels), info, isFloat)
+		if ok {
+			chunk = WithAudioPresentationTimestamp(chunk, pts)
+		}
+		return chunk, func() {}, nil
+	})
+}
+
+// videoFilter replaces the frames with black frames or the slate, of the same size, while muted.
+// Only a frame every mutedFrameInterval is sent, the others are dropped.
+func (mute *trackMute) videoFilter(r video.Reader) video.Reader {
+	var sent time.Duration
+	sending := false
+	var black, slate, scaled *image.YCbCr
+
+	return video.ReaderFunc(func() (img image.Image, release func(), err error) {
+		for {
+			img, release, err = r.Read()
+			if err != nil {
+				return img, release, err
+			}
+			muted, currentSlate := mute.state()
+			if !muted {
+				sending = false
+				return img, release, nil
+			}
+
+			frame, pts, _ := splitPresentationTimestamp(img)
+			bounds := image.Rectangle{Max: frame.Bounds().Size()}
+			release()
+			if sending && pts-sent < mutedFrameInterval {
+				continue
+			}
+			sent, sending = pts, true
+
+			if currentSlate == nil {
+				if black == nil || black.Rect != bounds {
+					black = newBlackFrame(bounds)
+				}
+				return WithPresentationTimestamp(copyYCbCr(black), pts), func() {}, nil
+			}
+
+			if currentSlate != slate || scaled == nil || scaled.Rect.Size() != bounds.Size() {
+				slate = currentSlate
+				if scaled, err = scaleSlate(slate, bounds.Size()); err != nil {
+					return nil, func() {}, err
+				}
+			}
+			return WithPresentationTimestamp(copyYCbCr(scaled), pts), func() {}, nil
+		}
+	})
+}
+
+// scaleSlate scales the slate to the size of the frames of the track, the encoder doesn't
+// support changes of the frame size
+func scaleSlate(slate *image.YCbCr, size image.Point) (*image.YCbCr, error) {
+	img, _, err := video.Scale(size.X, size.Y, video.ScalerFastBoxSampling)(video.ReaderFunc(func() (image.Image, func(), error) {
+		return slate, func() {}, nil
+	})).Read()
+	if err != nil {
+		return nil, err
+	}
+	return toYCbCr420(img), nil
+}
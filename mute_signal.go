@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyMuteSignal mutes all the tracks on a SIGUSR2 and unmutes them on the next one
+func notifyMuteSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+
+	go func() {
+		for range signals {
+			if err := ToggleMuteTracks("all"); err != nil {
+				log.Println("Mute signal ignored. ", err)
+			}
+		}
+	}()
+}
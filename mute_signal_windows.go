@@ -0,0 +1,4 @@
+package main
+
+// notifyMuteSignal does nothing, there is no SIGUSR2 on Windows, use the mute command instead
+func notifyMuteSignal() {}
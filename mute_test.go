@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/wave"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestMutedAudioDTX(t *testing.T) {
+	info := wave.ChunkInfo{Len: 960, Channels: 1, SamplingRate: 48000}
+	var samples int
+	tone := audio.ReaderFunc(func() (wave.Audio, func(), error) {
+		chunk := wave.NewInt16Interleaved(info)
+		for i := range chunk.Data {
+			chunk.Data[i] = int16(8000 * math.Sin(2*math.Pi*440*float64(samples+i)/48000))
+		}
+		samples += info.Len
+		return chunk, func() {}, nil
+	})
+	params := newOpusParams()
+	params.DTX = true
+	track := newAudioTrackFromReader(tone, NewCodecSelector(WithAudioEncoders(params))).(*AudioTrack)
+	defer track.Close()
+	encoder, err := track.NewEncodedReader(webrtc.MimeTypeOpus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+
+	// dtx counts the DTX frames of 50 frames of 20ms, libopus starts the discontinuous
+	// transmission after 200ms of silence
+	dtx := func() int {
+		count := 0
+		for i := 0; i < 50; i++ {
+			encoded, _, err := encoder.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(encoded.Data) <= 2 {
+				count++
+			}
+		}
+		return count
+	}
+
+	if count := dtx(); count != 0 {
+		t.Errorf("got %d DTX frames of the tone", count)
+	}
+	track.SetMuted(true)
+	if count := dtx(); count < 30 {
+		t.Errorf("got %d DTX frames while muted, expected at least 30", count)
+	}
+	track.SetMuted(false)
+	dtx()
+	if count := dtx(); count != 0 {
+		t.Errorf("got %d DTX frames after unmuting", count)
+	}
+}
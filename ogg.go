@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// opusPreSkip is the lookahead of libopus at 48kHz, the samples the decoder discards at the
+	// start
+	opusPreSkip = 312
+	// oggHeaderBOS marks the first page of a stream
+	oggHeaderBOS = 0x02
+)
+
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// oggWriter writes the packets of an opus track to an Ogg file, one packet per page so a file cut
+// short by a crash loses at most the last packet
+type oggWriter struct {
+	file     *os.File
+	serial   uint32
+	sequence uint32
+}
+
+func newOggWriter(file *os.File, format EncodedFrame) (*oggWriter, error) {
+	if !strings.EqualFold(format.MimeType, webrtc.MimeTypeOpus) {
+		return nil, fmt.Errorf("%s can't be written to an Ogg file", format.MimeType)
+	}
+	w := &oggWriter{file: file, serial: rand.Uint32()}
+
+	// the stereo flag of the TOC byte, RFC 6716 section 3.1
+	channels := byte(1)
+	if len(format.Data) > 0 && format.Data[0]&0x04 != 0 {
+		channels = 2
+	}
+	if err := w.page(opusHead(channels), oggHeaderBOS, 0); err != nil {
+		return nil, err
+	}
+
+	vendor := "whip-go"
+	tags := make([]byte, 8+4+len(vendor)+4)
+	copy(tags, "OpusTags")
+	binary.LittleEndian.PutUint32(tags[8:], uint32(len(vendor)))
+	copy(tags[12:], vendor)
+	if err := w.page(tags, 0, 0); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// opusHead is the identification header of RFC 7845, also the CodecPrivate of WebM
+func opusHead(channels byte) []byte {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1
+	head[9] = channels
+	binary.LittleEndian.PutUint16(head[10:], opusPreSkip)
+	binary.LittleEndian.PutUint32(head[12:], 48000)
+	return head
+}
+
+// write writes a packet, its granule position is the end of the packet in 48kHz samples
+func (w *oggWriter) write(track int, frame EncodedFrame, timestamp time.Duration) error {
+	granule := uint64(timestamp*48000/time.Second) + uint64(opusPacketSamples(frame.Data)) + opusPreSkip
+	return w.page(frame.Data, 0, granule)
+}
+
+func (w *oggWriter) page(packet []byte, headerType byte, granule uint64) error {
+	segments := len(packet)/255 + 1
+	if segments > 255 {
+		return fmt.Errorf("packet of %d bytes too large for an Ogg page", len(packet))
+	}
+
+	page := make([]byte, 27+segments, 27+segments+len(packet))
+	copy(page, "OggS")
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	binary.LittleEndian.PutUint32(page[14:], w.serial)
+	binary.LittleEndian.PutUint32(page[18:], w.sequence)
+	page[26] = byte(segments)
+	// lacing values, 255 for every full segment and the rest in the last one
+	for i := 0; i < segments-1; i++ {
+		page[27+i] = 255
+	}
+	page[27+segments-1] = byte(len(packet) % 255)
+	page = append(page, packet...)
+
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	binary.LittleEndian.PutUint32(page[22:], crc)
+
+	w.sequence++
+	_, err := w.file.Write(page)
+	return err
+}
+
+func (w *oggWriter) Close() error {
+	return w.file.Close()
+}
+
+// opusPacketSamples returns the duration of an opus packet in 48kHz samples, from its TOC byte
+// as in RFC 6716 section 3.1
+func opusPacketSamples(packet []byte) int {
+	if len(packet) == 0 {
+		return 0
+	}
+
+	config := packet[0] >> 3
+	var frame int
+	switch {
+	case config < 12:
+		// SILK 10, 20, 40 and 60ms
+		frame = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16:
+		// hybrid 10 and 20ms
+		frame = []int{480, 960}[config%2]
+	default:
+		// CELT 2.5, 5, 10 and 20ms
+		frame = []int{120, 240, 480, 960}[config%4]
+	}
+
+	switch packet[0] & 0x03 {
+	case 0:
+		return frame
+	case 1, 2:
+		return 2 * frame
+	default:
+		if len(packet) < 2 {
+			return 0
+		}
+		return int(packet[1]&0x3f) * frame
+	}
+}
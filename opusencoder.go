@@ -0,0 +1,161 @@
+package main
+
+// #cgo pkg-config: opus
+// #include <opus.h>
+//
+// // opus_encoder_ctl is a variadic macro, it can't be called from go
+// static int whip_opus_set_bitrate(OpusEncoder *e, opus_int32 bitrate) {
+//   return opus_encoder_ctl(e, OPUS_SET_BITRATE(bitrate));
+// }
+// static int whip_opus_set_complexity(OpusEncoder *e, opus_int32 complexity) {
+//   return opus_encoder_ctl(e, OPUS_SET_COMPLEXITY(complexity));
+// }
+// static int whip_opus_set_dtx(OpusEncoder *e, opus_int32 dtx) {
+//   return opus_encoder_ctl(e, OPUS_SET_DTX(dtx));
+// }
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/pion/mediadevices/pkg/wave"
+)
+
+// opusMaxPacketSize is the size recommended by libopus for the encoded packets
+const opusMaxPacketSize = 4000
+
+// opusParams configures the libopus encoder. The opus package of mediadevices doesn't expose the
+// complexity and the DTX, so the encoder is driven here.
+type opusParams struct {
+	codec.BaseParams
+	// Latency is the duration of the frames, 20ms by default
+	Latency time.Duration
+	// Complexity is the libopus complexity 0-10, -1 keeps the libopus default
+	Complexity int
+	// DTX stops sending the frames of silence, only a packet of 1 or 2 bytes is encoded for them
+	DTX bool
+}
+
+func newOpusParams() *opusParams {
+	return &opusParams{Latency: 20 * time.Millisecond, Complexity: -1}
+}
+
+// RTPCodec represents the codec metadata
+func (params *opusParams) RTPCodec() *codec.RTPCodec {
+	rtpCodec := codec.NewRTPOpusCodec(48000)
+	rtpCodec.Latency = params.Latency
+	if params.DTX {
+		rtpCodec.SDPFmtpLine += ";usedtx=1"
+	}
+	return rtpCodec
+}
+
+// BuildAudioEncoder builds the encoder of the chunks read from r
+func (params *opusParams) BuildAudioEncoder(r audio.Reader, property prop.Media) (codec.ReadCloser, error) {
+	return newOpusEncoder(r, property, *params)
+}
+
+type opusEncoder struct {
+	engine *C.OpusEncoder
+	reader audio.Reader
+
+	mu sync.Mutex
+}
+
+func newOpusEncoder(r audio.Reader, property prop.Media, params opusParams) (*opusEncoder, error) {
+	if property.SampleRate == 0 {
+		return nil, errors.New("opus: the sample rate is required")
+	}
+	if params.BitRate == 0 {
+		params.BitRate = 32000
+	}
+	if params.Latency == 0 {
+		params.Latency = 20 * time.Millisecond
+	}
+
+	var cerror C.int
+	engine := C.opus_encoder_create(C.opus_int32(property.SampleRate), C.int(property.ChannelCount),
+		C.OPUS_APPLICATION_VOIP, &cerror)
+	if cerror != C.OPUS_OK {
+		return nil, fmt.Errorf("opus_encoder_create failed (%d)", cerror)
+	}
+	encoder := &opusEncoder{
+		engine: engine,
+		reader: audio.NewBuffer(int(params.Latency * time.Duration(property.SampleRate) / time.Second))(r),
+	}
+
+	if ec := C.whip_opus_set_bitrate(engine, C.opus_int32(params.BitRate)); ec != C.OPUS_OK {
+		encoder.Close()
+		return nil, fmt.Errorf("setting the opus bitrate to %d failed (%d)", params.BitRate, ec)
+	}
+	if params.Complexity >= 0 {
+		if ec := C.whip_opus_set_complexity(engine, C.opus_int32(params.Complexity)); ec != C.OPUS_OK {
+			encoder.Close()
+			return nil, fmt.Errorf("setting the opus complexity to %d failed (%d)", params.Complexity, ec)
+		}
+	}
+	if params.DTX {
+		if ec := C.whip_opus_set_dtx(engine, 1); ec != C.OPUS_OK {
+			encoder.Close()
+			return nil, fmt.Errorf("enabling the opus dtx failed (%d)", ec)
+		}
+	}
+
+	return encoder, nil
+}
+
+func (encoder *opusEncoder) Read() ([]byte, func(), error) {
+	chunk, release, err := encoder.reader.Read()
+	if err != nil {
+		return nil, func() {}, err
+	}
+	defer release()
+
+	encoder.mu.Lock()
+	defer encoder.mu.Unlock()
+
+	if encoder.engine == nil {
+		return nil, func() {}, io.EOF
+	}
+
+	encoded := make([]byte, opusMaxPacketSize)
+	var n C.opus_int32
+	switch chunk := chunk.(type) {
+	case *wave.Int16Interleaved:
+		n = C.opus_encode(encoder.engine, (*C.opus_int16)(&chunk.Data[0]), C.int(chunk.ChunkInfo().Len),
+			(*C.uchar)(&encoded[0]), C.opus_int32(len(encoded)))
+	case *wave.Float32Interleaved:
+		n = C.opus_encode_float(encoder.engine, (*C.float)(&chunk.Data[0]), C.int(chunk.ChunkInfo().Len),
+			(*C.uchar)(&encoded[0]), C.opus_int32(len(encoded)))
+	default:
+		return nil, func() {}, fmt.Errorf("unsupported audio chunk %T", chunk)
+	}
+	if n < 0 {
+		return nil, func() {}, fmt.Errorf("opus_encode failed (%d)", n)
+	}
+
+	return encoded[:n:n], func() {}, nil
+}
+
+func (encoder *opusEncoder) Controller() codec.EncoderController {
+	return encoder
+}
+
+func (encoder *opusEncoder) Close() error {
+	encoder.mu.Lock()
+	defer encoder.mu.Unlock()
+
+	if encoder.engine == nil {
+		return nil
+	}
+	C.opus_encoder_destroy(encoder.engine)
+	encoder.engine = nil
+	return nil
+}
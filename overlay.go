@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pion/mediadevices/pkg/io/video"
+)
+
+// OverlayConfig is a text or a PNG image drawn on every video frame
+type OverlayConfig struct {
+	// Text is a text/template executed for every frame with OverlayFields
+	Text string
+	// Image is the path of a PNG image blended with its alpha channel
+	Image string
+	// X and Y are the position of the top left corner, negative values are relative to the
+	// right and bottom edges
+	X int
+	Y int
+	// Scale is the size of each pixel of the font
+	Scale int
+	// Color is the color of the text
+	Color color.YCbCr
+	// Box is the opacity of the black box behind the text, from 0 to 1
+	Box float64
+	// Opacity multiplies the alpha of the text or the image, from 0 to 1
+	Opacity float64
+}
+
+// OverlayFields are the fields available to the text templates
+type OverlayFields struct {
+	// Time is the wall clock time of the frame
+	Time time.Time
+	// Frame is the number of the frame in the track
+	Frame int64
+	// Kbps is the bitrate of the encoded video in the last second
+	Kbps   int
+	Width  int
+	Height int
+}
+
+// overlayColors are the text colors by name, in BT.601 limited range
+var overlayColors = map[string]color.YCbCr{
+	"white":  {235, 128, 128},
+	"black":  {16, 128, 128},
+	"yellow": {210, 16, 146},
+	"red":    {81, 90, 240},
+	"green":  {145, 54, 34},
+	"blue":   {41, 240, 110},
+}
+
+// parseOverlay parses an overlay, a semicolon separated list of key=value with either text or
+// image, f.e. "text=cam1 {{.Time.Format \"15:04:05\"}} {{.Kbps}}kbps;x=10;y=-10" or
+// "image=logo.png;x=-10;y=10;opacity=0.8"
+func parseOverlay(spec string) (OverlayConfig, error) {
+	config := OverlayConfig{
+		X:       10,
+		Y:       10,
+		Scale:   2,
+		Color:   overlayColors["white"],
+		Box:     0.5,
+		Opacity: 1,
+	}
+
+	for _, field := range strings.Split(spec, ";") {
+		i := strings.Index(field, "=")
+		if i < 0 {
+			return config, fmt.Errorf("invalid overlay field %s, expected key=value", field)
+		}
+		key, value := strings.TrimSpace(field[:i]), field[i+1:]
+
+		var err error
+		switch key {
+		case "text":
+			config.Text = value
+		case "image":
+			config.Image = value
+		case "x":
+			config.X, err = strconv.Atoi(value)
+		case "y":
+			config.Y, err = strconv.Atoi(value)
+		case "size":
+			config.Scale, err = strconv.Atoi(value)
+			if err == nil && config.Scale <= 0 {
+				err = fmt.Errorf("invalid size %d", config.Scale)
+			}
+		case "color":
+			config.Color, err = parseOverlayColor(value)
+		case "box":
+			config.Box, err = parseUnit(value)
+		case "opacity":
+			config.Opacity, err = parseUnit(value)
+		default:
+			err = fmt.Errorf("unknown overlay field %s, valid fields are text|image|x|y|size|color|box|opacity", key)
+		}
+		if err != nil {
+			return config, err
+		}
+	}
+
+	if (config.Text == "") == (config.Image == "") {
+		return config, fmt.Errorf("overlay %s needs either a text or an image", spec)
+	}
+	return config, nil
+}
+
+func parseOverlayColor(value string) (color.YCbCr, error) {
+	if c, ok := overlayColors[strings.ToLower(value)]; ok {
+		return c, nil
+	}
+	if len(value) == 7 && value[0] == '#' {
+		if rgb, err := strconv.ParseUint(value[1:], 16, 32); err == nil {
+			y, cb, cr := color.RGBToYCbCr(uint8(rgb>>16), uint8(rgb>>8), uint8(rgb))
+			return color.YCbCr{Y: y, Cb: cb, Cr: cr}, nil
+		}
+	}
+	return color.YCbCr{}, fmt.Errorf("invalid color %s, use a name or #rrggbb", value)
+}
+
+func parseUnit(value string) (float64, error) {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 || f > 1 {
+		return 0, fmt.Errorf("invalid value %s, expected a number from 0 to 1", value)
+	}
+	return f, nil
+}
+
+// overlayImage is a PNG image converted to YCbCr with its alpha
+type overlayImage struct {
+	size      image.Point
+	y, cb, cr []uint8
+	alpha     []float64
+}
+
+func loadOverlayImage(path string) (*overlayImage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, err := png.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid overlay image %s: %w", path, err)
+	}
+
+	bounds := img.Bounds()
+	overlay := &overlayImage{size: bounds.Size()}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+			overlay.y = append(overlay.y, yy)
+			overlay.cb = append(overlay.cb, cb)
+			overlay.cr = append(overlay.cr, cr)
+			overlay.alpha = append(overlay.alpha, float64(c.A)/255)
+		}
+	}
+	return overlay, nil
+}
+
+func (overlay *overlayImage) draw(frame *image.YCbCr, at image.Point, opacity float64) {
+	for y := 0; y < overlay.size.Y; y++ {
+		for x := 0; x < overlay.size.X; x++ {
+			i := y*overlay.size.X + x
+			if alpha := overlay.alpha[i] * opacity; alpha > 0 {
+				blendRect(frame, image.Rect(at.X+x, at.Y+y, at.X+x+1, at.Y+y+1), overlay.y[i], overlay.cb[i], overlay.cr[i], alpha)
+			}
+		}
+	}
+}
+
+// overlayPosition resolves the negative coordinates relative to the right and bottom edges
+func overlayPosition(config OverlayConfig, frame image.Point, size image.Point) image.Point {
+	at := image.Pt(config.X, config.Y)
+	if at.X < 0 {
+		at.X = frame.X + at.X - size.X
+	}
+	if at.Y < 0 {
+		at.Y = frame.Y + at.Y - size.Y
+	}
+	return at
+}
+
+// bitrateMeter measures the bitrate of the encoded frames of a track
+type bitrateMeter struct {
+	mu      sync.Mutex
+	start   time.Time
+	bytes   int
+	bitrate int
+}
+
+func (meter *bitrateMeter) add(bytes int) {
+	meter.mu.Lock()
+	defer meter.mu.Unlock()
+
+	now := time.Now()
+	if meter.start.IsZero() {
+		meter.start = now
+	}
+	meter.bytes += bytes
+	if elapsed := now.Sub(meter.start); elapsed >= time.Second {
+		meter.bitrate = int(float64(meter.bytes*8) / elapsed.Seconds())
+		meter.start, meter.bytes = now, 0
+	}
+}
+
+// Bitrate returns the bitrate in bits per second measured over the last second
+func (meter *bitrateMeter) Bitrate() int {
+	meter.mu.Lock()
+	defer meter.mu.Unlock()
+	return meter.bitrate
+}
+
+// Overlays are the overlays drawn on the frames of the video tracks, with the images loaded and
+// the templates parsed
+type Overlays struct {
+	layers []overlayLayer
+}
+
+type overlayLayer struct {
+	config   OverlayConfig
+	template *template.Template
+	image    *overlayImage
+}
+
+// NewOverlays loads the images and parses the text templates of the overlays
+func NewOverlays(configs ...OverlayConfig) (*Overlays, error) {
+	overlays := &Overlays{}
+	for i, config := range configs {
+		layer := overlayLayer{config: config}
+		var err error
+		if config.Image != "" {
+			layer.image, err = loadOverlayImage(config.Image)
+		} else {
+			layer.template, err = template.New(fmt.Sprintf("overlay%d", i)).Parse(config.Text)
+		}
+		if err != nil {
+			return nil, err
+		}
+		overlays.layers = append(overlays.layers, layer)
+	}
+	return overlays, nil
+}
+
+// filter draws the overlays in order on a copy of the frames of a track
+func (overlays *Overlays) filter(selector *CodecSelector, meter *bitrateMeter) video.TransformFunc {
+	return func(r video.Reader) video.Reader {
+		var frames int64
+
+		return video.ReaderFunc(func() (img image.Image, release func(), err error) {
+			img, release, err = r.Read()
+			if err != nil {
+				return img, release, err
+			}
+
+			img, pts, ok := splitPresentationTimestamp(img)
+			if !ok {
+				pts = selector.clock.now()
+			}
+			// the overlays are drawn on a copy, the frame could be sent again by the fps filter
+			frame := copyYCbCr(toYCbCr420(img))
+			size := frame.Rect.Size()
+			fields := OverlayFields{
+				Time:   selector.clock.wallTime(pts),
+				Frame:  frames,
+				Kbps:   meter.Bitrate() / 1000,
+				Width:  size.X,
+				Height: size.Y,
+			}
+			frames++
+
+			for _, layer := range overlays.layers {
+				layer.draw(frame, fields)
+			}
+
+			return WithPresentationTimestamp(frame, pts), release, nil
+		})
+	}
+}
+
+func (layer overlayLayer) draw(frame *image.YCbCr, fields OverlayFields) {
+	config := layer.config
+	size := frame.Rect.Size()
+	if layer.image != nil {
+		layer.image.draw(frame, overlayPosition(config, size, layer.image.size), config.Opacity)
+		return
+	}
+
+	var text bytes.Buffer
+	if err := layer.template.Execute(&text, fields); err != nil {
+		text.Reset()
+		text.WriteString(err.Error())
+	}
+	textSize := textSize(text.String(), config.Scale)
+	at := overlayPosition(config, size, textSize)
+	if config.Box > 0 {
+		box := image.Rectangle{Min: at, Max: at.Add(textSize)}.Inset(-config.Scale)
+		blendRect(frame, box, 16, 128, 128, config.Box*config.Opacity)
+	}
+	blendMask(frame, renderText(text.String()), at, config.Scale, config.Color.Y, config.Color.Cb, config.Color.Cr, config.Opacity)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	pacerInterval = 5 * time.Millisecond
+	// pacerMaxQueueBytes is the default MaxQueueBytes, a few seconds of a high bitrate video
+	pacerMaxQueueBytes = 1 << 20
+)
+
+// PacerConfig configures the sender side pacing of the RTP packets
+type PacerConfig struct {
+	// Bitrate is the target bitrate in bits per second of all the paced tracks
+	Bitrate int
+	// Multiplier is applied to Bitrate to get the pacing rate
+	Multiplier float64
+	// MaxQueueDelay is the time after which queued packets are sent regardless of the rate,
+	// 0 to never skip the pacing
+	MaxQueueDelay time.Duration
+	// MaxQueueBytes is the size of the queue above which the oldest packets are sent regardless
+	// of the rate, 1MB when 0
+	MaxQueueBytes int
+}
+
+// PacerStats are the queueing metrics of a Pacer
+type PacerStats struct {
+	QueuedPackets int
+	QueuedBytes   int
+	SentPackets   uint64
+	// QueueDelay is the moving average of the time the packets wait in the queue
+	QueueDelay time.Duration
+	// MaxQueueDelay is the maximum time a packet waited in the queue since the last call to Stats
+	MaxQueueDelay time.Duration
+}
+
+type pacedPacket struct {
+	size     int
+	enqueued time.Time
+	send     func()
+}
+
+// Pacer is a leaky bucket that spreads the packets of the tracks bound to it at a multiple of
+// the target bitrate. Audio packets are always sent ahead of the queued video packets.
+type Pacer struct {
+	config PacerConfig
+
+	mu     sync.Mutex
+	audio  []*pacedPacket
+	video  []*pacedPacket
+	stats  PacerStats
+	done   chan struct{}
+	closed sync.Once
+}
+
+// NewPacer creates a Pacer and starts sending the packets enqueued to it
+func NewPacer(config PacerConfig) *Pacer {
+	if config.MaxQueueBytes == 0 {
+		config.MaxQueueBytes = pacerMaxQueueBytes
+	}
+	pacer := &Pacer{
+		config: config,
+		done:   make(chan struct{}),
+	}
+
+	go pacer.loop()
+
+	return pacer
+}
+
+// Enqueue adds a packet of the given size to the queue, send is called when it is its turn
+func (pacer *Pacer) Enqueue(kind webrtc.RTPCodecType, size int, send func()) {
+	packet := &pacedPacket{
+		size:     size,
+		enqueued: time.Now(),
+		send:     send,
+	}
+
+	pacer.mu.Lock()
+	defer pacer.mu.Unlock()
+
+	if kind == webrtc.RTPCodecTypeAudio {
+		pacer.audio = append(pacer.audio, packet)
+	} else {
+		pacer.video = append(pacer.video, packet)
+	}
+	pacer.stats.QueuedPackets++
+	pacer.stats.QueuedBytes += size
+}
+
+// Stats returns the current queueing metrics
+func (pacer *Pacer) Stats() PacerStats {
+	pacer.mu.Lock()
+	defer pacer.mu.Unlock()
+
+	stats := pacer.stats
+	pacer.stats.MaxQueueDelay = 0
+	return stats
+}
+
+// Close stops the pacer, the packets still in the queue are dropped
+func (pacer *Pacer) Close() {
+	pacer.closed.Do(func() {
+		close(pacer.done)
+	})
+}
+
+func (pacer *Pacer) loop() {
+	ticker := time.NewTicker(pacerInterval)
+	defer ticker.Stop()
+
+	// bytes per second
+	rate := float64(pacer.config.Bitrate) * pacer.config.Multiplier / 8
+	// allow bursts of up to two intervals when the queue was empty
+	maxBudget := rate * 2 * pacerInterval.Seconds()
+	budget := 0.0
+	last := time.Now()
+
+	for {
+		select {
+		case <-pacer.done:
+			return
+		case now := <-ticker.C:
+			budget += rate * now.Sub(last).Seconds()
+			if budget > maxBudget {
+				budget = maxBudget
+			}
+			last = now
+
+			var batch []*pacedPacket
+			batch, budget = pacer.dequeue(now, budget)
+			for _, packet := range batch {
+				packet.send()
+			}
+		}
+	}
+}
+
+// dequeue takes the packets that can be sent with the given budget and returns the remaining one
+func (pacer *Pacer) dequeue(now time.Time, budget float64) ([]*pacedPacket, float64) {
+	pacer.mu.Lock()
+	defer pacer.mu.Unlock()
+
+	batch := pacer.audio
+	pacer.audio = nil
+	for _, packet := range batch {
+		budget -= float64(packet.size)
+	}
+
+	// the audio packets are counted out of the queue as they are sent anyway
+	queued := pacer.stats.QueuedBytes
+	for _, packet := range batch {
+		queued -= packet.size
+	}
+
+	sent := 0
+	for _, packet := range pacer.video {
+		overdue := pacer.config.MaxQueueDelay > 0 && now.Sub(packet.enqueued) > pacer.config.MaxQueueDelay
+		overflow := queued > pacer.config.MaxQueueBytes
+		if budget <= 0 && !overdue && !overflow {
+			break
+		}
+		budget -= float64(packet.size)
+		queued -= packet.size
+		batch = append(batch, packet)
+		sent++
+	}
+	pacer.video = pacer.video[sent:]
+
+	for _, packet := range batch {
+		delay := now.Sub(packet.enqueued)
+		pacer.stats.QueueDelay = (pacer.stats.QueueDelay*15 + delay) / 16
+		if delay > pacer.stats.MaxQueueDelay {
+			pacer.stats.MaxQueueDelay = delay
+		}
+		pacer.stats.QueuedPackets--
+		pacer.stats.QueuedBytes -= packet.size
+		pacer.stats.SentPackets++
+	}
+
+	return batch, budget
+}
+
+// PacerFactory is an interceptor factory that gives each peer connection its own Pacer, so the
+// packets of an endpoint are paced at the bitrate of its tracks and don't wait behind the ones of
+// the others
+type PacerFactory struct {
+	config PacerConfig
+
+	mu     sync.Mutex
+	pacers []*Pacer
+}
+
+// NewPacerFactory creates a PacerFactory building pacers with the given configuration, the
+// Bitrate being the one of the tracks of a single peer connection
+func NewPacerFactory(config PacerConfig) *PacerFactory {
+	return &PacerFactory{config: config}
+}
+
+// NewInterceptor creates the pacer of a new peer connection
+func (factory *PacerFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	pacerInterceptor := &pacerInterceptor{factory: factory, pacer: NewPacer(factory.config)}
+
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	factory.pacers = append(factory.pacers, pacerInterceptor.pacer)
+
+	return pacerInterceptor, nil
+}
+
+// Pacers returns the pacers of the peer connections that are not closed
+func (factory *PacerFactory) Pacers() []*Pacer {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+
+	return append([]*Pacer(nil), factory.pacers...)
+}
+
+func (factory *PacerFactory) remove(pacer *Pacer) {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+
+	for i, p := range factory.pacers {
+		if p == pacer {
+			factory.pacers = append(factory.pacers[:i], factory.pacers[i+1:]...)
+			return
+		}
+	}
+}
+
+// pacerInterceptor queues the packets written by the tracks of a peer connection to its pacer. It
+// is the outermost interceptor, so the ones after it see the packets when they are sent.
+type pacerInterceptor struct {
+	interceptor.NoOp
+	factory *PacerFactory
+	pacer   *Pacer
+
+	mu      sync.Mutex
+	streams map[uint32]*pacedStream
+}
+
+// pacedStream is the state of a track bound to the pacer
+type pacedStream struct {
+	mu sync.Mutex
+	// err is the error of the last packet written by the pacer, returned by the next write
+	err     error
+	unbound bool
+}
+
+// BindLocalStream paces the packets of a track
+func (i *pacerInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	kind := webrtc.RTPCodecTypeVideo
+	if strings.HasPrefix(strings.ToLower(info.MimeType), "audio/") {
+		kind = webrtc.RTPCodecTypeAudio
+	}
+	var absSendTimeID uint8
+	for _, extension := range info.RTPHeaderExtensions {
+		if extension.URI == absSendTimeURI {
+			absSendTimeID = uint8(extension.ID)
+		}
+	}
+
+	stream := &pacedStream{}
+	i.mu.Lock()
+	if i.streams == nil {
+		i.streams = make(map[uint32]*pacedStream)
+	}
+	i.streams[info.SSRC] = stream
+	i.mu.Unlock()
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		stream.mu.Lock()
+		err := stream.err
+		stream.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+
+		// the payloads of the packets are not modified once written, the headers may be
+		queued := header.Clone()
+		size := queued.MarshalSize() + len(payload)
+		i.pacer.Enqueue(kind, size, func() {
+			stream.mu.Lock()
+			defer stream.mu.Unlock()
+
+			// the packets still queued when the track is unbound are dropped
+			if stream.unbound {
+				return
+			}
+			// the send time is the one the packet leaves the queue at
+			if absSendTimeID != 0 {
+				if extension, err := rtp.NewAbsSendTimeExtension(time.Now()).Marshal(); err == nil {
+					queued.SetExtension(absSendTimeID, extension)
+				}
+			}
+			if _, err := writer.Write(&queued, payload, attributes); err != nil {
+				stream.err = err
+			}
+		})
+		return size, nil
+	})
+}
+
+// UnbindLocalStream drops the packets of the track still in the queue
+func (i *pacerInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.mu.Lock()
+	stream := i.streams[info.SSRC]
+	delete(i.streams, info.SSRC)
+	i.mu.Unlock()
+
+	if stream != nil {
+		stream.mu.Lock()
+		stream.unbound = true
+		stream.mu.Unlock()
+	}
+}
+
+// Close stops the pacer when the peer connection is closed, the queued packets are dropped
+func (i *pacerInterceptor) Close() error {
+	i.pacer.Close()
+	i.factory.remove(i.pacer)
+	return nil
+}
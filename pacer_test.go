@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestPacerDequeue(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		config PacerConfig
+		budget float64
+		// audio and video are the sizes of the queued packets, delays the time the video packets
+		// have been waiting
+		audio, video []int
+		delays       []time.Duration
+		sent         int
+		remaining    float64
+	}{
+		{"budget", PacerConfig{}, 2500, nil, []int{1000, 1000, 1000, 1000, 1000}, nil, 3, -500},
+		{"no budget", PacerConfig{}, 0, nil, []int{1000, 1000}, nil, 0, 0},
+		{"audio first", PacerConfig{}, 0, []int{100, 100}, []int{1000}, nil, 2, -200},
+		{"audio spends the budget", PacerConfig{}, 1000, []int{600}, []int{1000, 1000}, nil, 2, -600},
+		{"overdue", PacerConfig{MaxQueueDelay: 100 * time.Millisecond}, 0, nil, []int{1000, 1000, 1000},
+			[]time.Duration{200 * time.Millisecond, 150 * time.Millisecond, 0}, 2, -2000},
+		{"overflow", PacerConfig{MaxQueueBytes: 2500}, 0, nil, []int{1000, 1000, 1000, 1000, 1000}, nil, 3, -3000},
+	}
+	for _, test := range tests {
+		pacer := &Pacer{config: test.config, done: make(chan struct{})}
+		if pacer.config.MaxQueueBytes == 0 {
+			pacer.config.MaxQueueBytes = pacerMaxQueueBytes
+		}
+		for _, size := range test.audio {
+			pacer.Enqueue(webrtc.RTPCodecTypeAudio, size, func() {})
+		}
+		for i, size := range test.video {
+			pacer.Enqueue(webrtc.RTPCodecTypeVideo, size, func() {})
+			pacer.video[i].enqueued = now
+			if i < len(test.delays) {
+				pacer.video[i].enqueued = now.Add(-test.delays[i])
+			}
+		}
+
+		batch, remaining := pacer.dequeue(now, test.budget)
+		if len(batch) != test.sent || remaining != test.remaining {
+			t.Errorf("%s: sent %d packets with %.0f bytes of budget left, expected %d with %.0f", test.name, len(batch), remaining, test.sent, test.remaining)
+		}
+		if stats := pacer.Stats(); stats.QueuedPackets != len(test.audio)+len(test.video)-test.sent || stats.SentPackets != uint64(test.sent) {
+			t.Errorf("%s: got stats %+v", test.name, stats)
+		}
+	}
+}
+
+func TestPacerRate(t *testing.T) {
+	tests := []struct {
+		config  PacerConfig
+		packets int
+		// expected is the time the packets take to be sent
+		expected time.Duration
+	}{
+		{PacerConfig{Bitrate: 800_000, Multiplier: 1}, 30, 300 * time.Millisecond},
+		{PacerConfig{Bitrate: 800_000, Multiplier: 2}, 30, 150 * time.Millisecond},
+		{PacerConfig{Bitrate: 80_000, Multiplier: 1, MaxQueueDelay: 100 * time.Millisecond}, 30, 100 * time.Millisecond},
+	}
+	for _, test := range tests {
+		pacer := NewPacer(test.config)
+		sent := make(chan time.Time, test.packets)
+		start := time.Now()
+		for i := 0; i < test.packets; i++ {
+			pacer.Enqueue(webrtc.RTPCodecTypeVideo, 1000, func() { sent <- time.Now() })
+		}
+
+		var last time.Time
+		for i := 0; i < test.packets; i++ {
+			select {
+			case last = <-sent:
+			case <-time.After(time.Second):
+				t.Fatalf("%+v: only %d packets sent", test.config, i)
+			}
+		}
+		pacer.Close()
+
+		// the pacer sends every pacerInterval
+		if elapsed := last.Sub(start); elapsed < test.expected-2*pacerInterval || elapsed > test.expected+4*pacerInterval {
+			t.Errorf("%+v: sent in %s, expected %s", test.config, elapsed, test.expected)
+		}
+	}
+}
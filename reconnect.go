@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/wave"
+)
+
+const (
+	// fillFrameRate is the rate of the black frames sent while the producer is disconnected
+	fillFrameRate = 30
+	// fillStallTimeout is the time without frames after which the fillers are sent while the
+	// producer is still connected
+	fillStallTimeout = time.Second
+)
+
+// errInputClosed is returned by the readers of an input once it is closed
+var errInputClosed = errors.New("input closed")
+
+// streamConnector opens the stream of an input again every time it ends, f.e. by accepting a
+// new connection
+type streamConnector interface {
+	// connect blocks until the next stream is available, it fails once the connector is closed
+	connect() (io.ReadCloser, error)
+	// Close stops connecting, a connect in progress returns
+	Close() error
+	String() string
+}
+
+// reconnectingInput reads every stream returned by a connector until it is closed
+type reconnectingInput struct {
+	input     streamConnector
+	done      chan struct{}
+	startOnce sync.Once
+	closeOnce sync.Once
+	connected int32
+
+	mu   sync.Mutex
+	conn io.ReadCloser
+}
+
+func newReconnectingInput(input streamConnector) *reconnectingInput {
+	return &reconnectingInput{input: input, done: make(chan struct{})}
+}
+
+// start runs the input in the background on the first call, so the stream isn't read before
+// all the tracks sharing it are created
+func (in *reconnectingInput) start(read func(io.Reader)) {
+	in.startOnce.Do(func() {
+		go in.run(read)
+	})
+}
+
+// run calls read with every stream of the connector until the input is closed or the connector
+// fails, read returns when the stream ends
+func (in *reconnectingInput) run(read func(io.Reader)) {
+	defer in.Close()
+	for {
+		conn, err := in.input.connect()
+		if err != nil {
+			return
+		}
+
+		in.mu.Lock()
+		select {
+		case <-in.done:
+			in.mu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		in.conn = conn
+		in.mu.Unlock()
+
+		atomic.StoreInt32(&in.connected, 1)
+		read(conn)
+		atomic.StoreInt32(&in.connected, 0)
+
+		in.mu.Lock()
+		in.conn = nil
+		in.mu.Unlock()
+		conn.Close()
+	}
+}
+
+func (in *reconnectingInput) isConnected() bool {
+	return atomic.LoadInt32(&in.connected) == 1
+}
+
+// Close stops reading, the current stream is closed so a blocked read returns
+func (in *reconnectingInput) Close() error {
+	in.closeOnce.Do(func() {
+		close(in.done)
+		in.mu.Lock()
+		if in.conn != nil {
+			in.conn.Close()
+		}
+		in.mu.Unlock()
+		in.input.Close()
+	})
+	return nil
+}
+
+// closableVideoReader is a video reader owning its input, which is closed with the track
+type closableVideoReader struct {
+	video.Reader
+	io.Closer
+}
+
+// closableAudioReader is an audio reader owning its input, which is closed with the track
+type closableAudioReader struct {
+	audio.Reader
+	io.Closer
+}
+
+type streamImage struct {
+	img     image.Image
+	release func()
+}
+
+// newReconnectingVideoReader reads the frames of every stream returned by the connector with a
+// new reader. Black frames, of the given size until the first frame and then of the size of the
+// last one, are sent while the producer is disconnected or stalled, marked as fillers.
+func newReconnectingVideoReader(input streamConnector, newReader func(io.Reader) video.Reader, clock *mediaClock, size image.Point) video.Reader {
+	in := newReconnectingInput(input)
+	frames := make(chan interface{})
+	read := func(conn io.Reader) {
+		reader := newReader(conn)
+		for {
+			img, release, err := reader.Read()
+			if err != nil {
+				log.Printf("Input %s disconnected: %v", input, err)
+				return
+			}
+			select {
+			case frames <- streamImage{img, release}:
+			case <-in.done:
+				release()
+				return
+			}
+		}
+	}
+
+	reader := newFillingVideoReader(in, frames, clock, size)
+	return &closableVideoReader{Reader: video.ReaderFunc(func() (image.Image, func(), error) {
+		in.start(read)
+		return reader.Read()
+	}), Closer: in}
+}
+
+// newFillingVideoReader returns the frames received from the input, and black frames while it
+// is disconnected or stalled. The frames are streamImage items.
+func newFillingVideoReader(in *reconnectingInput, frames <-chan interface{}, clock *mediaClock, size image.Point) video.Reader {
+	black := newBlackFrame(image.Rectangle{Max: size})
+	last := time.Now()
+	next := func(item interface{}) (image.Image, func(), error) {
+		last = time.Now()
+		frame := item.(streamImage)
+		if bounds := frame.img.Bounds(); black.Rect != bounds {
+			black = newBlackFrame(bounds)
+		}
+		return frame.img, frame.release, nil
+	}
+	return video.ReaderFunc(func() (img image.Image, release func(), err error) {
+		for {
+			select {
+			case item := <-frames:
+				return next(item)
+			case <-time.After(time.Second / fillFrameRate):
+				if !in.isConnected() || time.Since(last) > fillStallTimeout {
+					return withFiller(black, clock.now()), func() {}, nil
+				}
+			case <-in.done:
+				// the frames queued before the end of the input are still sent
+				select {
+				case item := <-frames:
+					return next(item)
+				default:
+					return nil, func() {}, errInputClosed
+				}
+			}
+		}
+	})
+}
+
+type streamChunk struct {
+	chunk   wave.Audio
+	release func()
+}
+
+// newReconnectingAudioReader reads the chunks of every stream returned by the connector with a
+// new reader. Silence, in the given format until the first chunk and then in the format of the
+// last one, is sent while the producer is disconnected or stalled, marked as fillers.
+func newReconnectingAudioReader(input streamConnector, newReader func(io.Reader) audio.Reader, clock *mediaClock, info wave.ChunkInfo) audio.Reader {
+	in := newReconnectingInput(input)
+	chunks := make(chan interface{})
+	read := func(conn io.Reader) {
+		reader := newReader(conn)
+		for {
+			chunk, release, err := reader.Read()
+			if err != nil {
+				log.Printf("Input %s disconnected: %v", input, err)
+				return
+			}
+			select {
+			case chunks <- streamChunk{chunk, release}:
+			case <-in.done:
+				release()
+				return
+			}
+		}
+	}
+
+	reader := newFillingAudioReader(in, chunks, clock, info)
+	return &closableAudioReader{Reader: audio.ReaderFunc(func() (wave.Audio, func(), error) {
+		in.start(read)
+		return reader.Read()
+	}), Closer: in}
+}
+
+// newFillingAudioReader returns the chunks received from the input, and silence while it is
+// disconnected or stalled. The chunks are streamChunk items.
+func newFillingAudioReader(in *reconnectingInput, chunks <-chan interface{}, clock *mediaClock, info wave.ChunkInfo) audio.Reader {
+	silence := wave.NewInt16Interleaved(info)
+	duration := time.Duration(info.Len) * time.Second / time.Duration(info.SamplingRate)
+	last := time.Now()
+	next := func(item interface{}) (wave.Audio, func(), error) {
+		last = time.Now()
+		chunk := item.(streamChunk)
+		if info := chunk.chunk.ChunkInfo(); info.SamplingRate > 0 && silence.ChunkInfo() != info {
+			silence = wave.NewInt16Interleaved(info)
+			duration = time.Duration(info.Len) * time.Second / time.Duration(info.SamplingRate)
+		}
+		return chunk.chunk, chunk.release, nil
+	}
+	return audio.ReaderFunc(func() (chunk wave.Audio, release func(), err error) {
+		for {
+			select {
+			case item := <-chunks:
+				return next(item)
+			case <-time.After(duration):
+				if !in.isConnected() || time.Since(last) > fillStallTimeout {
+					return withAudioFiller(silence, clock.now()), func() {}, nil
+				}
+			case <-in.done:
+				// the chunks queued before the end of the input are still sent
+				select {
+				case item := <-chunks:
+					return next(item)
+				default:
+					return nil, func() {}, errInputClosed
+				}
+			}
+		}
+	})
+}
+
+// newBlackFrame returns a black I420 frame
+func newBlackFrame(bounds image.Rectangle) *image.YCbCr {
+	frame := image.NewYCbCr(bounds, image.YCbCrSubsampleRatio420)
+	for i := range frame.Y {
+		frame.Y[i] = 16
+	}
+	for i := range frame.Cb {
+		frame.Cb[i] = 128
+		frame.Cr[i] = 128
+	}
+	return frame
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/webrtc/v3"
+)
+
+// recorderQueue is the default number of frames waiting to be written
+const recorderQueue = 512
+
+// RecorderConfig configures a Recorder
+type RecorderConfig struct {
+	// Path is the file written, its extension selects the format: .ivf for the first video
+	// track, .ogg or .opus for the first audio track, .webm or .mkv for all the tracks, H.264
+	// only in .mkv
+	Path string
+	// SegmentDuration starts a new file every SegmentDuration, at the next video keyframe, with
+	// the start time in its name. 0 writes a single file.
+	SegmentDuration time.Duration
+	// QueueSize is the number of frames waiting to be written, recorderQueue when 0
+	QueueSize int
+	// SlowConsumer is applied to the frames when the disk is slower than the encoders, with
+	// DropOldest or DropNewest the recorder can't stall the publishing
+	SlowConsumer SlowConsumerPolicy
+}
+
+// mediaWriter writes the encoded frames of the recorded tracks to a file, the timestamps are
+// relative to the start of the file
+type mediaWriter interface {
+	write(track int, frame EncodedFrame, timestamp time.Duration) error
+	Close() error
+}
+
+// encodedFrameSource is implemented by the tracks whose encoded frames can be recorded
+type encodedFrameSource interface {
+	mediadevices.Track
+	OnEncodedFrame(handler func(EncodedFrame))
+	EncodeFrames(mimeType string) (io.Closer, error)
+	encoderMimeTypes() []string
+}
+
+type recordedFrame struct {
+	track int
+	frame EncodedFrame
+}
+
+// Recorder writes the encoded frames of the tracks to IVF, Ogg, WebM or Matroska files while
+// publishing, with the first codec of each track the format can hold. With WithSharedEncoder the
+// frames are the ones sent to the peer connections using that codec.
+type Recorder struct {
+	config RecorderConfig
+	ext    string
+	tracks []encodedFrameSource
+	// encoders are the encoders of the tracks started with EncodeFrames
+	encoders []io.Closer
+	frames   *frameQueue
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	// resync is set when a frame is dropped, the video frames depending on it are skipped
+	resync bool
+
+	// only used by the writing goroutine
+	formats      []*EncodedFrame
+	writer       mediaWriter
+	writerTracks []int
+	start        time.Duration
+	rotate       bool
+	keyRequested bool
+	waitKeyFrame bool
+	failed       bool
+}
+
+// NewRecorder starts recording the given tracks, the tracks that aren't written to the format of
+// the path are ignored
+func NewRecorder(config RecorderConfig, tracks ...mediadevices.Track) (*Recorder, error) {
+	r := &Recorder{
+		config: config,
+		ext:    strings.ToLower(filepath.Ext(config.Path)),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	switch r.ext {
+	case ".ivf", ".ogg", ".opus", ".webm", ".mkv":
+	default:
+		return nil, fmt.Errorf("unsupported recording format %s, valid extensions are .ivf|.ogg|.opus|.webm|.mkv", r.ext)
+	}
+	if config.SegmentDuration < 0 {
+		return nil, fmt.Errorf("invalid segment duration %s", config.SegmentDuration)
+	}
+	if config.QueueSize < 0 {
+		return nil, fmt.Errorf("invalid queue size %d", config.QueueSize)
+	}
+	if config.QueueSize == 0 {
+		config.QueueSize = recorderQueue
+	}
+	r.config = config
+	r.frames = newFrameQueue(config.QueueSize, config.SlowConsumer)
+
+	for _, track := range tracks {
+		source, ok := track.(encodedFrameSource)
+		if !ok {
+			continue
+		}
+		switch r.ext {
+		case ".ivf":
+			if track.Kind() != webrtc.RTPCodecTypeVideo || len(r.tracks) > 0 {
+				continue
+			}
+		case ".ogg", ".opus":
+			if track.Kind() != webrtc.RTPCodecTypeAudio || len(r.tracks) > 0 {
+				continue
+			}
+		}
+		r.tracks = append(r.tracks, source)
+	}
+	if len(r.tracks) == 0 {
+		return nil, fmt.Errorf("there is no track to record in %s", config.Path)
+	}
+	r.formats = make([]*EncodedFrame, len(r.tracks))
+
+	for i, track := range r.tracks {
+		i := i
+		track.OnEncodedFrame(func(frame EncodedFrame) {
+			r.mu.Lock()
+			closed := r.closed
+			r.mu.Unlock()
+			if closed {
+				return
+			}
+
+			// the data is only valid during the call
+			frame.Data = append([]byte(nil), frame.Data...)
+			if r.frames.push(recordedFrame{track: i, frame: frame}) {
+				r.mu.Lock()
+				r.resync = true
+				r.mu.Unlock()
+				log.Printf("Recorder %s is too slow, frame dropped\n", config.Path)
+			}
+		})
+	}
+
+	for _, track := range r.tracks {
+		encoder, err := r.encodeFrames(track)
+		if err != nil {
+			for _, encoder := range r.encoders {
+				encoder.Close()
+			}
+			return nil, err
+		}
+		r.encoders = append(r.encoders, encoder)
+	}
+
+	go r.run()
+	return r, nil
+}
+
+// encodeFrames starts the encoder of the first codec of the track written to the format, or of the
+// codec already encoded for another recorder
+func (r *Recorder) encodeFrames(track encodedFrameSource) (io.Closer, error) {
+	var errReasons []string
+	for _, mimeType := range track.encoderMimeTypes() {
+		if !recordable(r.ext, mimeType) {
+			continue
+		}
+		encoder, err := track.EncodeFrames(mimeType)
+		if err == nil {
+			return encoder, nil
+		}
+		errReasons = append(errReasons, fmt.Sprintf("%s: %s", mimeType, err))
+	}
+	if len(errReasons) == 0 {
+		return nil, fmt.Errorf("the %s track %s has no codec that can be written to %s", track.Kind(), track.ID(), r.config.Path)
+	}
+	return nil, fmt.Errorf("the %s track %s can't be recorded: %s", track.Kind(), track.ID(), strings.Join(errReasons, ", "))
+}
+
+// recordable returns whether the frames of the codec can be written to the format
+func recordable(ext string, mimeType string) bool {
+	codecID, ok := mkvCodecIDs[strings.ToLower(mimeType)]
+	switch ext {
+	case ".ivf":
+		return ok && codecID != mkvCodecOpus
+	case ".ogg", ".opus":
+		return codecID == mkvCodecOpus
+	case ".webm":
+		return ok && codecID != mkvCodecAVC
+	}
+	return ok
+}
+
+// Close stops recording and closes the file
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.mu.Unlock()
+
+	for _, encoder := range r.encoders {
+		encoder.Close()
+	}
+	close(r.stop)
+	<-r.done
+	r.frames.close()
+	if r.writer == nil {
+		return nil
+	}
+	return r.writer.Close()
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+
+	for {
+		select {
+		case <-r.stop:
+			// the queued frames are written before closing
+			for {
+				select {
+				case recorded := <-r.frames.items:
+					r.write(recorded.(recordedFrame))
+				default:
+					return
+				}
+			}
+		case recorded := <-r.frames.items:
+			r.write(recorded.(recordedFrame))
+		}
+	}
+}
+
+func (r *Recorder) hasVideo() bool {
+	for _, track := range r.tracks {
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			return true
+		}
+	}
+	return false
+}
+
+// write writes a frame, the files start on a video keyframe when there is video
+func (r *Recorder) write(recorded recordedFrame) {
+	if r.failed {
+		return
+	}
+	frame := recorded.frame
+	video := r.tracks[recorded.track].Kind() == webrtc.RTPCodecTypeVideo
+	// the format of a video track is its last keyframe, which carries the parameter sets the
+	// Matroska headers are built from
+	if format := frame; r.formats[recorded.track] == nil || !video || frame.KeyFrame {
+		r.formats[recorded.track] = &format
+	}
+
+	if r.writer != nil && r.config.SegmentDuration > 0 && frame.PTS-r.start >= r.config.SegmentDuration {
+		r.rotate = true
+	}
+	if r.writer != nil && r.rotate && (!r.hasVideo() || video && frame.KeyFrame) {
+		if err := r.writer.Close(); err != nil {
+			log.Printf("Recorder %s close failed: %v\n", r.config.Path, err)
+		}
+		r.writer, r.rotate = nil, false
+	}
+
+	if r.writer == nil {
+		if r.hasVideo() && !(video && frame.KeyFrame) {
+			r.requestKeyFrame()
+			return
+		}
+		if err := r.open(frame.PTS); err != nil {
+			log.Printf("Recording stopped: %v\n", err)
+			r.failed = true
+			return
+		}
+	} else if r.rotate {
+		r.requestKeyFrame()
+	}
+
+	r.mu.Lock()
+	resync := r.resync
+	r.resync = false
+	r.mu.Unlock()
+	if resync && r.hasVideo() {
+		r.waitKeyFrame, r.keyRequested = true, false
+		r.requestKeyFrame()
+	}
+	if video && r.waitKeyFrame {
+		if !frame.KeyFrame {
+			return
+		}
+		r.waitKeyFrame = false
+	}
+
+	// the frames of the tracks started after the file, or captured before its first keyframe,
+	// are not written
+	index := r.writerTracks[recorded.track]
+	if index < 0 || frame.PTS < r.start {
+		return
+	}
+	if err := r.writer.write(index, frame, frame.PTS-r.start); err != nil {
+		log.Printf("Recorder %s write failed: %v\n", r.config.Path, err)
+	}
+}
+
+// requestKeyFrame asks the encoders for a keyframe once per file, so the next file starts soon
+func (r *Recorder) requestKeyFrame() {
+	if r.keyRequested {
+		return
+	}
+	r.keyRequested = true
+	for _, track := range r.tracks {
+		if track, ok := track.(interface{ ForceKeyFrame() error }); ok {
+			if err := track.ForceKeyFrame(); err != nil {
+				log.Printf("Recorder keyframe request failed: %v\n", err)
+			}
+		}
+	}
+}
+
+// open creates the next file with the tracks whose format is known
+func (r *Recorder) open(start time.Duration) error {
+	path := r.config.Path
+	if r.config.SegmentDuration > 0 {
+		path = strings.TrimSuffix(path, filepath.Ext(path)) + "-" + time.Now().Format("20060102-150405") + filepath.Ext(path)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	var formats []EncodedFrame
+	r.writerTracks = make([]int, len(r.tracks))
+	for i, format := range r.formats {
+		r.writerTracks[i] = -1
+		if format != nil {
+			r.writerTracks[i] = len(formats)
+			formats = append(formats, *format)
+		}
+	}
+
+	var writer mediaWriter
+	switch r.ext {
+	case ".ivf":
+		writer, err = newIVFWriter(file, formats[0])
+	case ".ogg", ".opus":
+		writer, err = newOggWriter(file, formats[0])
+	case ".webm":
+		writer, err = newWebMWriter(file, "webm", formats)
+	default:
+		writer, err = newWebMWriter(file, "matroska", formats)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	log.Printf("Recording to %s\n", path)
+	r.writer, r.start, r.keyRequested = writer, start, false
+	return nil
+}
+
+// isKeyFrame returns whether an encoded frame can be decoded without the previous ones, audio
+// packets always can
+func isKeyFrame(mimeType string, data []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		// the inverse key frame flag of the frame tag, RFC 6386 section 9.1
+		return len(data) > 0 && data[0]&0x01 == 0
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return vp9KeyFrame(data)
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return h264KeyFrame(data)
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		return av1KeyFrame(data)
+	}
+	return true
+}
+
+// vp9KeyFrame reads the frame type of the uncompressed header: frame marker (2 bits), profile
+// (2 bits and a reserved one for profile 3), show existing frame and frame type, 0 for keyframes
+func vp9KeyFrame(data []byte) bool {
+	if len(data) == 0 || data[0]>>6 != 2 {
+		return false
+	}
+	profile := (data[0]>>5)&1 | (data[0]>>4)&1<<1
+	shift := uint(3)
+	if profile == 3 {
+		shift = 2
+	}
+	showExisting := (data[0] >> shift) & 1
+	frameType := (data[0] >> (shift - 1)) & 1
+	return showExisting == 0 && frameType == 0
+}
+
+// h264KeyFrame looks for an IDR slice in the Annex B NAL units
+func h264KeyFrame(data []byte) bool {
+	for _, nal := range annexBNALUnits(data) {
+		if nal[0]&0x1f == h264NALIDR {
+			return true
+		}
+	}
+	return false
+}
+
+// H.264 NAL unit types
+const (
+	h264NALIDR = 5
+	h264NALSPS = 7
+	h264NALPPS = 8
+)
+
+// annexBNALUnits splits an Annex B frame in NAL units, without their start codes
+func annexBNALUnits(data []byte) [][]byte {
+	var units [][]byte
+	add := func(unit []byte) {
+		// the leading zero of the next 4 byte start code
+		for len(unit) > 0 && unit[len(unit)-1] == 0 {
+			unit = unit[:len(unit)-1]
+		}
+		if len(unit) > 0 {
+			units = append(units, unit)
+		}
+	}
+
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				add(data[start:i])
+			}
+			start = i + 3
+			i += 2
+		}
+	}
+	if start >= 0 {
+		add(data[start:])
+	}
+	return units
+}
+
+// av1KeyFrame looks for a sequence header OBU, which the encoders send with every keyframe
+func av1KeyFrame(data []byte) bool {
+	for _, obu := range av1OBUs(data) {
+		if obu.obuType == av1OBUSequenceHeader {
+			return true
+		}
+	}
+	return false
+}
+
+// AV1 OBU types
+const (
+	av1OBUSequenceHeader    = 1
+	av1OBUTemporalDelimiter = 2
+)
+
+type av1OBU struct {
+	obuType int
+	// data is the whole OBU and payload the data after its header and size
+	data    []byte
+	payload []byte
+}
+
+// av1OBUs splits a temporal unit in the low overhead bitstream format in OBUs, the list stops at
+// the first malformed one
+func av1OBUs(data []byte) []av1OBU {
+	var obus []av1OBU
+	for len(data) > 0 {
+		header := data[0]
+		offset := 1
+		if header&0x04 != 0 {
+			// extension header
+			offset++
+		}
+		if offset > len(data) {
+			return obus
+		}
+
+		// the last OBU may have no size field
+		size := uint64(len(data) - offset)
+		if header&0x02 != 0 {
+			// leb128 size
+			size = 0
+			for i := 0; ; i++ {
+				if i == 8 || offset >= len(data) {
+					return obus
+				}
+				b := data[offset]
+				offset++
+				size |= uint64(b&0x7f) << (7 * uint(i))
+				if b&0x80 == 0 {
+					break
+				}
+			}
+		}
+		if size > uint64(len(data)-offset) {
+			return obus
+		}
+
+		end := offset + int(size)
+		obus = append(obus, av1OBU{obuType: int(header>>3) & 0x0f, data: data[:end], payload: data[offset:end]})
+		data = data[end:]
+	}
+	return obus
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/wave"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+)
+
+// av1 temporal units: a temporal delimiter, a sequence header with a reduced still picture header
+// of profile 0 and level 8, and a frame
+var (
+	av1TemporalDelimiter = []byte{0x12, 0x00}
+	av1SequenceHeader    = []byte{0x0a, 0x04, 0x1a, 0x00, 0x00, 0x00}
+	av1Frame             = []byte{0x32, 0x02, 0x10, 0x00}
+	av1Key               = concat(av1TemporalDelimiter, av1SequenceHeader, av1Frame)
+	av1Inter             = concat(av1TemporalDelimiter, av1Frame)
+)
+
+func TestIsKeyFrame(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		data     []byte
+		expected bool
+	}{
+		{"vp8 keyframe", webrtc.MimeTypeVP8, []byte{0x10, 0x02, 0x00}, true},
+		{"vp8 interframe", webrtc.MimeTypeVP8, []byte{0x11, 0x02, 0x00}, false},
+		{"vp8 empty", webrtc.MimeTypeVP8, nil, false},
+		{"vp9 keyframe", webrtc.MimeTypeVP9, []byte{0x82, 0x49, 0x83}, true},
+		{"vp9 interframe", webrtc.MimeTypeVP9, []byte{0x86, 0x00}, false},
+		{"vp9 show existing frame", webrtc.MimeTypeVP9, []byte{0x88}, false},
+		{"vp9 profile 3 keyframe", webrtc.MimeTypeVP9, []byte{0xb0}, true},
+		{"vp9 profile 3 interframe", webrtc.MimeTypeVP9, []byte{0xb2}, false},
+		{"vp9 invalid frame marker", webrtc.MimeTypeVP9, []byte{0x02}, false},
+		{"h264 idr with parameter sets", webrtc.MimeTypeH264, []byte{0, 0, 0, 1, 0x67, 0x42, 0xc0, 0x1f, 0, 0, 0, 1, 0x68, 0xce, 0, 0, 1, 0x65, 0x88}, true},
+		{"h264 non-idr slice", webrtc.MimeTypeH264, []byte{0, 0, 0, 1, 0x41, 0x9a}, false},
+		{"h264 without start code", webrtc.MimeTypeH264, []byte{0x65, 0x88}, false},
+		{"av1 keyframe", webrtc.MimeTypeAV1, av1Key, true},
+		{"av1 without temporal delimiter", webrtc.MimeTypeAV1, concat(av1SequenceHeader, av1Frame), true},
+		{"av1 sequence header with extension", webrtc.MimeTypeAV1, concat(av1TemporalDelimiter, []byte{0x0e, 0x00, 0x01, 0x1a}), true},
+		{"av1 interframe", webrtc.MimeTypeAV1, av1Inter, false},
+		{"av1 truncated sequence header", webrtc.MimeTypeAV1, concat(av1TemporalDelimiter, av1SequenceHeader[:4]), false},
+		{"opus", webrtc.MimeTypeOpus, []byte{0xf8}, true},
+	}
+	for _, test := range tests {
+		if got := isKeyFrame(test.mimeType, test.data); got != test.expected {
+			t.Errorf("%s: got %t, expected %t", test.name, got, test.expected)
+		}
+	}
+}
+
+func createTestFile(t *testing.T, dir string, name string) *os.File {
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func recordTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestIVFWriter(t *testing.T) {
+	dir := recordTestDir(t)
+	defer os.RemoveAll(dir)
+	file := createTestFile(t, dir, "video.ivf")
+	frames := []EncodedFrame{
+		{MimeType: webrtc.MimeTypeVP8, Data: []byte{0x10, 0x01, 0x02}, KeyFrame: true, Width: 640, Height: 360},
+		{MimeType: webrtc.MimeTypeVP8, Data: []byte{0x11, 0x03}},
+	}
+	w, err := newIVFWriter(file, frames[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range frames {
+		if err := w.write(0, frame, time.Duration(i)*33*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := os.Open(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer written.Close()
+	reader, header, err := ivfreader.NewWith(written)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.FourCC != "VP80" || header.Width != 640 || header.Height != 360 || header.NumFrames != 2 || header.TimebaseDenominator != 1000 {
+		t.Errorf("got the header %+v", header)
+	}
+	for i, frame := range frames {
+		data, frameHeader, err := reader.ParseNextFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, frame.Data) || frameHeader.Timestamp != uint64(i*33) {
+			t.Errorf("frame %d: got %x at %d", i, data, frameHeader.Timestamp)
+		}
+	}
+
+	if _, err := newIVFWriter(createTestFile(t, dir, "audio.ivf"), EncodedFrame{MimeType: webrtc.MimeTypeOpus}); err == nil {
+		t.Error("opus written to an IVF file")
+	}
+}
+
+func TestOggWriter(t *testing.T) {
+	dir := recordTestDir(t)
+	defer os.RemoveAll(dir)
+	file := createTestFile(t, dir, "audio.ogg")
+	// CELT fullband 20ms mono packets
+	packets := [][]byte{{0xf8, 0x01, 0x02}, {0xf8, 0x03}, {0xf8, 0x04}}
+	w, err := newOggWriter(file, EncodedFrame{MimeType: webrtc.MimeTypeOpus, Data: packets[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, packet := range packets {
+		frame := EncodedFrame{MimeType: webrtc.MimeTypeOpus, Data: packet, KeyFrame: true}
+		if err := w.write(0, frame, time.Duration(i)*20*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := os.Open(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer written.Close()
+	// the reader checks the CRC of every page
+	reader, header, err := oggreader.NewWith(written)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Channels != 1 || header.SampleRate != 48000 || header.PreSkip != opusPreSkip {
+		t.Errorf("got the header %+v", header)
+	}
+	if tags, _, err := reader.ParseNextPage(); err != nil || !bytes.HasPrefix(tags, []byte("OpusTags")) {
+		t.Fatalf("got the tags %q: %v", tags, err)
+	}
+	for i, packet := range packets {
+		data, pageHeader, err := reader.ParseNextPage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the granule position is the end of the packet
+		if granule := uint64((i+1)*960 + opusPreSkip); !bytes.Equal(data, packet) || pageHeader.GranulePosition != granule {
+			t.Errorf("packet %d: got %x at %d, expected %x at %d", i, data, pageHeader.GranulePosition, packet, granule)
+		}
+	}
+
+	if _, err := newOggWriter(createTestFile(t, dir, "video.ogg"), EncodedFrame{MimeType: webrtc.MimeTypeVP8}); err == nil {
+		t.Error("VP8 written to an Ogg file")
+	}
+}
+
+func TestWebMWriter(t *testing.T) {
+	dir := recordTestDir(t)
+	defer os.RemoveAll(dir)
+	vp8 := EncodedFrame{MimeType: webrtc.MimeTypeVP8, Data: []byte{0x10, 0x01}, KeyFrame: true, Width: 640, Height: 360}
+	opus := EncodedFrame{MimeType: webrtc.MimeTypeOpus, Data: []byte{0xf8, 0x02}, KeyFrame: true}
+	h264 := EncodedFrame{MimeType: webrtc.MimeTypeH264, Data: []byte{0, 0, 0, 1, 0x67, 0x42, 0xc0, 0x1f, 0, 0, 0, 1, 0x68, 0xce, 0, 0, 1, 0x65, 0x88}, KeyFrame: true}
+	av1 := EncodedFrame{MimeType: webrtc.MimeTypeAV1, Data: av1Key, KeyFrame: true}
+
+	tests := []struct {
+		name    string
+		docType string
+		formats []EncodedFrame
+		// expected are the byte sequences of the elements in the file
+		expected [][]byte
+	}{
+		{"vp8 and opus", "webm", []EncodedFrame{vp8, opus}, [][]byte{
+			ebmlElement(ebmlDocTypeID, []byte("webm")),
+			ebmlElement(mkvCodecIDID, []byte("V_VP8")),
+			ebmlElement(mkvCodecIDID, []byte(mkvCodecOpus)),
+			ebmlElement(mkvCodecPrivateID, opusHead(1)),
+			// track 1 at 0ms, keyframe
+			ebmlElement(mkvSimpleBlockID, concat([]byte{0x81, 0, 0, 0x80}, vp8.Data)),
+			// track 2 at 20ms
+			ebmlElement(mkvSimpleBlockID, concat([]byte{0x82, 0, 20, 0x80}, opus.Data)),
+		}},
+		{"h264", "matroska", []EncodedFrame{h264}, [][]byte{
+			ebmlElement(ebmlDocTypeID, []byte("matroska")),
+			ebmlElement(mkvCodecIDID, []byte(mkvCodecAVC)),
+			// the avcC with the SPS and the PPS
+			ebmlElement(mkvCodecPrivateID, []byte{1, 0x42, 0xc0, 0x1f, 0xff, 0xe1, 0, 4, 0x67, 0x42, 0xc0, 0x1f, 1, 0, 2, 0x68, 0xce}),
+			// the NAL units with their length
+			ebmlElement(mkvSimpleBlockID, []byte{0x81, 0, 0, 0x80, 0, 0, 0, 4, 0x67, 0x42, 0xc0, 0x1f, 0, 0, 0, 2, 0x68, 0xce, 0, 0, 0, 2, 0x65, 0x88}),
+		}},
+		{"av1", "matroska", []EncodedFrame{av1}, [][]byte{
+			ebmlElement(mkvCodecIDID, []byte(mkvCodecAV1)),
+			// the av1C of profile 0 and level 8 with the sequence header
+			ebmlElement(mkvCodecPrivateID, concat([]byte{0x81, 0x08, 0x0c, 0}, av1SequenceHeader)),
+			// the blocks have no temporal delimiter
+			ebmlElement(mkvSimpleBlockID, concat([]byte{0x81, 0, 0, 0x80}, av1SequenceHeader, av1Frame)),
+		}},
+	}
+	for _, test := range tests {
+		file := createTestFile(t, dir, "recording.mkv")
+		w, err := newWebMWriter(file, test.docType, test.formats)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for i, frame := range test.formats {
+			if err := w.write(i, frame, time.Duration(i)*20*time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadFile(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, ebmlID(ebmlHeaderID)) {
+			t.Errorf("%s: no EBML header", test.name)
+		}
+		for _, expected := range test.expected {
+			if !bytes.Contains(data, expected) {
+				t.Errorf("%s: %x not found", test.name, expected)
+			}
+		}
+	}
+
+	if _, err := newWebMWriter(createTestFile(t, dir, "video.webm"), "webm", []EncodedFrame{h264}); err == nil {
+		t.Error("H.264 written to a WebM file")
+	}
+}
+
+// TestRecorderEncoder records an audio track without peer connection while another encoder of the
+// track runs, like the one of a peer connection without WithSharedEncoder
+func TestRecorderEncoder(t *testing.T) {
+	dir := recordTestDir(t)
+	defer os.RemoveAll(dir)
+	info := wave.ChunkInfo{Len: 960, Channels: 1, SamplingRate: 48000}
+	var mu sync.Mutex
+	var samples int
+	tone := audio.ReaderFunc(func() (wave.Audio, func(), error) {
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		chunk := wave.NewInt16Interleaved(info)
+		for i := range chunk.Data {
+			chunk.Data[i] = int16(8000 * math.Sin(2*math.Pi*440*float64(samples+i)/48000))
+		}
+		samples += info.Len
+		return chunk, func() {}, nil
+	})
+	track := newAudioTrackFromReader(tone, NewCodecSelector(WithAudioEncoders(newOpusParams()))).(*AudioTrack)
+	defer track.Close()
+
+	other, err := track.NewRTPReader(webrtc.MimeTypeOpus, 0, rtpOutboundMTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer other.Close()
+		for {
+			if _, _, err := other.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	file := createTestFile(t, dir, "audio.ogg")
+	file.Close()
+	start := time.Now()
+	recorder, err := NewRecorder(RecorderConfig{Path: file.Name(), SlowConsumer: Block}, track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	written, err := os.Open(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer written.Close()
+	reader, _, err := oggreader.NewWith(written)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := -1
+	var last uint64
+	for {
+		_, header, err := reader.ParseNextPage()
+		if err != nil {
+			break
+		}
+		if packets >= 0 && header.GranulePosition <= last {
+			t.Fatalf("packet %d at %d after %d", packets, header.GranulePosition, last)
+		}
+		packets++
+		last = header.GranulePosition
+	}
+	// the packets of 20ms of a single encoder
+	if max := int(elapsed/(20*time.Millisecond)) + 2; packets < 10 || packets > max {
+		t.Errorf("got %d packets in %s, expected at most %d", packets, elapsed, max)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const socketRetryInterval = time.Second
+
+var (
+	// listenedAddresses are the addresses the socket inputs listen on, an address accepts the
+	// producer of a single input
+	listenedAddressesMu sync.Mutex
+	listenedAddresses   = make(map[string]bool)
+)
+
+// socketInput is an input read from a Unix domain or TCP socket, f.e. unix:///tmp/video.sock or
+// tcp://localhost:9000 to connect to a producer, or with ?listen to wait for the producer to
+// connect. Whenever the connection is lost the input connects or accepts a new one.
+type socketInput struct {
+	name     string
+	network  string
+	address  string
+	listener net.Listener
+	// listened is the key of the address in listenedAddresses
+	listened string
+
+	// ctx is cancelled by Close
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+// newSocketInput starts listening when listen is set, otherwise it connects on the first read
+func newSocketInput(name string, network string, address string, listen bool) (*socketInput, error) {
+	input := &socketInput{
+		name:    name,
+		network: network,
+		address: address,
+	}
+	input.ctx, input.cancel = context.WithCancel(context.Background())
+
+	if listen {
+		// a second listener would take the connections of the first one, or remove its unix socket
+		key := network + "://" + address
+		listenedAddressesMu.Lock()
+		defer listenedAddressesMu.Unlock()
+		if listenedAddresses[key] {
+			return nil, fmt.Errorf("%s is already listened on by another input, use format=framed to send the video and the audio on one connection", key)
+		}
+
+		if network == "unix" {
+			// remove the socket left behind by a previous run, but never a regular file
+			if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+				os.Remove(address)
+			}
+		}
+
+		var err error
+		input.listener, err = net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		input.listened = key
+		listenedAddresses[key] = true
+	}
+
+	return input, nil
+}
+
+func (input *socketInput) String() string {
+	return input.name
+}
+
+// connect returns the next connection to the producer, retrying until it succeeds or the input
+// is closed
+func (input *socketInput) connect() (io.ReadCloser, error) {
+	var dialer net.Dialer
+	for {
+		var conn net.Conn
+		var err error
+		if input.listener != nil {
+			conn, err = input.listener.Accept()
+		} else {
+			conn, err = dialer.DialContext(input.ctx, input.network, input.address)
+		}
+		if err == nil {
+			log.Printf("Input %s connected", input.name)
+			return conn, nil
+		}
+
+		if input.ctx.Err() != nil {
+			return nil, errInputClosed
+		}
+		log.Printf("Input %s failed to connect: %v", input.name, err)
+		select {
+		case <-time.After(socketRetryInterval):
+		case <-input.ctx.Done():
+			return nil, errInputClosed
+		}
+	}
+}
+
+// Close stops connecting and listening
+func (input *socketInput) Close() error {
+	var err error
+	input.closeOnce.Do(func() {
+		input.cancel()
+		if input.listener != nil {
+			err = input.listener.Close()
+
+			listenedAddressesMu.Lock()
+			delete(listenedAddresses, input.listened)
+			listenedAddressesMu.Unlock()
+		}
+	})
+	return err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/mediadevices"
+)
+
+func TestSocketFillersWhileStalled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	address := filepath.Join(dir, "video.sock")
+
+	uri, _, err := ParseSourceURI("unix://" + address + "?listen&width=2&height=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	track, err := newSocketTrack(uri, "unix", mediadevices.VideoInput, NewCodecSelector())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer track.Close()
+
+	// the raw audio of the same address would take the connections of the video
+	if _, err := newSocketTrack(uri, "unix", mediadevices.AudioInput, NewCodecSelector()); err == nil {
+		t.Error("a second input listened on the same address")
+	}
+
+	frames := make(chan bool)
+	go func() {
+		r := track.(*VideoTrack).NewReader(false)
+		for {
+			img, release, err := r.Read()
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- isFiller(img)
+			release()
+		}
+	}()
+	// fillers until the producer connects
+	if filler := <-frames; !filler {
+		t.Fatal("got a frame before the producer connected")
+	}
+
+	conn, err := net.Dial("unix", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(make([]byte, 6))
+
+	// the frame of the producer, then fillers once it stalls while still connected
+	var received time.Time
+	for filler := range frames {
+		if !filler {
+			received = time.Now()
+		} else if !received.IsZero() {
+			if elapsed := time.Since(received); elapsed < fillStallTimeout {
+				t.Fatalf("filler sent %s after the frame of the producer", elapsed)
+			}
+			return
+		}
+	}
+	t.Fatal("the track ended")
+}
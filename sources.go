@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/wave"
+)
+
+// SourceOption is an option of an input source, set as a query parameter of its URI
+type SourceOption struct {
+	Name        string
+	Default     string
+	Description string
+}
+
+// SourceURI is a parsed input URI, f.e. file:/tmp/video.yuv?width=640&height=360
+type SourceURI struct {
+	Scheme string
+	// Path is everything between the scheme and the options
+	Path    string
+	options map[string]string
+}
+
+// Option returns the value of an option, or its default when it wasn't set
+func (uri *SourceURI) Option(name string) string {
+	return uri.options[name]
+}
+
+// IntOption returns the value of an integer option
+func (uri *SourceURI) IntOption(name string) (int, error) {
+	value, err := strconv.Atoi(uri.options[name])
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s option %s of %s input", name, uri.options[name], uri.Scheme)
+	}
+	return value, nil
+}
+
+// BoolOption returns the value of a boolean option, an option without value is true
+func (uri *SourceURI) BoolOption(name string) (bool, error) {
+	value := uri.options[name]
+	if value == "" {
+		return true, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s option %s of %s input", name, value, uri.Scheme)
+	}
+	return enabled, nil
+}
+
+func (uri *SourceURI) String() string {
+	return uri.Scheme + ":" + uri.Path
+}
+
+// SourceFactory creates the tracks of an input source
+type SourceFactory struct {
+	Description string
+	// Kinds are the kinds of track the source can produce
+	Kinds []mediadevices.MediaDeviceType
+	// Options are the only query parameters accepted in the URIs of the source
+	Options []SourceOption
+	// NewTrack creates a track of the given kind, the tracks must be encoded with the codecs of
+	// the selector, f.e. by reading the raw media with newVideoTrackFromReader
+	NewTrack func(uri *SourceURI, kind mediadevices.MediaDeviceType, selector *CodecSelector) (mediadevices.Track, error)
+}
+
+func (factory *SourceFactory) supports(kind mediadevices.MediaDeviceType) bool {
+	for _, supported := range factory.Kinds {
+		if supported == kind {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	sourcesMu sync.RWMutex
+	sources   = make(map[string]*SourceFactory)
+)
+
+// RegisterSource makes an input source available with the given URI scheme. It panics if the
+// scheme is already registered, like database/sql.Register.
+func RegisterSource(scheme string, factory SourceFactory) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+
+	if factory.NewTrack == nil {
+		panic("RegisterSource: missing NewTrack for source " + scheme)
+	}
+	if _, ok := sources[scheme]; ok {
+		panic("RegisterSource: source registered twice " + scheme)
+	}
+	sources[scheme] = &factory
+}
+
+// SourceSchemes returns the registered URI schemes
+func SourceSchemes() []string {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+
+	schemes := make([]string, 0, len(sources))
+	for scheme := range sources {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// SourceUsage describes the registered sources and their options
+func SourceUsage() string {
+	var usage strings.Builder
+
+	for _, scheme := range SourceSchemes() {
+		sourcesMu.RLock()
+		factory := sources[scheme]
+		sourcesMu.RUnlock()
+
+		fmt.Fprintf(&usage, "  %s: %s\n", scheme, factory.Description)
+		for _, option := range factory.Options {
+			fmt.Fprintf(&usage, "      %s: %s (default %q)\n", option.Name, option.Description, option.Default)
+		}
+	}
+	return usage.String()
+}
+
+// ParseSourceURI parses an input and checks its options. For compatibility "screen" and "test"
+// don't need the colon and any other name without a registered scheme is a file.
+func ParseSourceURI(name string) (*SourceURI, *SourceFactory, error) {
+	uri := &SourceURI{Scheme: "file", Path: name}
+	switch {
+	case name == "screen" || name == "test":
+		uri.Scheme, uri.Path = name, ""
+	case isSourceScheme(name):
+		i := strings.Index(name, ":")
+		uri.Scheme, uri.Path = strings.ToLower(name[:i]), name[i+1:]
+	}
+
+	sourcesMu.RLock()
+	factory, ok := sources[uri.Scheme]
+	sourcesMu.RUnlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown input source %s, valid sources are %s", uri.Scheme, strings.Join(SourceSchemes(), "|"))
+	}
+
+	values, err := splitSourceOptions(uri, factory)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid options of input %s: %w", name, err)
+	}
+
+	uri.options = make(map[string]string)
+	for _, option := range factory.Options {
+		uri.options[option.Name] = option.Default
+		if value, ok := values[option.Name]; ok {
+			uri.options[option.Name] = value[len(value)-1]
+		}
+	}
+
+	return uri, factory, nil
+}
+
+// splitSourceOptions removes the options after the last question mark from the path. When the
+// text after it isn't made of options of the source only, f.e. the query of a URL in the
+// arguments of ffmpeg or the options of the last input of a compose input, it is kept in the
+// path.
+func splitSourceOptions(uri *SourceURI, factory *SourceFactory) (url.Values, error) {
+	i := strings.LastIndex(uri.Path, "?")
+	if i < 0 {
+		return url.Values{}, nil
+	}
+
+	query := uri.Path[i+1:]
+	for _, pair := range strings.Split(query, "&") {
+		if pair == "" {
+			continue
+		}
+		name := strings.SplitN(pair, "=", 2)[0]
+		known := false
+		for _, option := range factory.Options {
+			known = known || option.Name == name
+		}
+		if !known {
+			return url.Values{}, nil
+		}
+	}
+
+	uri.Path = uri.Path[:i]
+	return url.ParseQuery(query)
+}
+
+// isSourceScheme returns whether the name starts with a scheme, so paths with a colon in a later
+// segment are still files
+func isSourceScheme(name string) bool {
+	i := strings.Index(name, ":")
+	if i < 2 {
+		return false
+	}
+	for _, c := range name[:i] {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// newSourceTrack creates the track of an input of the given kind
+func newSourceTrack(name string, kind mediadevices.MediaDeviceType, selector *CodecSelector) (mediadevices.Track, error) {
+	uri, factory, err := parseSourceKind(name, kind)
+	if err != nil {
+		return nil, err
+	}
+	return factory.NewTrack(uri, kind, selector)
+}
+
+func kindName(kind mediadevices.MediaDeviceType) string {
+	if kind == mediadevices.AudioInput {
+		return "audio"
+	}
+	return "video"
+}
+
+var (
+	videoKinds = []mediadevices.MediaDeviceType{mediadevices.VideoInput}
+	bothKinds  = []mediadevices.MediaDeviceType{mediadevices.VideoInput, mediadevices.AudioInput}
+
+	// streamOptions are the options of the sources reading raw or framed media from a byte stream
+	streamOptions = []SourceOption{
+		{"format", "raw", "raw for fixed size frames or framed for the framed protocol"},
+		{"width", "1280", "width of the raw I420 video frames"},
+		{"height", "720", "height of the raw I420 video frames"},
+		{"sample-rate", "48000", "sample rate of the raw S16LE audio"},
+		{"channels", "1", "channels of the raw S16LE audio"},
+	}
+	socketOptions = append([]SourceOption{
+		{"listen", "false", "wait for the producer to connect instead of connecting to it"},
+	}, streamOptions...)
+)
+
+func init() {
+	RegisterSource("screen", SourceFactory{
+		Description: "screen capture",
+		Kinds:       videoKinds,
+		NewTrack: func(uri *SourceURI, kind mediadevices.MediaDeviceType, selector *CodecSelector) (mediadevices.Track, error) {
+			return getScreenVideoTrack(selector)
+		},
+	})
+	RegisterSource("test", SourceFactory{
+		Description: "SMPTE bars or moving pattern with a wall clock timecode and a tone, with flashes and beeps every second",
+		Kinds:       bothKinds,
+		Options:     testSourceOptions,
+		NewTrack: func(uri *SourceURI, kind mediadevices.MediaDeviceType, selector *CodecSelector) (mediadevices.Track, error) {
+			if kind == mediadevices.AudioInput {
+				return getTestAudioTrack(uri, selector)
+			}
+			return getTestVideoTrack(uri, selector)
+		},
+	})
+	RegisterSource("file", SourceFactory{
+		Description: "raw or framed media read from a file or a named pipe, f.e. file:/dev/stdin",
+		Kinds:       bothKinds,
+		Options:     streamOptions,
+		NewTrack: func(uri *SourceURI, kind mediadevices.MediaDeviceType, selector *CodecSelector) (mediadevices.Track, error) {
+			return newStreamTrack(uri, kind, selector, func() (io.Reader, error) {
+				return os.Open(uri.Path)
+			})
+		},
+	})
+	RegisterSource("udp", SourceFactory{
+		Description: "raw or framed media received as UDP datagrams of up to 64KB, f.e. udp://:5000",
+		Kinds:       bothKinds,
+		Options:     streamOptions,
+		NewTrack: func(uri *SourceURI, kind mediadevices.MediaDeviceType, selector *CodecSelector) (mediadevices.Track, error) {
+			return newStreamTrack(uri, kind, selector, func() (io.Reader, error) {
+				conn, err := net.ListenPacket("udp", strings.TrimPrefix(uri.Path, "//"))
+				if err != nil {
+					return nil, err
+				}
+				// datagrams bigger than the buffer passed to Read are truncated
+				return struct {
+					io.Reader
+					io.Closer
+				}{bufio.NewReaderSize(&packetReader{conn}, 64<<10), conn}, nil
+			})
+		},
+	})
+	for _, network := range []string{"unix", "tcp"} {
+		network := network
+		RegisterSource(network, SourceFactory{
+			Description: fmt.Sprintf("raw or framed media read from a %s socket, f.e. %s", network, map[string]string{"unix": "unix:///tmp/video.sock", "tcp": "tcp://localhost:9000"}[network]),
+			Kinds:       bothKinds,
+			Options:     socketOptions,
+			NewTrack: func(uri *SourceURI, kind mediadevices.MediaDeviceType, selector *CodecSelector) (mediadevices.Track, error) {
+				return newSocketTrack(uri, network, kind, selector)
+			},
+		})
+	}
+}
+
+// newStreamTrack creates a track reading the stream opened by open with the format of the uri
+func newStreamTrack(uri *SourceURI, kind mediadevices.MediaDeviceType, selector *CodecSelector, open func() (io.Reader, error)) (mediadevices.Track, error) {
+	if uri.Option("format") == "framed" {
+		return newFramedTrack(uri, kind, selector, func() (streamConnector, error) {
+			stream, err := open()
+			if err != nil {
+				return nil, err
+			}
+			return newStreamOnce(uri.String(), stream), nil
+		})
+	}
+	newVideoReader, newAudioReader, err := newStreamReaders(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	// the stream is closed with the track
+	closer, ok := stream.(io.Closer)
+	if !ok {
+		closer = ioutil.NopCloser(nil)
+	}
+	if kind == mediadevices.AudioInput {
+		return newAudioTrackFromReader(&closableAudioReader{Reader: newAudioReader(stream), Closer: closer}, selector), nil
+	}
+	return newVideoTrackFromReader(&closableVideoReader{Reader: newVideoReader(stream), Closer: closer}, selector), nil
+}
+
+func newSocketTrack(uri *SourceURI, network string, kind mediadevices.MediaDeviceType, selector *CodecSelector) (mediadevices.Track, error) {
+	listen, err := uri.BoolOption("listen")
+	if err != nil {
+		return nil, err
+	}
+
+	address := strings.TrimPrefix(uri.Path, "//")
+	if address == "" {
+		return nil, fmt.Errorf("invalid %s input: missing address", uri)
+	}
+	if uri.Option("format") == "framed" {
+		// the video and the audio tracks share the socket
+		return newFramedTrack(uri, kind, selector, func() (streamConnector, error) {
+			return newSocketInput(uri.String(), network, address, listen)
+		})
+	}
+
+	newVideoReader, newAudioReader, err := newStreamReaders(uri)
+	if err != nil {
+		return nil, err
+	}
+	// the fillers sent until the producer connects have the format of the raw options
+	width, height, sampleRate, channels, err := streamFormat(uri)
+	if err != nil {
+		return nil, err
+	}
+	socket, err := newSocketInput(uri.String(), network, address, listen)
+	if err != nil {
+		return nil, err
+	}
+
+	if kind == mediadevices.AudioInput {
+		info := wave.ChunkInfo{Len: sampleRate / 100, Channels: channels, SamplingRate: sampleRate}
+		return newAudioTrackFromReader(newReconnectingAudioReader(socket, newAudioReader, selector.clock, info), selector), nil
+	}
+	return newVideoTrackFromReader(newReconnectingVideoReader(socket, newVideoReader, selector.clock, image.Pt(width, height)), selector), nil
+}
+
+// newStreamReaders returns the constructors of the readers of the raw format of the uri
+func newStreamReaders(uri *SourceURI) (func(io.Reader) video.Reader, func(io.Reader) audio.Reader, error) {
+	if format := uri.Option("format"); format != "raw" {
+		return nil, nil, fmt.Errorf("invalid format %s of %s input, valid values are raw|framed", format, uri.Scheme)
+	}
+
+	width, height, sampleRate, channels, err := streamFormat(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return func(r io.Reader) video.Reader {
+			return newRawVideoReader(r, width, height)
+		}, func(r io.Reader) audio.Reader {
+			return newRawAudioReader(r, sampleRate, channels)
+		}, nil
+}
+
+// streamFormat returns the format of the raw frames of a stream source
+func streamFormat(uri *SourceURI) (width int, height int, sampleRate int, channels int, err error) {
+	var values [4]int
+	for i, name := range []string{"width", "height", "sample-rate", "channels"} {
+		value, err := uri.IntOption(name)
+		if err != nil {
+			return 0, 0, 0, 0, err
+		}
+		if value <= 0 {
+			return 0, 0, 0, 0, fmt.Errorf("invalid %s option %d of %s input", name, value, uri.Scheme)
+		}
+		values[i] = value
+	}
+	return values[0], values[1], values[2], values[3], nil
+}
+
+// packetReader reads the datagrams of a packet connection as a stream
+type packetReader struct {
+	conn net.PacketConn
+}
+
+func (r *packetReader) Read(b []byte) (int, error) {
+	n, _, err := r.conn.ReadFrom(b)
+	return n, err
+}
+
+// parseSourceKind parses an input that must provide the given kind
+func parseSourceKind(name string, kind mediadevices.MediaDeviceType) (*SourceURI, *SourceFactory, error) {
+	uri, factory, err := ParseSourceURI(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !factory.supports(kind) {
+		return nil, nil, fmt.Errorf("%s is not a valid %s input", uri.Scheme, kindName(kind))
+	}
+	return uri, factory, nil
+}
+
+// splitSourceInputs splits the inputs of the sources combining several inputs, separated by |
+func splitSourceInputs(path string) []string {
+	var inputs []string
+	for _, input := range strings.Split(path, "|") {
+		if input = strings.TrimSpace(input); input != "" {
+			inputs = append(inputs, input)
+		}
+	}
+	return inputs
+}
+
+// inputTracks are the tracks of the inputs of a source combining several inputs, they are closed
+// with the track of the source
+type inputTracks []mediadevices.Track
+
+func (tracks inputTracks) Close() error {
+	var err error
+	for _, track := range tracks {
+		if closeErr := track.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// validateSource checks the input can be parsed and provides the given kind
+func validateSource(name string, kind mediadevices.MediaDeviceType) error {
+	uri, _, err := parseSourceKind(name, kind)
+	if err != nil {
+		return err
+	}
+	switch uri.Scheme {
+	case "file":
+		if _, err := os.Stat(uri.Path); err != nil {
+			return fmt.Errorf("invalid %s input: %w", kindName(kind), err)
+		}
+	case "compose", "mix", "switch":
+		for _, input := range splitSourceInputs(uri.Path) {
+			if err := validateSource(input, kind); err != nil {
+				return fmt.Errorf("invalid %s input %s: %w", uri.Scheme, input, err)
+			}
+		}
+	}
+	return nil
+}
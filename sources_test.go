@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestParseSourceURI(t *testing.T) {
+	tests := []struct {
+		name         string
+		scheme, path string
+		// options are the expected values of some of the options
+		options map[string]string
+	}{
+		{"/tmp/video.yuv", "file", "/tmp/video.yuv", map[string]string{"width": "1280"}},
+		{"file:/tmp/video.yuv?width=640&height=360", "file", "/tmp/video.yuv", map[string]string{"width": "640", "height": "360"}},
+		{"ffmpeg:-i http://host/live?token=1&width=2", "ffmpeg", "-i http://host/live?token=1&width=2", map[string]string{"width": "1280"}},
+		{"compose:a.y4m|unix:///tmp/camera.sock?format=framed", "compose", "a.y4m|unix:///tmp/camera.sock?format=framed", map[string]string{"layout": "side-by-side"}},
+		{"compose:a.y4m|unix:///tmp/camera.sock?format=framed&width=640", "compose", "a.y4m|unix:///tmp/camera.sock?format=framed&width=640", map[string]string{"width": "1280"}},
+		{"compose:a.y4m|unix:///tmp/camera.sock?width=640?layout=pip&width=1920", "compose", "a.y4m|unix:///tmp/camera.sock?width=640", map[string]string{"layout": "pip", "width": "1920"}},
+	}
+	for _, test := range tests {
+		uri, _, err := ParseSourceURI(test.name)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if uri.Scheme != test.scheme || uri.Path != test.path {
+			t.Errorf("%s: got %s %s, expected %s %s", test.name, uri.Scheme, uri.Path, test.scheme, test.path)
+		}
+		for name, expected := range test.options {
+			if value := uri.Option(name); value != expected {
+				t.Errorf("%s: got the %s option %s, expected %s", test.name, name, value, expected)
+			}
+		}
+	}
+}
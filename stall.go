@@ -0,0 +1,189 @@
+package main
+
+import (
+	"image"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/wave"
+)
+
+// stallFiller is the input of the switch events of a track sending black frames or silence in
+// place of its stalled input
+const stallFiller = "filler"
+
+// WithStallTimeout monitors the input of every track: when it delivers no frames for the timeout
+// the track sends black frames or silence, marked as fillers, until it delivers again. The black
+// frames and the silence of a reconnecting input don't count as frames. Every stall and recovery
+// is emitted as a SwitchEvent from the ID of the track to "filler" and back. The switch sources
+// fail over on their own and are not monitored again, 0 disables the monitoring.
+func WithStallTimeout(timeout time.Duration) CodecSelectorOption {
+	return func(t *CodecSelector) {
+		t.stallTimeout = timeout
+	}
+}
+
+// stallMonitor follows the frames of an input and emits the events of its stalls
+type stallMonitor struct {
+	kind    string
+	timeout time.Duration
+	// id returns the ID of the track, which is set after the track is created
+	id func() string
+
+	last    time.Time
+	stalled bool
+}
+
+// delivered records a frame of the input, the fillers of a reconnecting input don't end a stall
+func (m *stallMonitor) delivered(filler bool) {
+	if filler {
+		m.check()
+		return
+	}
+	m.last = time.Now()
+	if m.stalled {
+		m.stalled = false
+		emitSwitchEvent(SwitchEvent{Kind: m.kind, From: stallFiller, To: m.id(), Reason: SwitchRecovered})
+	}
+}
+
+// check returns whether the input is stalled
+func (m *stallMonitor) check() bool {
+	if !m.stalled && time.Since(m.last) > m.timeout {
+		m.stalled = true
+		emitSwitchEvent(SwitchEvent{Kind: m.kind, From: m.id(), To: stallFiller, Reason: SwitchStalled})
+	}
+	return m.stalled
+}
+
+// stallInput reads the input in the background from the first read, so the monitor keeps going
+// while a read blocks
+type stallInput struct {
+	items     chan interface{}
+	ended     chan struct{}
+	done      chan struct{}
+	err       error
+	closer    io.Closer
+	startOnce sync.Once
+	closeOnce sync.Once
+}
+
+func newStallInput(closer io.Closer) *stallInput {
+	return &stallInput{items: make(chan interface{}), ended: make(chan struct{}), done: make(chan struct{}), closer: closer}
+}
+
+func (in *stallInput) start(read func() (interface{}, error)) {
+	in.startOnce.Do(func() {
+		go func() {
+			defer close(in.ended)
+			for {
+				item, err := read()
+				if err != nil {
+					in.err = err
+					return
+				}
+				select {
+				case in.items <- item:
+				case <-in.done:
+					return
+				}
+			}
+		}()
+	})
+}
+
+// Close closes the input, the item read in the background is dropped
+func (in *stallInput) Close() error {
+	in.closeOnce.Do(func() {
+		close(in.done)
+	})
+	if in.closer != nil {
+		return in.closer.Close()
+	}
+	return nil
+}
+
+// newStallVideoReader sends black frames of the size of the last frame at fillFrameRate while
+// the reader is stalled
+func newStallVideoReader(r video.Reader, timeout time.Duration, clock *mediaClock, id func() string) video.Reader {
+	closer, _ := r.(io.Closer)
+	in := newStallInput(closer)
+	monitor := &stallMonitor{kind: kindName(mediadevices.VideoInput), timeout: timeout, id: id}
+	var black *image.YCbCr
+
+	reader := video.ReaderFunc(func() (image.Image, func(), error) {
+		in.start(func() (interface{}, error) {
+			img, release, err := r.Read()
+			return streamImage{img, release}, err
+		})
+		if monitor.last.IsZero() {
+			monitor.last = time.Now()
+		}
+
+		for {
+			select {
+			case item := <-in.items:
+				frame := item.(streamImage)
+				monitor.delivered(isFiller(frame.img))
+				if bounds := frame.img.Bounds(); black == nil || black.Rect != bounds {
+					black = newBlackFrame(bounds)
+				}
+				return frame.img, frame.release, nil
+			case <-time.After(time.Second / fillFrameRate):
+				if monitor.check() && black != nil {
+					return withFiller(black, clock.now()), func() {}, nil
+				}
+			case <-in.ended:
+				return nil, func() {}, in.err
+			}
+		}
+	})
+	return &closableVideoReader{Reader: reader, Closer: in}
+}
+
+// newStallAudioReader sends silence in the format of the last chunk while the reader is stalled
+func newStallAudioReader(r audio.Reader, timeout time.Duration, clock *mediaClock, id func() string) audio.Reader {
+	closer, _ := r.(io.Closer)
+	in := newStallInput(closer)
+	monitor := &stallMonitor{kind: kindName(mediadevices.AudioInput), timeout: timeout, id: id}
+	var silence wave.Audio
+	var duration time.Duration
+
+	reader := audio.ReaderFunc(func() (wave.Audio, func(), error) {
+		in.start(func() (interface{}, error) {
+			chunk, release, err := r.Read()
+			return streamChunk{chunk, release}, err
+		})
+		if monitor.last.IsZero() {
+			monitor.last = time.Now()
+		}
+
+		for {
+			wait := duration
+			if wait == 0 {
+				wait = time.Second / fillFrameRate
+			}
+			select {
+			case item := <-in.items:
+				chunk := item.(streamChunk)
+				monitor.delivered(isFiller(chunk.chunk))
+				if info := chunk.chunk.ChunkInfo(); info.SamplingRate > 0 && (silence == nil || silence.ChunkInfo() != info) {
+					silence = wave.NewInt16Interleaved(info)
+					duration = time.Duration(info.Len) * time.Second / time.Duration(info.SamplingRate)
+				}
+				return chunk.chunk, chunk.release, nil
+			case <-time.After(wait):
+				if monitor.check() && silence != nil {
+					return withAudioFiller(silence, clock.now()), func() {}, nil
+				}
+			case <-in.ended:
+				return nil, func() {}, in.err
+			}
+		}
+	})
+	return &closableAudioReader{Reader: reader, Closer: in}
+}
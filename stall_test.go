@@ -0,0 +1,128 @@
+package main
+
+import (
+	"image"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/io/video"
+)
+
+// switchEvents collects the switch events of the inputs or tracks with the given names
+type switchEvents struct {
+	mu     sync.Mutex
+	names  map[string]bool
+	events []SwitchEvent
+}
+
+func newSwitchEvents(names ...string) *switchEvents {
+	events := &switchEvents{names: make(map[string]bool)}
+	for _, name := range names {
+		events.names[name] = true
+	}
+	OnSwitchEvent(events.add)
+	return events
+}
+
+func (events *switchEvents) add(event SwitchEvent) {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	if events.names[event.From] || events.names[event.To] {
+		events.events = append(events.events, event)
+	}
+}
+
+func (events *switchEvents) get() []SwitchEvent {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	return append([]SwitchEvent(nil), events.events...)
+}
+
+func TestStallTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	resume := make(chan struct{})
+	frames := 0
+	track := newVideoTrackFromReader(video.ReaderFunc(func() (image.Image, func(), error) {
+		// a frame, then nothing until resumed
+		if frames++; frames == 2 {
+			<-resume
+		}
+		time.Sleep(10 * time.Millisecond)
+		return image.NewYCbCr(image.Rect(0, 0, 2, 2), image.YCbCrSubsampleRatio420), func() {}, nil
+	}), NewCodecSelector(WithStallTimeout(timeout)))
+	defer track.Close()
+	events := newSwitchEvents(track.ID())
+
+	r := track.(*VideoTrack).NewReader(false)
+	read := func() (bool, time.Time) {
+		img, release, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+		return isFiller(img), time.Now()
+	}
+
+	if filler, _ := read(); filler {
+		t.Fatal("got a filler before the input stalled")
+	}
+	start := time.Now()
+	filler, at := read()
+	if !filler || at.Sub(start) < timeout {
+		t.Fatalf("got a filler %t after %s, expected a filler after %s", filler, at.Sub(start), timeout)
+	}
+	if got := events.get(); len(got) != 1 || got[0] != (SwitchEvent{Kind: "video", From: track.ID(), To: stallFiller, Reason: SwitchStalled}) {
+		t.Fatalf("got the events %+v", got)
+	}
+
+	close(resume)
+	for filler {
+		filler, _ = read()
+	}
+	if got := events.get(); len(got) != 2 || got[1] != (SwitchEvent{Kind: "video", From: stallFiller, To: track.ID(), Reason: SwitchRecovered}) {
+		t.Fatalf("got the events %+v", got)
+	}
+}
+
+func TestSwitchInputFromHandler(t *testing.T) {
+	bars, moving := "test:?pattern=bars", "test:?pattern=moving"
+	events := newSwitchEvents(bars, moving)
+	// the handlers run without the switches locked, so they can switch again
+	OnSwitchEvent(func(event SwitchEvent) {
+		if event.To == moving {
+			SwitchInput(0)
+		}
+	})
+
+	uri, _, err := ParseSourceURI("switch:" + bars + "|" + moving + "?stall-timeout=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	track, err := newSwitchTrack(uri, mediadevices.VideoInput, NewCodecSelector())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- SwitchInput(1) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout switching from a switch event handler")
+	}
+	if got := events.get(); len(got) != 2 || got[0].To != moving || got[1].To != bars {
+		t.Fatalf("got the events %+v", got)
+	}
+
+	track.Close()
+	switchersMu.Lock()
+	defer switchersMu.Unlock()
+	if len(switchers) != 0 {
+		t.Fatalf("%d switches left after closing the track", len(switchers))
+	}
+}
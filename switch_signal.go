@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifySwitchSignal sends the next input of the switch sources on every SIGUSR1
+func notifySwitchSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	go func() {
+		for range signals {
+			if err := SwitchNextInput(); err != nil {
+				log.Println("Switch signal ignored. ", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,4 @@
+package main
+
+// notifySwitchSignal does nothing, there is no SIGUSR1 on Windows, use the switch command instead
+func notifySwitchSignal() {}
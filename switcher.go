@@ -0,0 +1,518 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/wave"
+)
+
+const (
+	// switchVideoQueue and switchAudioQueue are the frames and chunks kept for each input, the
+	// oldest ones are dropped while the input is not active
+	switchVideoQueue = 2
+	switchAudioQueue = 10
+	// switchCheckInterval is the interval of the checks of the health of the inputs
+	switchCheckInterval = 100 * time.Millisecond
+)
+
+// Reasons of the switch events
+const (
+	SwitchManual    = "manual"
+	SwitchStalled   = "stalled"
+	SwitchRecovered = "recovered"
+)
+
+// SwitchEvent is emitted every time a switch source changes the input it sends
+type SwitchEvent struct {
+	Kind string
+	From string
+	To   string
+	// Reason is SwitchManual, SwitchStalled or SwitchRecovered
+	Reason string
+}
+
+func init() {
+	RegisterSource("switch", SourceFactory{
+		Description: "inputs separated by | sent one at a time, f.e. switch:unix:///tmp/camera.sock?format=framed|image:/tmp/slate.png?stall-timeout=2s, " +
+			"the options of the switch go after the ones of the last input",
+		Kinds: bothKinds,
+		Options: []SourceOption{
+			{"active", "0", "index of the primary input, sent at the start"},
+			{"stall-timeout", "2s", "time without frames after which the next healthy input is sent instead of the primary, 0 to disable"},
+			{"recover", "5s", "time the primary must deliver frames again before it is sent again"},
+		},
+		NewTrack: newSwitchTrack,
+	})
+	RegisterCommand("switch", Command{
+		Usage:       "<input>",
+		Description: "send another input of the switch inputs, which becomes the primary one",
+		Run: func(args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("invalid number of arguments")
+			}
+			index, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid input %s", args[0])
+			}
+			return SwitchInput(index)
+		},
+	})
+	OnSwitchEvent(func(event SwitchEvent) {
+		log.Printf("Switched %s from %s to %s, %s\n", event.Kind, event.From, event.To, event.Reason)
+	})
+}
+
+var (
+	switchersMu sync.Mutex
+	switchers   []*switcher
+
+	switchHandlersMu sync.Mutex
+	switchHandlers   []func(SwitchEvent)
+)
+
+// OnSwitchEvent adds a handler called on every change of the input of the switch sources
+func OnSwitchEvent(handler func(SwitchEvent)) {
+	switchHandlersMu.Lock()
+	defer switchHandlersMu.Unlock()
+	switchHandlers = append(switchHandlers, handler)
+}
+
+func emitSwitchEvent(event SwitchEvent) {
+	switchHandlersMu.Lock()
+	handlers := append(([]func(SwitchEvent))(nil), switchHandlers...)
+	switchHandlersMu.Unlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+// SwitchInput makes the input with the given index the primary input of all the switch sources
+// and sends it at the next frame boundary, with a keyframe
+func SwitchInput(index int) error {
+	var notifications []func()
+	err := func() error {
+		switchersMu.Lock()
+		defer switchersMu.Unlock()
+
+		if len(switchers) == 0 {
+			return fmt.Errorf("there is no switch input")
+		}
+		for _, s := range switchers {
+			if index < 0 || index >= len(s.inputs) {
+				return fmt.Errorf("invalid input %d, there are %d inputs", index, len(s.inputs))
+			}
+		}
+		for _, s := range switchers {
+			s.mu.Lock()
+			s.primary = index
+			s.mu.Unlock()
+			notifications = append(notifications, s.setActive(index, SwitchManual))
+		}
+		return nil
+	}()
+
+	// the keyframe requests and the event handlers don't run with the switches locked
+	for _, notify := range notifications {
+		notify()
+	}
+	return err
+}
+
+// SwitchNextInput makes the input after the primary one the primary input of all the switch
+// sources
+func SwitchNextInput() error {
+	var notifications []func()
+	err := func() error {
+		switchersMu.Lock()
+		defer switchersMu.Unlock()
+
+		if len(switchers) == 0 {
+			return fmt.Errorf("there is no switch input")
+		}
+		for _, s := range switchers {
+			s.mu.Lock()
+			s.primary = (s.primary + 1) % len(s.inputs)
+			next := s.primary
+			s.mu.Unlock()
+			notifications = append(notifications, s.setActive(next, SwitchManual))
+		}
+		return nil
+	}()
+
+	for _, notify := range notifications {
+		notify()
+	}
+	return err
+}
+
+// switcher sends the frames or chunks of the active input. The inputs that are not active are
+// still read so live producers don't block and their health is known, and the switch happens
+// between two frames. When the primary input stalls the switcher fails over to the next healthy
+// input, and goes back to the primary once it has been delivering frames for the recover time.
+// The video and audio switchers of the same URI are linked and fail over together.
+type switcher struct {
+	key          string
+	kind         mediadevices.MediaDeviceType
+	inputs       []*switchInput
+	tracks       inputTracks
+	stallTimeout time.Duration
+	recover      time.Duration
+
+	mu      sync.Mutex
+	primary int
+	active  int
+	// changed is closed and replaced when the active input changes
+	changed  chan struct{}
+	onSwitch func()
+	// linked is the switcher of the other kind of the same URI, the monitor of the first one
+	// checks the inputs of both
+	linked *switcher
+	// stopMonitor stops the monitor of the switcher, nil when it doesn't run one
+	stopMonitor chan struct{}
+	closed      bool
+}
+
+type switchInput struct {
+	name         string
+	queue        *frameQueue
+	stallTimeout time.Duration
+
+	mu sync.Mutex
+	// last is the time of the last frame that isn't a filler, healthy is the start of the current
+	// run of frames without stalls
+	last    time.Time
+	healthy time.Time
+}
+
+func newSwitchTrack(uri *SourceURI, kind mediadevices.MediaDeviceType, selector *CodecSelector) (mediadevices.Track, error) {
+	s := &switcher{key: uri.String() + "?" + fmt.Sprint(uri.options), kind: kind, changed: make(chan struct{})}
+
+	names := splitSourceInputs(uri.Path)
+	if len(names) == 0 {
+		return nil, fmt.Errorf("invalid %s input: missing inputs", uri)
+	}
+	active, err := uri.IntOption("active")
+	if err != nil {
+		return nil, err
+	}
+	if active < 0 || active >= len(names) {
+		return nil, fmt.Errorf("invalid active option %d of %s input, there are %d inputs", active, uri.Scheme, len(names))
+	}
+	s.primary, s.active = active, active
+	for name, value := range map[string]*time.Duration{"stall-timeout": &s.stallTimeout, "recover": &s.recover} {
+		if *value, err = time.ParseDuration(uri.Option(name)); err != nil || *value < 0 {
+			return nil, fmt.Errorf("invalid %s option %s of %s input", name, uri.Option(name), uri.Scheme)
+		}
+	}
+
+	// the filters and the overlays of the selector are applied once, after the switch, and the
+	// stalls of the inputs are handled by the switch
+	inputSelector := *selector
+	inputSelector.videoFilters = nil
+	inputSelector.overlays = nil
+	inputSelector.audioFilters = nil
+	inputSelector.stallTimeout = 0
+	trackSelector := *selector
+	trackSelector.stallTimeout = 0
+
+	now := time.Now()
+	for _, name := range names {
+		track, err := newSourceTrack(name, kind, &inputSelector)
+		if err != nil {
+			s.tracks.Close()
+			return nil, fmt.Errorf("invalid switch input %s: %w", name, err)
+		}
+		s.tracks = append(s.tracks, track)
+
+		// the inputs are expected to deliver their first frame within the stall timeout
+		input := &switchInput{name: name, stallTimeout: s.stallTimeout, last: now, healthy: now}
+		switch track := track.(type) {
+		case *VideoTrack:
+			input.queue = newFrameQueue(switchVideoQueue, DropOldest)
+			r := track.NewReader(false)
+			go input.run(func() (interface{}, bool, error) {
+				img, release, err := r.Read()
+				if err != nil {
+					return nil, false, err
+				}
+				defer release()
+				// the frames are timestamped again by the track so the timestamps go on across
+				// the switches
+				filler := isFiller(img)
+				img, _, _ = splitPresentationTimestamp(img)
+				return copyYCbCr(toYCbCr420(img)), filler, nil
+			})
+		case *AudioTrack:
+			input.queue = newFrameQueue(switchAudioQueue, DropOldest)
+			r := track.NewReader(false)
+			go input.run(func() (interface{}, bool, error) {
+				chunk, release, err := r.Read()
+				if err != nil {
+					return nil, false, err
+				}
+				defer release()
+				filler := isFiller(chunk)
+				chunk, _, _ = splitAudioPresentationTimestamp(chunk)
+				samples, isFloat := pcmSamples(chunk)
+				return pcmChunk(samples, chunk.ChunkInfo(), isFloat), filler, nil
+			})
+		default:
+			s.tracks.Close()
+			return nil, fmt.Errorf("invalid switch input %s: only raw inputs can be switched", name)
+		}
+		s.inputs = append(s.inputs, input)
+	}
+
+	var track mediadevices.Track
+	if kind == mediadevices.AudioInput {
+		reader := audio.ReaderFunc(func() (wave.Audio, func(), error) {
+			return s.next().(wave.Audio), func() {}, nil
+		})
+		track = newAudioTrackFromReader(&closableAudioReader{Reader: reader, Closer: s}, &trackSelector)
+	} else {
+		reader := video.ReaderFunc(func() (image.Image, func(), error) {
+			return s.next().(image.Image), func() {}, nil
+		})
+		videoTrack := newVideoTrackFromReader(&closableVideoReader{Reader: reader, Closer: s}, &trackSelector).(*VideoTrack)
+		track = videoTrack
+		// the first frame of the new input is encoded as a keyframe, so the receivers don't
+		// decode it with the references of the old input
+		s.onSwitch = func() {
+			if err := videoTrack.ForceKeyFrame(); err != nil {
+				log.Printf("Switch keyframe request failed: %v\n", err)
+			}
+		}
+	}
+
+	switchersMu.Lock()
+	for _, other := range switchers {
+		other.mu.Lock()
+		if other.key == s.key && other.kind != s.kind && other.linked == nil {
+			other.linked, s.linked = s, other
+		}
+		other.mu.Unlock()
+	}
+	switchers = append(switchers, s)
+	if s.linked == nil {
+		s.startMonitor()
+	}
+	switchersMu.Unlock()
+
+	return track, nil
+}
+
+// startMonitor runs the monitor of the inputs when failing over is enabled, switchersMu is held
+func (s *switcher) startMonitor() {
+	if s.stallTimeout == 0 || len(s.inputs) < 2 {
+		return
+	}
+	s.stopMonitor = make(chan struct{})
+	go s.monitor(s.stopMonitor)
+}
+
+// Close closes the inputs and removes the switcher from the ones changed by SwitchInput. The
+// linked switcher monitors its inputs on its own from then on.
+func (s *switcher) Close() error {
+	switchersMu.Lock()
+	for i, registered := range switchers {
+		if registered == s {
+			switchers = append(switchers[:i], switchers[i+1:]...)
+			break
+		}
+	}
+	if s.stopMonitor != nil {
+		close(s.stopMonitor)
+		s.stopMonitor = nil
+	}
+	s.mu.Lock()
+	linked := s.linked
+	s.linked, s.closed = nil, true
+	s.mu.Unlock()
+	if linked != nil {
+		linked.mu.Lock()
+		linked.linked = nil
+		closed := linked.closed
+		linked.mu.Unlock()
+		if !closed && linked.stopMonitor == nil {
+			linked.startMonitor()
+		}
+	}
+	switchersMu.Unlock()
+
+	return s.tracks.Close()
+}
+
+// run queues the items read from the input, dropping the oldest ones when the queue is full
+func (input *switchInput) run(read func() (interface{}, bool, error)) {
+	defer close(input.queue.items)
+
+	for {
+		item, filler, err := read()
+		if err != nil {
+			log.Printf("Switch input %s stopped: %v\n", input.name, err)
+			return
+		}
+		// the black frames and the silence of a reconnecting input don't make it healthy
+		if !filler {
+			input.delivered(time.Now())
+		}
+
+		input.queue.push(item)
+	}
+}
+
+func (input *switchInput) delivered(now time.Time) {
+	input.mu.Lock()
+	defer input.mu.Unlock()
+
+	if now.Sub(input.last) > input.stallTimeout {
+		input.healthy = now
+	}
+	input.last = now
+}
+
+// status returns whether the input stalled and for how long it has been delivering frames
+func (input *switchInput) status(now time.Time) (bool, time.Duration) {
+	input.mu.Lock()
+	defer input.mu.Unlock()
+
+	if now.Sub(input.last) > input.stallTimeout {
+		return true, 0
+	}
+	return false, now.Sub(input.healthy)
+}
+
+// monitor fails over when the active input stalls and goes back to the primary once it
+// recovers, until stop is closed
+func (s *switcher) monitor(stop <-chan struct{}) {
+	ticker := time.NewTicker(switchCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		s.mu.Lock()
+		primary, active := s.primary, s.active
+		s.mu.Unlock()
+
+		if active != primary {
+			if stalled, healthy := s.status(primary, now); !stalled && healthy >= s.recover {
+				s.failOver(primary, SwitchRecovered)
+				continue
+			}
+		}
+		if stalled, _ := s.status(active, now); !stalled {
+			continue
+		}
+		// the first healthy input after the active one, the primary only comes back after the
+		// recover time
+		for i := 1; i < len(s.inputs); i++ {
+			next := (active + i) % len(s.inputs)
+			if stalled, _ := s.status(next, now); !stalled && next != primary {
+				s.failOver(next, SwitchStalled)
+				break
+			}
+		}
+	}
+}
+
+// status returns whether the input stalled in the switcher or in the linked one, and for how
+// long it has been delivering frames in both
+func (s *switcher) status(index int, now time.Time) (bool, time.Duration) {
+	stalled, healthy := s.inputs[index].status(now)
+
+	s.mu.Lock()
+	linked := s.linked
+	s.mu.Unlock()
+	if linked != nil {
+		linkedStalled, linkedHealthy := linked.inputs[index].status(now)
+		stalled = stalled || linkedStalled
+		if linkedHealthy < healthy {
+			healthy = linkedHealthy
+		}
+	}
+	return stalled, healthy
+}
+
+// failOver sends the input in the switcher and in the linked one
+func (s *switcher) failOver(index int, reason string) {
+	s.setActive(index, reason)()
+
+	s.mu.Lock()
+	linked := s.linked
+	s.mu.Unlock()
+	if linked != nil {
+		linked.setActive(index, reason)()
+	}
+}
+
+// next returns the next item of the active input, it waits for another input when the active
+// one stopped
+func (s *switcher) next() interface{} {
+	for {
+		s.mu.Lock()
+		input, changed := s.inputs[s.active], s.changed
+		s.mu.Unlock()
+
+		select {
+		case item, ok := <-input.queue.items:
+			if ok {
+				return item
+			}
+			<-changed
+		case <-changed:
+		}
+	}
+}
+
+// setActive sends the input from the next frame, the returned function requests the keyframe
+// and emits the event of the switch
+func (s *switcher) setActive(index int, reason string) func() {
+	s.mu.Lock()
+	if index == s.active {
+		s.mu.Unlock()
+		return func() {}
+	}
+	from := s.inputs[s.active]
+	s.active = index
+	input := s.inputs[index]
+	// the queued items were captured while the input was not active
+	for drained := false; !drained; {
+		select {
+		case _, ok := <-input.queue.items:
+			drained = !ok
+		default:
+			drained = true
+		}
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+	onSwitch := s.onSwitch
+	s.mu.Unlock()
+
+	return func() {
+		if onSwitch != nil {
+			onSwitch()
+		}
+		emitSwitchEvent(SwitchEvent{
+			Kind:   kindName(s.kind),
+			From:   from.name,
+			To:     input.name,
+			Reason: reason,
+		})
+	}
+}
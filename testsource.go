@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/wave"
+)
+
+// TestSourceConfig configures the synthetic test sources. The beeps of the tone and the flashes
+// of the picture start at the same wall clock instants, every BeepInterval, so the A/V sync can
+// be measured on the receiving end, and the burned-in timecode gives the glass-to-glass latency.
+type TestSourceConfig struct {
+	// Pattern is "bars" for SMPTE color bars or "moving" for a full frame moving pattern
+	Pattern      string
+	Width        int
+	Height       int
+	FrameRate    int
+	Frequency    float64
+	BeepInterval time.Duration
+	BeepDuration time.Duration
+}
+
+var testSourceOptions = []SourceOption{
+	{"pattern", "bars", "bars for SMPTE color bars or moving for a moving pattern"},
+	{"width", "640", "width of the video"},
+	{"height", "480", "height of the video"},
+	{"fps", "30", "frame rate of the video"},
+	{"frequency", "440", "frequency of the tone in Hz, the beeps are an octave higher"},
+	{"beep-interval", "1s", "time between the beeps and the flashes"},
+	{"beep-duration", "100ms", "duration of the beeps and the flashes"},
+}
+
+func parseTestSourceConfig(uri *SourceURI) (TestSourceConfig, error) {
+	config := TestSourceConfig{Pattern: uri.Option("pattern")}
+	if config.Pattern != "bars" && config.Pattern != "moving" {
+		return config, fmt.Errorf("invalid pattern %s of test input, valid values are bars|moving", config.Pattern)
+	}
+
+	var err error
+	for name, value := range map[string]*int{"width": &config.Width, "height": &config.Height, "fps": &config.FrameRate} {
+		if *value, err = uri.IntOption(name); err != nil {
+			return config, err
+		}
+		if *value <= 0 {
+			return config, fmt.Errorf("invalid %s option %d of test input", name, *value)
+		}
+	}
+	if config.Frequency, err = strconv.ParseFloat(uri.Option("frequency"), 64); err != nil || config.Frequency <= 0 {
+		return config, fmt.Errorf("invalid frequency option %s of test input", uri.Option("frequency"))
+	}
+	if config.BeepInterval, err = time.ParseDuration(uri.Option("beep-interval")); err != nil || config.BeepInterval <= 0 {
+		return config, fmt.Errorf("invalid beep-interval option %s of test input", uri.Option("beep-interval"))
+	}
+	if config.BeepDuration, err = time.ParseDuration(uri.Option("beep-duration")); err != nil || config.BeepDuration < 0 {
+		return config, fmt.Errorf("invalid beep-duration option %s of test input", uri.Option("beep-duration"))
+	}
+
+	return config, nil
+}
+
+// beeping returns whether the beep or flash of the interval is on at the given wall clock time
+func (config TestSourceConfig) beeping(at time.Time) bool {
+	return time.Duration(at.UnixNano())%config.BeepInterval < config.BeepDuration
+}
+
+func getTestVideoTrack(uri *SourceURI, selector *CodecSelector) (mediadevices.Track, error) {
+	config, err := parseTestSourceConfig(uri)
+	if err != nil {
+		return nil, err
+	}
+	return newVideoTrackFromReader(newTestVideoReader(config, selector), selector), nil
+}
+
+func getTestAudioTrack(uri *SourceURI, selector *CodecSelector) (mediadevices.Track, error) {
+	config, err := parseTestSourceConfig(uri)
+	if err != nil {
+		return nil, err
+	}
+	return newAudioTrackFromReader(newTestAudioReader(config, selector), selector), nil
+}
+
+// BT.601 limited range colors of the 75% SMPTE bars
+var smpteBars = [][3]uint8{
+	{180, 128, 128}, // gray
+	{162, 44, 142},  // yellow
+	{131, 156, 44},  // cyan
+	{112, 72, 58},   // green
+	{84, 184, 198},  // magenta
+	{65, 100, 212},  // red
+	{35, 212, 114},  // blue
+}
+
+// the reversed bars of the middle strip
+var smpteCastellations = [][3]uint8{
+	{35, 212, 114},
+	{16, 128, 128},
+	{84, 184, 198},
+	{16, 128, 128},
+	{131, 156, 44},
+	{16, 128, 128},
+	{180, 128, 128},
+}
+
+// newTestVideoReader generates frames at the configured frame rate, timestamped on the media clock
+func newTestVideoReader(config TestSourceConfig, selector *CodecSelector) video.Reader {
+	rect := image.Rect(0, 0, config.Width, config.Height)
+	background := image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+	if config.Pattern == "bars" {
+		drawSMPTEBars(background)
+	}
+
+	frameDuration := time.Second / time.Duration(config.FrameRate)
+	scale := config.Height / 240
+	if scale < 1 {
+		scale = 1
+	}
+
+	var start time.Duration
+	var frames int64
+
+	return video.ReaderFunc(func() (img image.Image, release func(), err error) {
+		if frames == 0 {
+			start = selector.clock.now()
+		}
+		pts := start + time.Duration(frames)*frameDuration
+		if wait := pts - selector.clock.now(); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		frame := image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+		copy(frame.Y, background.Y)
+		copy(frame.Cb, background.Cb)
+		copy(frame.Cr, background.Cr)
+
+		if config.Pattern == "bars" {
+			drawSweep(frame, frames, config.FrameRate)
+		} else {
+			drawMovingPattern(frame, frames)
+		}
+
+		wallTime := selector.clock.wallTime(pts)
+		if config.beeping(wallTime) {
+			// the flash square in the bottom right corner
+			size := config.Height / 6
+			fillRect(frame, image.Rect(config.Width-size, config.Height-size, config.Width, config.Height), 235, 128, 128)
+		}
+
+		// the timecode is centered below the castellations, on a black box for the moving pattern
+		timecode := fmt.Sprintf("%s #%06d", wallTime.UTC().Format("15:04:05.000"), frames)
+		size := textSize(timecode, scale)
+		at := image.Pt((config.Width-size.X)/2, config.Height*3/4+scale*2)
+		fillRect(frame, image.Rectangle{Min: at, Max: at.Add(size)}.Inset(-scale), 16, 128, 128)
+		drawText(frame, timecode, at, scale, 235)
+
+		frames++
+		return WithPresentationTimestamp(frame, pts), func() {}, nil
+	})
+}
+
+// drawSMPTEBars draws the color bars on the top two thirds, the castellations below them and a
+// black band for the timecode at the bottom
+func drawSMPTEBars(frame *image.YCbCr) {
+	width, height := frame.Rect.Dx(), frame.Rect.Dy()
+	barsBottom := height * 2 / 3
+	stripBottom := height * 3 / 4
+
+	for i := range smpteBars {
+		x0, x1 := width*i/len(smpteBars), width*(i+1)/len(smpteBars)
+		bar, castellation := smpteBars[i], smpteCastellations[i]
+		fillRect(frame, image.Rect(x0, 0, x1, barsBottom), bar[0], bar[1], bar[2])
+		fillRect(frame, image.Rect(x0, barsBottom, x1, stripBottom), castellation[0], castellation[1], castellation[2])
+	}
+	fillRect(frame, image.Rect(0, stripBottom, width, height), 16, 128, 128)
+}
+
+// drawSweep moves a white bar along the castellations, one screen width per second
+func drawSweep(frame *image.YCbCr, frames int64, frameRate int) {
+	width, height := frame.Rect.Dx(), frame.Rect.Dy()
+	barWidth := width / 40
+	if barWidth < 2 {
+		barWidth = 2
+	}
+	x := int(frames%int64(frameRate)) * (width - barWidth) / frameRate
+	fillLuma(frame, image.Rect(x, height*2/3, x+barWidth, height*3/4), 235)
+}
+
+// drawMovingPattern draws scrolling diagonal stripes, so any frozen or repeated frame is obvious
+func drawMovingPattern(frame *image.YCbCr, frames int64) {
+	width, height := frame.Rect.Dx(), frame.Rect.Dy()
+	period := width / 8
+	if period < 8 {
+		period = 8
+	}
+	offset := int(frames * 4)
+
+	for y := 0; y < height; y++ {
+		row := frame.YOffset(0, y)
+		for x := 0; x < width; x++ {
+			phase := float64((x+y+offset)%period) / float64(period)
+			frame.Y[row+x] = uint8(16 + 219*(0.5+0.5*math.Sin(2*math.Pi*phase)))
+		}
+	}
+	for i := range frame.Cb {
+		frame.Cb[i] = 128
+		frame.Cr[i] = 128
+	}
+}
+
+const (
+	testAudioSampleRate = 48000
+	testAudioChunk      = 480
+	// amplitudes of the tone and the beeps, -20dBFS and -6dBFS
+	testToneAmplitude = 0.1
+	testBeepAmplitude = 0.5
+)
+
+// newTestAudioReader generates 10ms chunks of the tone in real time, timestamped on the media
+// clock
+func newTestAudioReader(config TestSourceConfig, selector *CodecSelector) audio.Reader {
+	chunkInfo := wave.ChunkInfo{
+		Len:          testAudioChunk,
+		Channels:     1,
+		SamplingRate: testAudioSampleRate,
+	}
+
+	var start time.Duration
+	var samples int64
+	started := false
+
+	return audio.ReaderFunc(func() (chunk wave.Audio, release func(), err error) {
+		if !started {
+			start = selector.clock.now()
+			started = true
+		}
+		pts := start + time.Duration(samples)*time.Second/testAudioSampleRate
+		if wait := pts - selector.clock.now(); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		buffer := wave.NewInt16Interleaved(chunkInfo)
+		for i := range buffer.Data {
+			n := samples + int64(i)
+			t := float64(n) / testAudioSampleRate
+			value := testToneAmplitude * math.Sin(2*math.Pi*config.Frequency*t)
+
+			at := selector.clock.wallTime(start + time.Duration(n)*time.Second/testAudioSampleRate)
+			if config.beeping(at) {
+				value = testBeepAmplitude * math.Sin(2*math.Pi*2*config.Frequency*t)
+			}
+			buffer.Data[i] = int16(value * math.MaxInt16)
+		}
+		samples += testAudioChunk
+
+		return WithAudioPresentationTimestamp(buffer, pts), func() {}, nil
+	})
+}
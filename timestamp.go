@@ -0,0 +1,159 @@
+package main
+
+import (
+	"image"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/wave"
+)
+
+// maxInputClockDrift is how far the timestamps of an input can be from the clock before they are
+// considered a jump
+const maxInputClockDrift = 2 * time.Second
+
+// mediaClock is the shared reference of the presentation timestamps of all the tracks, so the
+// RTP timestamps of audio and video can be mapped to the same wall clock in the sender reports
+type mediaClock struct {
+	once  sync.Once
+	epoch time.Time
+
+	mu        sync.Mutex
+	offset    time.Duration
+	hasOffset bool
+}
+
+// now returns the time elapsed since the clock was first used
+func (clock *mediaClock) now() time.Duration {
+	clock.once.Do(func() {
+		clock.epoch = time.Now()
+	})
+	return time.Since(clock.epoch)
+}
+
+// wallTime returns the wall clock time of a presentation timestamp
+func (clock *mediaClock) wallTime(pts time.Duration) time.Time {
+	clock.now()
+	return clock.epoch.Add(pts)
+}
+
+// fromInput maps a timestamp sent by an input, relative to its own origin, to the clock. All the
+// inputs share the offset of the first timestamp received, so the audio and video sent by the
+// same producer stay in sync. The offset is reset when the timestamps jump, f.e. when the
+// producer restarts.
+func (clock *mediaClock) fromInput(pts time.Duration) time.Duration {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	now := clock.now()
+	if drift := pts + clock.offset - now; !clock.hasOffset || drift > maxInputClockDrift || drift < -maxInputClockDrift {
+		clock.offset = now - pts
+		clock.hasOffset = true
+	}
+	return pts + clock.offset
+}
+
+type timestampedImage struct {
+	image.Image
+	pts    time.Duration
+	filler bool
+}
+
+type timestampedAudio struct {
+	wave.Audio
+	pts    time.Duration
+	filler bool
+}
+
+// WithPresentationTimestamp attaches a presentation timestamp to a video frame. Readers that know
+// the timing of the frames (f.e. from the container or the frame number) should use it, frames
+// without timestamp are timestamped when they are read from the input.
+func WithPresentationTimestamp(img image.Image, pts time.Duration) image.Image {
+	if timestamped, ok := img.(*timestampedImage); ok {
+		img = timestamped.Image
+	}
+	return &timestampedImage{Image: img, pts: pts}
+}
+
+// WithAudioPresentationTimestamp attaches a presentation timestamp to an audio chunk. Chunks
+// without timestamp are timestamped from the number of samples read from the input.
+func WithAudioPresentationTimestamp(chunk wave.Audio, pts time.Duration) wave.Audio {
+	if timestamped, ok := chunk.(*timestampedAudio); ok {
+		chunk = timestamped.Audio
+	}
+	return &timestampedAudio{Audio: chunk, pts: pts}
+}
+
+// withFiller timestamps a frame sent in place of the frames of a disconnected input, so the
+// input can be monitored. The mark is lost when the timestamp is attached again.
+func withFiller(img image.Image, pts time.Duration) image.Image {
+	return &timestampedImage{Image: img, pts: pts, filler: true}
+}
+
+// withAudioFiller timestamps a chunk sent in place of the chunks of a disconnected input
+func withAudioFiller(chunk wave.Audio, pts time.Duration) wave.Audio {
+	return &timestampedAudio{Audio: chunk, pts: pts, filler: true}
+}
+
+// isFiller returns whether the frame or chunk was sent in place of the ones of a disconnected
+// input
+func isFiller(item interface{}) bool {
+	switch item := item.(type) {
+	case *timestampedImage:
+		return item.filler
+	case *timestampedAudio:
+		return item.filler
+	}
+	return false
+}
+
+// splitPresentationTimestamp returns the frame without the timestamp attached to it
+func splitPresentationTimestamp(img image.Image) (image.Image, time.Duration, bool) {
+	if timestamped, ok := img.(*timestampedImage); ok {
+		return timestamped.Image, timestamped.pts, true
+	}
+	return img, 0, false
+}
+
+// splitAudioPresentationTimestamp returns the chunk without the timestamp attached to it
+func splitAudioPresentationTimestamp(chunk wave.Audio) (wave.Audio, time.Duration, bool) {
+	if timestamped, ok := chunk.(*timestampedAudio); ok {
+		return timestamped.Audio, timestamped.pts, true
+	}
+	return chunk, 0, false
+}
+
+// stripPresentationTimestamps removes the timestamps from the frames for the readers that
+// inspect the concrete image type
+func stripPresentationTimestamps(reader video.Reader) video.Reader {
+	return video.ReaderFunc(func() (img image.Image, release func(), err error) {
+		img, release, err = reader.Read()
+		img, _, _ = splitPresentationTimestamp(img)
+		return img, release, err
+	})
+}
+
+// stripAudioPresentationTimestamps removes the timestamps from the chunks for the readers that
+// inspect the concrete chunk type
+func stripAudioPresentationTimestamps(reader audio.Reader) audio.Reader {
+	return audio.ReaderFunc(func() (chunk wave.Audio, release func(), err error) {
+		chunk, release, err = reader.Read()
+		chunk, _, _ = splitAudioPresentationTimestamp(chunk)
+		return chunk, release, err
+	})
+}
+
+// presentationTimestampReader is implemented by the encoded readers that know the presentation
+// timestamp of the last buffer read
+type presentationTimestampReader interface {
+	PresentationTimestamp() time.Duration
+}
+
+// clockTicks converts a presentation timestamp to the clock rate of a codec
+func clockTicks(pts time.Duration, clockRate uint32) uint32 {
+	// RTP timestamps wrap around, so only the lower 32 bits are relevant
+	return uint32(uint64(math.Round(pts.Seconds() * float64(clockRate))))
+}
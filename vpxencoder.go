@@ -0,0 +1,395 @@
+package main
+
+// #cgo pkg-config: vpx
+// #include <stdlib.h>
+// #include <vpx/vpx_encoder.h>
+// #include <vpx/vp8cx.h>
+//
+// static vpx_codec_iface_t *whip_vpx_vp8(void) {
+//   return vpx_codec_vp8_cx();
+// }
+// static vpx_codec_iface_t *whip_vpx_vp9(void) {
+//   return vpx_codec_vp9_cx();
+// }
+//
+// static void *whip_vpx_pkt_buf(const vpx_codec_cx_pkt_t *pkt) {
+//   return pkt->data.frame.buf;
+// }
+// static int whip_vpx_pkt_size(const vpx_codec_cx_pkt_t *pkt) {
+//   return pkt->data.frame.sz;
+// }
+//
+// // vpx_codec_control is a variadic macro, it can't be called from go
+// static vpx_codec_err_t whip_vpx_set_cq_level(vpx_codec_ctx_t *ctx, unsigned int level) {
+//   return vpx_codec_control(ctx, VP8E_SET_CQ_LEVEL, level);
+// }
+// static vpx_codec_err_t whip_vpx_set_cpu_used(vpx_codec_ctx_t *ctx, int cpu_used) {
+//   return vpx_codec_control(ctx, VP8E_SET_CPUUSED, cpu_used);
+// }
+// static vpx_codec_err_t whip_vpx_set_svc(vpx_codec_ctx_t *ctx, vpx_svc_extra_cfg_t *params) {
+//   vpx_codec_err_t err = vpx_codec_control(ctx, VP9E_SET_SVC, 1);
+//   if (err != VPX_CODEC_OK) {
+//     return err;
+//   }
+//   return vpx_codec_control(ctx, VP9E_SET_SVC_PARAMETERS, params);
+// }
+//
+// // the planes of the frame are only referenced during the call
+// static vpx_codec_err_t whip_vpx_encode(vpx_codec_ctx_t *ctx, vpx_image_t *img, vpx_codec_pts_t pts,
+//     unsigned long duration, vpx_enc_frame_flags_t flags, unsigned long deadline,
+//     unsigned char *y, unsigned char *cb, unsigned char *cr, int y_stride, int c_stride) {
+//   unsigned char *planes[3] = {img->planes[0], img->planes[1], img->planes[2]};
+//   int strides[3] = {img->stride[0], img->stride[1], img->stride[2]};
+//   img->planes[0] = y;
+//   img->planes[1] = cb;
+//   img->planes[2] = cr;
+//   img->stride[0] = y_stride;
+//   img->stride[1] = img->stride[2] = c_stride;
+//   vpx_codec_err_t err = vpx_codec_encode(ctx, img, pts, duration, flags, deadline);
+//   for (int i = 0; i < 3; i++) {
+//     img->planes[i] = planes[i];
+//     img->stride[i] = strides[i];
+//   }
+//   return err;
+// }
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/prop"
+)
+
+// vpxParams configures the libvpx VP8 and VP9 encoders. The vpx package of mediadevices doesn't
+// expose the scalability layers of VP9, so the encoders are driven here.
+type vpxParams struct {
+	codec.BaseParams
+	vp9 bool
+	// Deadline is the time given to encode a frame, VPX_DL_REALTIME by default
+	Deadline time.Duration
+	// CPUUsed trades quality for speed, 0 keeps the libvpx default
+	CPUUsed int
+	// RateControl is cbr, vbr or crf with the CRF quantizer, empty for the libvpx default
+	RateControl string
+	CRF         int
+	// TemporalLayers and SpatialLayers are the scalability layers of VP9, 1 for a single layer
+	TemporalLayers int
+	SpatialLayers  int
+}
+
+func newVP8Params() *vpxParams {
+	return &vpxParams{Deadline: time.Microsecond * C.VPX_DL_REALTIME}
+}
+
+func newVP9Params() *vpxParams {
+	return &vpxParams{vp9: true, Deadline: time.Microsecond * C.VPX_DL_REALTIME}
+}
+
+// RTPCodec represents the codec metadata
+func (params *vpxParams) RTPCodec() *codec.RTPCodec {
+	if params.vp9 {
+		return codec.NewRTPVP9Codec(90000)
+	}
+	return codec.NewRTPVP8Codec(90000)
+}
+
+// BuildVideoEncoder builds the encoder of the frames read from r
+func (params *vpxParams) BuildVideoEncoder(r video.Reader, property prop.Media) (codec.ReadCloser, error) {
+	return newVPXEncoder(video.ToI420(r), property, *params)
+}
+
+// layered returns whether the VP9 stream is sent with scalability layers
+func (params vpxParams) layered() bool {
+	return params.vp9 && (params.TemporalLayers > 1 || params.SpatialLayers > 1)
+}
+
+type vpxEncoder struct {
+	params vpxParams
+	iface  *C.vpx_codec_iface_t
+	cfg    *C.vpx_codec_enc_cfg_t
+	ctx    *C.vpx_codec_ctx_t
+	img    *C.vpx_image_t
+	reader video.Reader
+	start  time.Time
+	// last is the timestamp of the last frame encoded, in the 1/1000 timebase of the encoder
+	last          int64
+	forceKeyFrame bool
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newVPXEncoder(r video.Reader, property prop.Media, params vpxParams) (*vpxEncoder, error) {
+	if params.BitRate == 0 {
+		params.BitRate = 100000
+	}
+	if params.KeyFrameInterval == 0 {
+		params.KeyFrameInterval = 60
+	}
+	if params.TemporalLayers == 0 {
+		params.TemporalLayers = 1
+	}
+	if params.SpatialLayers == 0 {
+		params.SpatialLayers = 1
+	}
+
+	iface := C.whip_vpx_vp8()
+	if params.vp9 {
+		iface = C.whip_vpx_vp9()
+	}
+	// the encoder keeps a pointer to its configuration
+	cfg := (*C.vpx_codec_enc_cfg_t)(C.calloc(1, C.sizeof_vpx_codec_enc_cfg_t))
+	if ec := C.vpx_codec_enc_config_default(iface, cfg, 0); ec != C.VPX_CODEC_OK {
+		C.free(unsafe.Pointer(cfg))
+		return nil, fmt.Errorf("vpx_codec_enc_config_default failed (%d)", ec)
+	}
+
+	cfg.g_timebase.num = 1
+	cfg.g_timebase.den = 1000
+	cfg.g_lag_in_frames = 0
+	cfg.g_pass = C.VPX_RC_ONE_PASS
+	cfg.rc_resize_allowed = 0
+	cfg.rc_target_bitrate = C.uint(params.BitRate / 1000)
+	cfg.kf_max_dist = C.uint(params.KeyFrameInterval)
+
+	switch params.RateControl {
+	case "cbr":
+		cfg.rc_end_usage = C.VPX_CBR
+	case "vbr":
+		cfg.rc_end_usage = C.VPX_VBR
+	case "crf":
+		// libvpx has no crf, the constant quality mode with the crf as quality level is the closest
+		cfg.rc_end_usage = C.VPX_Q
+		cfg.rc_min_quantizer = 0
+		cfg.rc_max_quantizer = 63
+	}
+
+	if params.layered() {
+		setVP9Layers(cfg, params)
+	}
+
+	encoder := &vpxEncoder{
+		params: params,
+		iface:  iface,
+		cfg:    cfg,
+		reader: r,
+		start:  time.Now(),
+		last:   -1,
+	}
+	if err := encoder.open(property.Width, property.Height); err != nil {
+		encoder.Close()
+		return nil, err
+	}
+	return encoder, nil
+}
+
+// setVP9Layers configures the temporal and spatial layers, with the bitrate split by
+// svcLayerBitrates. The layers are encoded in one superframe per picture, so the receivers decode
+// all of them.
+func setVP9Layers(cfg *C.vpx_codec_enc_cfg_t, params vpxParams) {
+	spatial, temporal := params.SpatialLayers, params.TemporalLayers
+	cfg.ss_number_layers = C.uint(spatial)
+	cfg.ts_number_layers = C.uint(temporal)
+	// the layers above the base one may be lost without breaking the decoding of the others
+	cfg.g_error_resilient = C.VPX_ERROR_RESILIENT_DEFAULT
+	if params.RateControl == "" {
+		cfg.rc_end_usage = C.VPX_CBR
+	}
+
+	bitrates := svcLayerBitrates(int(cfg.rc_target_bitrate), spatial, temporal)
+	for s := 0; s < spatial; s++ {
+		for t := 0; t < temporal; t++ {
+			bitrate := C.uint(bitrates[s*temporal+t])
+			cfg.layer_target_bitrate[s*temporal+t] = bitrate
+			if t == temporal-1 {
+				cfg.ss_target_bitrate[s] = bitrate
+			}
+			cfg.ts_target_bitrate[t] += bitrate
+		}
+	}
+
+	switch temporal {
+	case 1:
+		cfg.temporal_layering_mode = C.VP9E_TEMPORAL_LAYERING_MODE_NOLAYERING
+		cfg.ts_rate_decimator[0] = 1
+		cfg.ts_periodicity = 1
+	case 2:
+		cfg.temporal_layering_mode = C.VP9E_TEMPORAL_LAYERING_MODE_0101
+		cfg.ts_rate_decimator[0], cfg.ts_rate_decimator[1] = 2, 1
+		cfg.ts_periodicity = 2
+		cfg.ts_layer_id[0], cfg.ts_layer_id[1] = 0, 1
+	case 3:
+		cfg.temporal_layering_mode = C.VP9E_TEMPORAL_LAYERING_MODE_0212
+		cfg.ts_rate_decimator[0], cfg.ts_rate_decimator[1], cfg.ts_rate_decimator[2] = 4, 2, 1
+		cfg.ts_periodicity = 4
+		cfg.ts_layer_id[0], cfg.ts_layer_id[1], cfg.ts_layer_id[2], cfg.ts_layer_id[3] = 0, 2, 1, 2
+	}
+}
+
+// open starts an encoding context for frames of the given size, replacing the current one
+func (encoder *vpxEncoder) open(width int, height int) error {
+	encoder.cfg.g_w, encoder.cfg.g_h = C.uint(width), C.uint(height)
+
+	ctx := (*C.vpx_codec_ctx_t)(C.calloc(1, C.sizeof_vpx_codec_ctx_t))
+	if ec := C.vpx_codec_enc_init_ver(ctx, encoder.iface, encoder.cfg, 0, C.VPX_ENCODER_ABI_VERSION); ec != C.VPX_CODEC_OK {
+		C.free(unsafe.Pointer(ctx))
+		return fmt.Errorf("vpx_codec_enc_init failed (%d)", ec)
+	}
+	if err := encoder.control(ctx); err != nil {
+		C.vpx_codec_destroy(ctx)
+		C.free(unsafe.Pointer(ctx))
+		return err
+	}
+
+	img := C.vpx_img_alloc(nil, C.VPX_IMG_FMT_I420, C.uint(width), C.uint(height), 1)
+	if img == nil {
+		C.vpx_codec_destroy(ctx)
+		C.free(unsafe.Pointer(ctx))
+		return errors.New("vpx_img_alloc failed")
+	}
+
+	encoder.release()
+	encoder.ctx, encoder.img = ctx, img
+	return nil
+}
+
+// control sets the options that are not part of the configuration
+func (encoder *vpxEncoder) control(ctx *C.vpx_codec_ctx_t) error {
+	params := encoder.params
+	if params.CPUUsed != 0 {
+		if ec := C.whip_vpx_set_cpu_used(ctx, C.int(params.CPUUsed)); ec != C.VPX_CODEC_OK {
+			return fmt.Errorf("setting the vpx cpu-used failed (%d)", ec)
+		}
+	}
+	if params.RateControl == "crf" {
+		if ec := C.whip_vpx_set_cq_level(ctx, C.uint(params.CRF)); ec != C.VPX_CODEC_OK {
+			return fmt.Errorf("setting the vpx cq level failed (%d)", ec)
+		}
+	}
+
+	if params.layered() {
+		var svc C.vpx_svc_extra_cfg_t
+		for s := 0; s < params.SpatialLayers; s++ {
+			// each spatial layer is half the size of the one above it
+			svc.scaling_factor_num[s] = C.int(1 << s)
+			svc.scaling_factor_den[s] = C.int(1 << (params.SpatialLayers - 1))
+			// LOOPFILTER_ALL
+			svc.loopfilter_ctrl[s] = 1
+			for t := 0; t < params.TemporalLayers; t++ {
+				svc.max_quantizers[s*params.TemporalLayers+t] = C.int(encoder.cfg.rc_max_quantizer)
+				svc.min_quantizers[s*params.TemporalLayers+t] = C.int(encoder.cfg.rc_min_quantizer)
+			}
+		}
+		if ec := C.whip_vpx_set_svc(ctx, &svc); ec != C.VPX_CODEC_OK {
+			return fmt.Errorf("setting the vp9 layers failed (%d)", ec)
+		}
+	}
+
+	return nil
+}
+
+func (encoder *vpxEncoder) release() {
+	if encoder.ctx != nil {
+		C.vpx_codec_destroy(encoder.ctx)
+		C.free(unsafe.Pointer(encoder.ctx))
+		encoder.ctx = nil
+	}
+	if encoder.img != nil {
+		C.vpx_img_free(encoder.img)
+		encoder.img = nil
+	}
+}
+
+func (encoder *vpxEncoder) Read() ([]byte, func(), error) {
+	// the frame is read without holding the lock, so the keyframe requests don't wait for it
+	img, release, err := encoder.reader.Read()
+	if err != nil {
+		return nil, func() {}, err
+	}
+	defer release()
+	frame := img.(*image.YCbCr)
+
+	encoder.mu.Lock()
+	defer encoder.mu.Unlock()
+
+	if encoder.closed {
+		return nil, func() {}, io.EOF
+	}
+
+	size := frame.Bounds().Size()
+	if C.uint(size.X) != encoder.cfg.g_w || C.uint(size.Y) != encoder.cfg.g_h {
+		if err := encoder.open(size.X, size.Y); err != nil {
+			return nil, func() {}, err
+		}
+	}
+
+	// libvpx doesn't accept frames without duration
+	pts := int64(time.Since(encoder.start) / time.Millisecond)
+	if pts <= encoder.last {
+		pts = encoder.last + 1
+	}
+	duration := pts - encoder.last
+	if encoder.last < 0 {
+		duration = 1
+	}
+	encoder.last = pts
+
+	var flags C.vpx_enc_frame_flags_t
+	if encoder.forceKeyFrame {
+		flags |= C.VPX_EFLAG_FORCE_KF
+		encoder.forceKeyFrame = false
+	}
+	if ec := C.whip_vpx_encode(encoder.ctx, encoder.img, C.vpx_codec_pts_t(pts), C.ulong(duration), flags,
+		C.ulong(encoder.params.Deadline/time.Microsecond),
+		(*C.uchar)(&frame.Y[0]), (*C.uchar)(&frame.Cb[0]), (*C.uchar)(&frame.Cr[0]),
+		C.int(frame.YStride), C.int(frame.CStride)); ec != C.VPX_CODEC_OK {
+		return nil, func() {}, fmt.Errorf("vpx_codec_encode failed (%d)", ec)
+	}
+
+	// the spatial layers of VP9 come in a single superframe
+	var encoded []byte
+	var iter C.vpx_codec_iter_t
+	for {
+		pkt := C.vpx_codec_get_cx_data(encoder.ctx, &iter)
+		if pkt == nil {
+			break
+		}
+		if pkt.kind == C.VPX_CODEC_CX_FRAME_PKT {
+			encoded = append(encoded, C.GoBytes(C.whip_vpx_pkt_buf(pkt), C.whip_vpx_pkt_size(pkt))...)
+		}
+	}
+
+	return encoded, func() {}, nil
+}
+
+func (encoder *vpxEncoder) ForceKeyFrame() error {
+	encoder.mu.Lock()
+	defer encoder.mu.Unlock()
+	encoder.forceKeyFrame = true
+	return nil
+}
+
+func (encoder *vpxEncoder) Controller() codec.EncoderController {
+	return encoder
+}
+
+func (encoder *vpxEncoder) Close() error {
+	encoder.mu.Lock()
+	defer encoder.mu.Unlock()
+
+	if encoder.closed {
+		return nil
+	}
+	encoder.closed = true
+	encoder.release()
+	C.free(unsafe.Pointer(encoder.cfg))
+	return nil
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Matroska element IDs
+const (
+	ebmlHeaderID         = 0x1A45DFA3
+	ebmlVersionID        = 0x4286
+	ebmlReadVersionID    = 0x42F7
+	ebmlMaxIDLengthID    = 0x42F2
+	ebmlMaxSizeLengthID  = 0x42F3
+	ebmlDocTypeID        = 0x4282
+	ebmlDocTypeVersionID = 0x4287
+	ebmlDocTypeReadID    = 0x4285
+	mkvSegmentID         = 0x18538067
+	mkvInfoID            = 0x1549A966
+	mkvTimecodeScaleID   = 0x2AD7B1
+	mkvMuxingAppID       = 0x4D80
+	mkvWritingAppID      = 0x5741
+	mkvTracksID          = 0x1654AE6B
+	mkvTrackEntryID      = 0xAE
+	mkvTrackNumberID     = 0xD7
+	mkvTrackUIDID        = 0x73C5
+	mkvTrackTypeID       = 0x83
+	mkvCodecIDID         = 0x86
+	mkvCodecPrivateID    = 0x63A2
+	mkvCodecDelayID      = 0x56AA
+	mkvSeekPreRollID     = 0x56BB
+	mkvVideoID           = 0xE0
+	mkvPixelWidthID      = 0xB0
+	mkvPixelHeightID     = 0xBA
+	mkvAudioID           = 0xE1
+	mkvSamplingFreqID    = 0xB5
+	mkvChannelsID        = 0x9F
+	mkvClusterID         = 0x1F43B675
+	mkvTimecodeID        = 0xE7
+	mkvSimpleBlockID     = 0xA3
+)
+
+const (
+	// mkvUnknownSize is the size of the segment and the clusters, written as they go
+	mkvUnknownSize = 0x01FFFFFFFFFFFFFF
+	// mkvClusterDuration is the longest cluster, the block timestamps are 16 bit milliseconds
+	// relative to the cluster
+	mkvClusterDuration = 5 * time.Second
+)
+
+const (
+	mkvCodecAVC  = "V_MPEG4/ISO/AVC"
+	mkvCodecAV1  = "V_AV1"
+	mkvCodecOpus = "A_OPUS"
+)
+
+var mkvCodecIDs = map[string]string{
+	strings.ToLower(webrtc.MimeTypeVP8):  "V_VP8",
+	strings.ToLower(webrtc.MimeTypeVP9):  "V_VP9",
+	strings.ToLower(webrtc.MimeTypeAV1):  mkvCodecAV1,
+	strings.ToLower(webrtc.MimeTypeH264): mkvCodecAVC,
+	strings.ToLower(webrtc.MimeTypeOpus): mkvCodecOpus,
+}
+
+// webmWriter muxes the frames of several tracks in a WebM or Matroska file without seek index,
+// the segment and the clusters have unknown size so the file is playable up to the last frame
+// written
+type webmWriter struct {
+	file     *os.File
+	codecIDs []string
+
+	clusterStarted bool
+	clusterStart   time.Duration
+}
+
+// newWebMWriter writes the headers of the tracks, the docType is webm or matroska
+func newWebMWriter(file *os.File, docType string, formats []EncodedFrame) (*webmWriter, error) {
+	w := &webmWriter{file: file}
+
+	header := ebmlElement(ebmlHeaderID, concat(
+		ebmlUint(ebmlVersionID, 1),
+		ebmlUint(ebmlReadVersionID, 1),
+		ebmlUint(ebmlMaxIDLengthID, 4),
+		ebmlUint(ebmlMaxSizeLengthID, 8),
+		ebmlElement(ebmlDocTypeID, []byte(docType)),
+		ebmlUint(ebmlDocTypeVersionID, 4),
+		ebmlUint(ebmlDocTypeReadID, 2),
+	))
+
+	var entries [][]byte
+	for i, format := range formats {
+		codecID, ok := mkvCodecIDs[strings.ToLower(format.MimeType)]
+		// WebM only allows VP8, VP9, AV1 and Opus
+		if !ok || codecID == mkvCodecAVC && docType == "webm" {
+			return nil, fmt.Errorf("%s can't be written to a %s file", format.MimeType, docType)
+		}
+		w.codecIDs = append(w.codecIDs, codecID)
+
+		entry := concat(
+			ebmlUint(mkvTrackNumberID, uint64(i+1)),
+			ebmlUint(mkvTrackUIDID, uint64(i+1)),
+			ebmlElement(mkvCodecIDID, []byte(codecID)),
+		)
+		if strings.HasPrefix(codecID, "V_") {
+			entry = concat(entry,
+				ebmlUint(mkvTrackTypeID, 1),
+				ebmlElement(mkvVideoID, concat(
+					ebmlUint(mkvPixelWidthID, uint64(format.Width)),
+					ebmlUint(mkvPixelHeightID, uint64(format.Height)),
+				)),
+			)
+
+			// the decoder configuration is built from the parameters sent with the keyframes
+			var private []byte
+			var err error
+			switch codecID {
+			case mkvCodecAVC:
+				private, err = avcDecoderConfig(format.Data)
+			case mkvCodecAV1:
+				private, err = av1CodecConfig(format.Data)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if private != nil {
+				entry = concat(entry, ebmlElement(mkvCodecPrivateID, private))
+			}
+		} else {
+			channels := byte(1)
+			if len(format.Data) > 0 && format.Data[0]&0x04 != 0 {
+				channels = 2
+			}
+			entry = concat(entry,
+				ebmlUint(mkvTrackTypeID, 2),
+				ebmlElement(mkvCodecPrivateID, opusHead(channels)),
+				ebmlUint(mkvCodecDelayID, uint64(opusPreSkip*time.Second/48000)),
+				ebmlUint(mkvSeekPreRollID, uint64(80*time.Millisecond)),
+				ebmlElement(mkvAudioID, concat(
+					ebmlFloat(mkvSamplingFreqID, 48000),
+					ebmlUint(mkvChannelsID, uint64(channels)),
+				)),
+			)
+		}
+		entries = append(entries, ebmlElement(mkvTrackEntryID, entry))
+	}
+
+	segment := concat(
+		ebmlID(mkvSegmentID), ebmlSize(mkvUnknownSize),
+		ebmlElement(mkvInfoID, concat(
+			// millisecond timestamps
+			ebmlUint(mkvTimecodeScaleID, uint64(time.Millisecond)),
+			ebmlElement(mkvMuxingAppID, []byte("whip-go")),
+			ebmlElement(mkvWritingAppID, []byte("whip-go")),
+		)),
+		ebmlElement(mkvTracksID, concat(entries...)),
+	)
+
+	if _, err := file.Write(concat(header, segment)); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// write writes a frame in a SimpleBlock, a cluster starts on every video keyframe and at least
+// every mkvClusterDuration
+func (w *webmWriter) write(track int, frame EncodedFrame, timestamp time.Duration) error {
+	relative := (timestamp - w.clusterStart) / time.Millisecond
+	video := strings.HasPrefix(strings.ToLower(frame.MimeType), "video/")
+	newCluster := !w.clusterStarted || video && frame.KeyFrame ||
+		timestamp-w.clusterStart >= mkvClusterDuration || relative < math.MinInt16
+	if newCluster {
+		w.clusterStarted = true
+		w.clusterStart = timestamp
+		relative = 0
+		cluster := concat(
+			ebmlID(mkvClusterID), ebmlSize(mkvUnknownSize),
+			ebmlUint(mkvTimecodeID, uint64(timestamp/time.Millisecond)),
+		)
+		if _, err := w.file.Write(cluster); err != nil {
+			return err
+		}
+	}
+
+	block := make([]byte, 4, 4+len(frame.Data))
+	// track numbers below 127 are a single byte vint
+	block[0] = 0x80 | byte(track+1)
+	binary.BigEndian.PutUint16(block[1:], uint16(int16(relative)))
+	if frame.KeyFrame {
+		block[3] = 0x80
+	}
+	switch w.codecIDs[track] {
+	case mkvCodecAVC:
+		// Matroska stores the NAL units with their length instead of start codes
+		for _, nal := range annexBNALUnits(frame.Data) {
+			block = append(block, byte(len(nal)>>24), byte(len(nal)>>16), byte(len(nal)>>8), byte(len(nal)))
+			block = append(block, nal...)
+		}
+	case mkvCodecAV1:
+		// the blocks don't carry the temporal delimiters
+		for _, obu := range av1OBUs(frame.Data) {
+			if obu.obuType != av1OBUTemporalDelimiter {
+				block = append(block, obu.data...)
+			}
+		}
+	default:
+		block = append(block, frame.Data...)
+	}
+
+	_, err := w.file.Write(ebmlElement(mkvSimpleBlockID, block))
+	return err
+}
+
+func (w *webmWriter) Close() error {
+	return w.file.Close()
+}
+
+func concat(parts ...[]byte) []byte {
+	var data []byte
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+	return data
+}
+
+// ebmlID returns the bytes of an element ID, which include their length marker
+func ebmlID(id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFF:
+		return []byte{byte(id >> 8), byte(id)}
+	}
+	return []byte{byte(id)}
+}
+
+// ebmlSize returns the shortest vint of a size, mkvUnknownSize is written as it is
+func ebmlSize(size uint64) []byte {
+	if size == mkvUnknownSize {
+		return []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	}
+	length := 1
+	// the values with all the bits set are reserved
+	for size >= 1<<(7*uint(length))-1 {
+		length++
+	}
+	data := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		data[i] = byte(size)
+		size >>= 8
+	}
+	data[0] |= 0x80 >> uint(length-1)
+	return data
+}
+
+func ebmlElement(id uint32, data []byte) []byte {
+	return concat(ebmlID(id), ebmlSize(uint64(len(data))), data)
+}
+
+func ebmlUint(id uint32, value uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, value)
+	for len(data) > 1 && data[0] == 0 {
+		data = data[1:]
+	}
+	return ebmlElement(id, data)
+}
+
+func ebmlFloat(id uint32, value float64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, math.Float64bits(value))
+	return ebmlElement(id, data)
+}
+
+// avcDecoderConfig returns the AVCDecoderConfigurationRecord of ISO 14496-15, the CodecPrivate of
+// V_MPEG4/ISO/AVC, built from the SPS and PPS sent with an H.264 keyframe
+func avcDecoderConfig(data []byte) ([]byte, error) {
+	var spss, ppss [][]byte
+	for _, nal := range annexBNALUnits(data) {
+		switch nal[0] & 0x1f {
+		case h264NALSPS:
+			spss = append(spss, nal)
+		case h264NALPPS:
+			ppss = append(ppss, nal)
+		}
+	}
+	if len(spss) == 0 || len(ppss) == 0 || len(spss[0]) < 4 {
+		return nil, errors.New("the H.264 keyframe has no SPS and PPS")
+	}
+	sps := spss[0]
+
+	// version, profile, compatibility, level and 4 byte NAL unit lengths
+	config := []byte{1, sps[1], sps[2], sps[3], 0xfc | 3, 0xe0 | byte(len(spss))}
+	for _, nal := range spss {
+		config = append(config, byte(len(nal)>>8), byte(len(nal)))
+		config = append(config, nal...)
+	}
+	config = append(config, byte(len(ppss)))
+	for _, nal := range ppss {
+		config = append(config, byte(len(nal)>>8), byte(len(nal)))
+		config = append(config, nal...)
+	}
+
+	switch sps[1] {
+	case 100, 110, 122, 144:
+		// the high profiles add the chroma format and the bit depths
+		r := &bitReader{data: unescapeRBSP(sps[4:])}
+		r.expGolomb() // seq_parameter_set_id
+		chromaFormat := r.expGolomb()
+		if chromaFormat == 3 {
+			r.bits(1) // separate_colour_plane_flag
+		}
+		lumaDepth := r.expGolomb()
+		chromaDepth := r.expGolomb()
+		if r.failed {
+			return nil, errors.New("invalid H.264 SPS")
+		}
+		config = append(config, 0xfc|byte(chromaFormat), 0xf8|byte(lumaDepth), 0xf8|byte(chromaDepth), 0)
+	}
+	return config, nil
+}
+
+// unescapeRBSP removes the emulation prevention bytes of a NAL unit
+func unescapeRBSP(data []byte) []byte {
+	rbsp := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// av1CodecConfig returns the AV1CodecConfigurationRecord, the CodecPrivate of V_AV1, built from
+// the sequence header sent with an AV1 keyframe
+func av1CodecConfig(data []byte) ([]byte, error) {
+	for _, obu := range av1OBUs(data) {
+		if obu.obuType != av1OBUSequenceHeader {
+			continue
+		}
+		fields, err := av1SequenceFields(obu.payload)
+		if err != nil {
+			return nil, err
+		}
+		// marker and version 1, the fields, no initial presentation delay, and the sequence
+		// header as the configuration OBU
+		return append([]byte{0x81, fields[0], fields[1], 0}, obu.data...), nil
+	}
+	return nil, errors.New("the AV1 keyframe has no sequence header")
+}
+
+// av1SequenceFields reads the second and third bytes of the AV1CodecConfigurationRecord in a
+// sequence header OBU: the profile and the level, and the tier and the color config
+func av1SequenceFields(payload []byte) ([2]byte, error) {
+	r := &bitReader{data: payload}
+	profile := r.bits(3)
+	r.bits(1) // still_picture
+	reduced := r.bits(1) == 1
+
+	var level, tier uint64
+	if reduced {
+		level = r.bits(5)
+	} else {
+		decoderModelInfo := false
+		var bufferDelayLength uint
+		if r.bits(1) == 1 {
+			// timing_info
+			r.bits(32)
+			r.bits(32)
+			if r.bits(1) == 1 {
+				r.expGolomb()
+			}
+			decoderModelInfo = r.bits(1) == 1
+			if decoderModelInfo {
+				bufferDelayLength = uint(r.bits(5)) + 1
+				r.bits(32)
+				r.bits(10)
+			}
+		}
+		initialDisplayDelay := r.bits(1) == 1
+		operatingPoints := int(r.bits(5)) + 1
+		for i := 0; i < operatingPoints; i++ {
+			r.bits(12) // operating_point_idc
+			opLevel, opTier := r.bits(5), uint64(0)
+			if opLevel > 7 {
+				opTier = r.bits(1)
+			}
+			if decoderModelInfo && r.bits(1) == 1 {
+				r.bits(bufferDelayLength)
+				r.bits(bufferDelayLength)
+				r.bits(1)
+			}
+			if initialDisplayDelay && r.bits(1) == 1 {
+				r.bits(4)
+			}
+			if i == 0 {
+				level, tier = opLevel, opTier
+			}
+		}
+	}
+
+	widthBits, heightBits := uint(r.bits(4))+1, uint(r.bits(4))+1
+	r.bits(widthBits)
+	r.bits(heightBits)
+	if !reduced && r.bits(1) == 1 {
+		// frame id numbers
+		r.bits(7)
+	}
+	r.bits(3) // superblock size, filter intra and intra edge filter
+	if !reduced {
+		r.bits(4) // compound, warped motion and dual filter tools
+		orderHint := r.bits(1) == 1
+		if orderHint {
+			r.bits(2)
+		}
+		screenContentTools := uint64(2)
+		if r.bits(1) == 0 {
+			screenContentTools = r.bits(1)
+		}
+		if screenContentTools > 0 && r.bits(1) == 0 {
+			r.bits(1) // seq_force_integer_mv
+		}
+		if orderHint {
+			r.bits(3)
+		}
+	}
+	r.bits(3) // superres, cdef and restoration
+
+	// color_config
+	highBitDepth := r.bits(1)
+	var twelveBit, mono uint64
+	if profile == 2 && highBitDepth == 1 {
+		twelveBit = r.bits(1)
+	}
+	if profile != 1 {
+		mono = r.bits(1)
+	}
+	primaries, transfer, matrix := uint64(2), uint64(2), uint64(2)
+	if r.bits(1) == 1 {
+		primaries = r.bits(8)
+		transfer = r.bits(8)
+		matrix = r.bits(8)
+	}
+	subsamplingX, subsamplingY, samplePosition := uint64(1), uint64(1), uint64(0)
+	switch {
+	case mono == 1:
+		r.bits(1) // color_range
+	case primaries == 1 && transfer == 13 && matrix == 0:
+		// sRGB
+		subsamplingX, subsamplingY = 0, 0
+	default:
+		r.bits(1) // color_range
+		switch {
+		case profile == 0:
+		case profile == 1:
+			subsamplingX, subsamplingY = 0, 0
+		case twelveBit == 1:
+			subsamplingX, subsamplingY = r.bits(1), 0
+			if subsamplingX == 1 {
+				subsamplingY = r.bits(1)
+			}
+		default:
+			subsamplingY = 0
+		}
+		if subsamplingX == 1 && subsamplingY == 1 {
+			samplePosition = r.bits(2)
+		}
+	}
+	if r.failed {
+		return [2]byte{}, errors.New("invalid AV1 sequence header")
+	}
+
+	return [2]byte{
+		byte(profile<<5 | level),
+		byte(tier<<7 | highBitDepth<<6 | twelveBit<<5 | mono<<4 | subsamplingX<<3 | subsamplingY<<2 | samplePosition),
+	}, nil
+}
+
+// bitReader reads the fields of the H.264 and AV1 headers, most significant bit first. Reading
+// past the end returns zeros and sets failed.
+type bitReader struct {
+	data   []byte
+	offset uint
+	failed bool
+}
+
+func (r *bitReader) bits(n uint) uint64 {
+	var value uint64
+	for i := uint(0); i < n; i++ {
+		index := r.offset / 8
+		if index >= uint(len(r.data)) {
+			r.failed = true
+			return 0
+		}
+		value = value<<1 | uint64(r.data[index]>>(7-r.offset%8)&1)
+		r.offset++
+	}
+	return value
+}
+
+// expGolomb reads an unsigned Exp-Golomb code, the ue(v) of H.264 and the uvlc() of AV1
+func (r *bitReader) expGolomb() uint64 {
+	zeros := uint(0)
+	for r.bits(1) == 0 {
+		if r.failed || zeros == 32 {
+			r.failed = true
+			return 0
+		}
+		zeros++
+	}
+	return r.bits(zeros) + 1<<zeros - 1
+}
@@ -3,29 +3,131 @@ package main
 import (
 	"bytes"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/pion/interceptor"
 	"github.com/pion/mediadevices"
 	"github.com/pion/webrtc/v3"
 )
 
+const (
+	// reconnectMinDelay and reconnectMaxDelay bound the backoff between the publishing attempts
+	// of PublishWithReconnect
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = 30 * time.Second
+	// disconnectedTimeout is the time a disconnected session has to connect again before it fails
+	disconnectedTimeout = 10 * time.Second
+)
+
+// WHIPStatusError is the unexpected status of the response of a WHIP endpoint
+type WHIPStatusError struct {
+	StatusCode int
+}
+
+func (err *WHIPStatusError) Error() string {
+	return fmt.Sprintf("non successful POST: %d", err.StatusCode)
+}
+
+// rejected returns whether the endpoint refuses the request, f.e. an invalid token or endpoint, so
+// retrying it is pointless
+func (err *WHIPStatusError) rejected() bool {
+	return err.StatusCode >= 400 && err.StatusCode < 500 &&
+		err.StatusCode != http.StatusRequestTimeout && err.StatusCode != http.StatusTooManyRequests
+}
+
 type WHIPClient struct {
 	endpoint    string
 	token       string
 	resourceUrl string
+
+	mu     sync.Mutex
+	pc     *webrtc.PeerConnection
+	closed bool
+	// failed receives the failure of the current session
+	failed chan error
+	done   chan struct{}
 }
 
 func NewWHIPClient(endpoint string, token string) *WHIPClient {
 	client := new(WHIPClient)
 	client.endpoint = endpoint
 	client.token = token
+	client.done = make(chan struct{})
 	return client
 }
 
-func (whip *WHIPClient) Publish(stream mediadevices.MediaStream, mediaEngine webrtc.MediaEngine, iceServers []webrtc.ICEServer, skipTlsAuth bool) {
+func (whip *WHIPClient) Publish(stream mediadevices.MediaStream, mediaEngine *webrtc.MediaEngine, interceptorRegistry *interceptor.Registry, iceServers []webrtc.ICEServer, skipTlsAuth bool) {
+	if err := whip.publish(stream, mediaEngine, interceptorRegistry, iceServers, skipTlsAuth); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// PublishWithReconnect publishes the stream in the background and publishes it again when the
+// session fails or stays disconnected for disconnectedTimeout, with a new peer connection
+// configured by setup, until Close. The sessions of different clients fail and reconnect
+// independently. When the endpoint rejects the session with a 4xx status, other than 408 and 429,
+// publishing stops and the returned channel receives the WHIPStatusError, it is closed without
+// error by Close.
+func (whip *WHIPClient) PublishWithReconnect(stream mediadevices.MediaStream, setup func(*webrtc.MediaEngine, *interceptor.Registry) error, iceServers []webrtc.ICEServer, skipTlsAuth bool) <-chan error {
+	stopped := make(chan error, 1)
+	go func() {
+		defer close(stopped)
+		delay := reconnectMinDelay
+		for {
+			mediaEngine := &webrtc.MediaEngine{}
+			interceptorRegistry := &interceptor.Registry{}
+			err := setup(mediaEngine, interceptorRegistry)
+			if err == nil {
+				err = whip.publish(stream, mediaEngine, interceptorRegistry, iceServers, skipTlsAuth)
+			}
+			if err == nil {
+				delay = reconnectMinDelay
+				whip.mu.Lock()
+				failed := whip.failed
+				whip.mu.Unlock()
+				select {
+				case err = <-failed:
+				case <-whip.done:
+					return
+				}
+			}
+			select {
+			case <-whip.done:
+				return
+			default:
+			}
+			var statusErr *WHIPStatusError
+			if errors.As(err, &statusErr) && statusErr.rejected() {
+				whip.teardown(skipTlsAuth)
+				stopped <- fmt.Errorf("publishing to %s rejected: %w", whip.endpoint, err)
+				return
+			}
+			log.Printf("Publishing to %s failed, retrying in %s: %v\n", whip.endpoint, delay, err)
+			whip.teardown(skipTlsAuth)
+
+			select {
+			case <-time.After(delay):
+			case <-whip.done:
+				return
+			}
+			if delay *= 2; delay > reconnectMaxDelay {
+				delay = reconnectMaxDelay
+			}
+		}
+	}()
+	return stopped
+}
+
+// publish starts a session, the failures are returned so each client can retry on its own
+func (whip *WHIPClient) publish(stream mediadevices.MediaStream, mediaEngine *webrtc.MediaEngine, interceptorRegistry *interceptor.Registry, iceServers []webrtc.ICEServer, skipTlsAuth bool) error {
 	config := webrtc.Configuration{
 		ICEServers: iceServers,
 	}
@@ -33,11 +135,22 @@ func (whip *WHIPClient) Publish(stream mediadevices.MediaStream, mediaEngine web
 	// settings.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
 
 	pc, err := webrtc.NewAPI(
-		webrtc.WithMediaEngine(&mediaEngine),
+		webrtc.WithMediaEngine(mediaEngine),
 		webrtc.WithSettingEngine(settings),
+		webrtc.WithInterceptorRegistry(interceptorRegistry),
 	).NewPeerConnection(config)
 	if err != nil {
-		log.Fatal("Unexpected error building the PeerConnection. ", err)
+		return fmt.Errorf("unexpected error building the PeerConnection: %w", err)
+	}
+
+	failed := make(chan error, 1)
+	whip.mu.Lock()
+	closed := whip.closed
+	whip.pc, whip.failed = pc, failed
+	whip.mu.Unlock()
+	if closed {
+		pc.Close()
+		return errors.New("client closed")
 	}
 
 	for _, track := range stream.GetTracks() {
@@ -51,21 +164,42 @@ func (whip *WHIPClient) Publish(stream mediadevices.MediaStream, mediaEngine web
 			},
 		)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("unexpected error adding the %s track: %w", track.ID(), err)
 		}
 	}
 
 	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		log.Printf("PeerConnection State has changed %s \n", connectionState.String())
+		log.Printf("PeerConnection %s State has changed %s \n", whip.endpoint, connectionState.String())
+	})
+	fail := func(err error) {
+		select {
+		case failed <- err:
+		default:
+		}
+	}
+	// changes counts the state changes, so a disconnection only fails if no other change followed
+	var changes int32
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		change := atomic.AddInt32(&changes, 1)
+		switch state {
+		case webrtc.PeerConnectionStateFailed:
+			fail(fmt.Errorf("PeerConnection %s", state))
+		case webrtc.PeerConnectionStateDisconnected:
+			time.AfterFunc(disconnectedTimeout, func() {
+				if atomic.LoadInt32(&changes) == change {
+					fail(fmt.Errorf("PeerConnection %s for %s", state, disconnectedTimeout))
+				}
+			})
+		}
 	})
 
 	offer, err := pc.CreateOffer(nil)
 	if err != nil {
-		log.Fatal("PeerConnection could not create offer. ", err)
+		return fmt.Errorf("PeerConnection could not create offer: %w", err)
 	}
 	err = pc.SetLocalDescription(offer)
 	if err != nil {
-		log.Fatal("PeerConnection could not set local offer. ", err)
+		return fmt.Errorf("PeerConnection could not set local offer: %w", err)
 	}
 
 	// Block until ICE Gathering is complete, disabling trickle ICE
@@ -94,7 +228,7 @@ func (whip *WHIPClient) Publish(stream mediadevices.MediaStream, mediaEngine web
 	}
 	req, err := http.NewRequest("POST", whip.endpoint, bytes.NewBuffer(sdp))
 	if err != nil {
-		log.Fatal("Unexpected error building http request. ", err)
+		return fmt.Errorf("unexpected error building http request: %w", err)
 	}
 
 	req.Header.Add("Content-Type", "application/sdp")
@@ -104,27 +238,32 @@ func (whip *WHIPClient) Publish(stream mediadevices.MediaStream, mediaEngine web
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatal("Failed http POST request. ", err)
+		return fmt.Errorf("failed http POST request: %w", err)
 	}
 
 	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read the answer: %w", err)
+	}
 
 	// log.Println(string(body))
 
 	if resp.StatusCode != 201 {
-		log.Fatalf("Non Successful POST: %d", resp.StatusCode)
+		return &WHIPStatusError{StatusCode: resp.StatusCode}
 	}
 
 	resourceUrl, err := url.Parse(resp.Header.Get("Location"))
 	if err != nil {
-		log.Fatal("Failed to parse resource url. ", err)
+		return fmt.Errorf("failed to parse resource url: %w", err)
 	}
 	base, err := url.Parse(whip.endpoint)
 	if err != nil {
-		log.Fatal("Failed to parse base url. ", err)
+		return fmt.Errorf("failed to parse base url: %w", err)
 	}
+	whip.mu.Lock()
 	whip.resourceUrl = base.ResolveReference(resourceUrl).String()
+	whip.mu.Unlock()
 
 	answer := webrtc.SessionDescription{}
 	answer.Type = webrtc.SDPTypeAnswer
@@ -132,14 +271,43 @@ func (whip *WHIPClient) Publish(stream mediadevices.MediaStream, mediaEngine web
 
 	err = pc.SetRemoteDescription(answer)
 	if err != nil {
-		log.Fatal("PeerConnection could not set remote answer. ", err)
+		return fmt.Errorf("PeerConnection could not set remote answer: %w", err)
 	}
+	return nil
 }
 
+// Close ends the session and stops reconnecting
 func (whip *WHIPClient) Close(skipTlsAuth bool) {
-	req, err := http.NewRequest("DELETE", whip.resourceUrl, nil)
+	whip.mu.Lock()
+	if !whip.closed {
+		whip.closed = true
+		close(whip.done)
+	}
+	whip.mu.Unlock()
+
+	whip.teardown(skipTlsAuth)
+}
+
+// teardown closes the peer connection and deletes the resource of the current session
+func (whip *WHIPClient) teardown(skipTlsAuth bool) {
+	whip.mu.Lock()
+	pc, resourceUrl := whip.pc, whip.resourceUrl
+	whip.pc, whip.resourceUrl = nil, ""
+	whip.mu.Unlock()
+
+	if pc != nil {
+		if err := pc.Close(); err != nil {
+			log.Println("PeerConnection close failed. ", err)
+		}
+	}
+	if resourceUrl == "" {
+		return
+	}
+
+	req, err := http.NewRequest("DELETE", resourceUrl, nil)
 	if err != nil {
-		log.Fatal("Unexpected error building http request. ", err)
+		log.Println("Unexpected error building http request. ", err)
+		return
 	}
 	if whip.token != "" {
 		req.Header.Add("Authorization", "Bearer "+whip.token)
@@ -152,8 +320,10 @@ func (whip *WHIPClient) Close(skipTlsAuth bool) {
 			},
 		},
 	}
-	_, err = client.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatal("Failed http DELETE request. ", err)
+		log.Println("Failed http DELETE request. ", err)
+		return
 	}
+	resp.Body.Close()
 }
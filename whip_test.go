@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/mediadevices"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestPublishWithReconnect(t *testing.T) {
+	tests := []struct {
+		status int
+		// rejected is whether publishing stops at the first response
+		rejected bool
+	}{
+		{http.StatusUnauthorized, true},
+		{http.StatusForbidden, true},
+		{http.StatusNotFound, true},
+		{http.StatusTooManyRequests, false},
+		{http.StatusServiceUnavailable, false},
+	}
+	for _, test := range tests {
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.WriteHeader(test.status)
+		}))
+		stream, err := mediadevices.NewMediaStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		setup := func(*webrtc.MediaEngine, *interceptor.Registry) error { return nil }
+
+		client := NewWHIPClient(server.URL, "token")
+		stopped := client.PublishWithReconnect(stream, setup, nil, false)
+		select {
+		case err := <-stopped:
+			if !test.rejected || err == nil {
+				t.Errorf("%d: stopped publishing with %v", test.status, err)
+			}
+		case <-time.After(reconnectMinDelay + 2*time.Second):
+			if test.rejected {
+				t.Errorf("%d: still publishing", test.status)
+			}
+		}
+		if got := atomic.LoadInt32(&requests); test.rejected && got != 1 || !test.rejected && got < 2 {
+			t.Errorf("%d: got %d requests", test.status, got)
+		}
+
+		client.Close(false)
+		if err, ok := <-stopped; ok && !test.rejected {
+			t.Errorf("%d: stopped publishing with %v after Close", test.status, err)
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+// #cgo pkg-config: x264
+// #include <stdint.h>
+// #include <stdlib.h>
+// #include <x264.h>
+//
+// typedef struct whip_x264 {
+//   x264_t *h;
+//   x264_picture_t pic;
+// } whip_x264;
+//
+// // x264_encoder_open is a macro, it can't be called from go
+// static whip_x264 *whip_x264_open(x264_param_t *param) {
+//   whip_x264 *e = calloc(1, sizeof(whip_x264));
+//   e->h = x264_encoder_open(param);
+//   if (!e->h) {
+//     free(e);
+//     return NULL;
+//   }
+//   x264_picture_init(&e->pic);
+//   e->pic.img.i_csp = X264_CSP_I420;
+//   e->pic.img.i_plane = 3;
+//   return e;
+// }
+//
+// // the planes of the frame are only referenced during the call. The payloads of the NAL units
+// // follow each other in memory, the first one is set in payload.
+// static int whip_x264_encode(whip_x264 *e, uint8_t *y, uint8_t *cb, uint8_t *cr, int y_stride,
+//     int c_stride, int64_t pts, int keyframe, uint8_t **payload) {
+//   x264_nal_t *nal;
+//   int i_nal;
+//   x264_picture_t pic_out;
+//   e->pic.img.plane[0] = y;
+//   e->pic.img.plane[1] = cb;
+//   e->pic.img.plane[2] = cr;
+//   e->pic.img.i_stride[0] = y_stride;
+//   e->pic.img.i_stride[1] = e->pic.img.i_stride[2] = c_stride;
+//   e->pic.i_pts = pts;
+//   e->pic.i_type = keyframe ? X264_TYPE_IDR : X264_TYPE_AUTO;
+//   int size = x264_encoder_encode(e->h, &nal, &i_nal, &e->pic, &pic_out);
+//   for (int i = 0; i < 3; i++) {
+//     e->pic.img.plane[i] = NULL;
+//   }
+//   if (size > 0) {
+//     *payload = nal[0].p_payload;
+//   }
+//   return size;
+// }
+//
+// static void whip_x264_close(whip_x264 *e) {
+//   x264_encoder_close(e->h);
+//   free(e);
+// }
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/prop"
+)
+
+var x264Presets = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow", "placebo"}
+
+var x264Tunes = []string{"film", "animation", "grain", "stillimage", "psnr", "ssim", "fastdecode", "zerolatency"}
+
+// x264ProfileLevelIDs are the profile-level-id signaled for each profile, with level 3.1
+var x264ProfileLevelIDs = map[string]string{
+	"baseline": "42e01f",
+	"main":     "4d001f",
+	"high":     "64001f",
+}
+
+// x264Params configures the libx264 H.264 encoder. The x264 package of mediadevices only exposes
+// the preset, so the encoder is driven here.
+type x264Params struct {
+	codec.BaseParams
+	Preset string
+	// Tune is a comma separated list of x264 tunes, zerolatency is always added
+	Tune string
+	// Profile is baseline, main or high, empty for high signaled as constrained baseline like the
+	// mediadevices encoder
+	Profile string
+	// RateControl is cbr, vbr or crf with the CRF quality, empty for the x264 average bitrate
+	RateControl string
+	CRF         int
+}
+
+func newX264Params() *x264Params {
+	return &x264Params{Preset: "ultrafast"}
+}
+
+// RTPCodec represents the codec metadata
+func (params *x264Params) RTPCodec() *codec.RTPCodec {
+	rtpCodec := codec.NewRTPH264Codec(90000)
+	if id, ok := x264ProfileLevelIDs[params.Profile]; ok {
+		rtpCodec.SDPFmtpLine = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + id
+	}
+	return rtpCodec
+}
+
+// BuildVideoEncoder builds the encoder of the frames read from r
+func (params *x264Params) BuildVideoEncoder(r video.Reader, property prop.Media) (codec.ReadCloser, error) {
+	return newX264Encoder(video.ToI420(r), property, *params)
+}
+
+type x264Encoder struct {
+	params   x264Params
+	property prop.Media
+	engine   *C.whip_x264
+	reader   video.Reader
+	start    time.Time
+	// last is the timestamp of the last frame encoded, in the 1/1000 timebase of the encoder
+	last          int64
+	forceKeyFrame bool
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newX264Encoder(r video.Reader, property prop.Media, params x264Params) (*x264Encoder, error) {
+	if params.BitRate == 0 {
+		params.BitRate = 100000
+	}
+	if params.KeyFrameInterval == 0 {
+		params.KeyFrameInterval = 60
+	}
+	if params.Preset == "" {
+		params.Preset = "ultrafast"
+	}
+
+	encoder := &x264Encoder{
+		params:   params,
+		property: property,
+		reader:   r,
+		start:    time.Now(),
+		last:     -1,
+	}
+	if err := encoder.open(property.Width, property.Height); err != nil {
+		return nil, err
+	}
+	return encoder, nil
+}
+
+// open starts an encoder for frames of the given size, replacing the current one
+func (encoder *x264Encoder) open(width int, height int) error {
+	params := encoder.params
+
+	// the frames are sent as soon as they are encoded
+	tune := "zerolatency"
+	if params.Tune != "" && !strings.Contains(params.Tune, "zerolatency") {
+		tune = params.Tune + "," + tune
+	}
+	cPreset, cTune := C.CString(params.Preset), C.CString(tune)
+	defer C.free(unsafe.Pointer(cPreset))
+	defer C.free(unsafe.Pointer(cTune))
+
+	var param C.x264_param_t
+	if C.x264_param_default_preset(&param, cPreset, cTune) < 0 {
+		return fmt.Errorf("invalid x264 preset %s or tune %s", params.Preset, tune)
+	}
+
+	param.i_csp = C.X264_CSP_I420
+	param.i_width, param.i_height = C.int(width), C.int(height)
+	param.i_fps_num, param.i_fps_den = 30, 1
+	if encoder.property.FrameRate > 0 {
+		param.i_fps_num = C.uint32_t(encoder.property.FrameRate)
+	}
+	param.i_keyint_max = C.int(params.KeyFrameInterval)
+	// the frames are timestamped with the time they are encoded at
+	param.b_vfr_input = 1
+	param.i_timebase_num, param.i_timebase_den = 1, 1000
+	// for streaming
+	param.b_repeat_headers = 1
+	param.b_annexb = 1
+
+	bitrate := C.int(params.BitRate / 1000)
+	param.rc.i_bitrate = bitrate
+	switch params.RateControl {
+	case "":
+		param.rc.i_rc_method = C.X264_RC_ABR
+		param.rc.i_vbv_max_bitrate = bitrate
+		param.rc.i_vbv_buffer_size = bitrate * 2
+	case "cbr":
+		param.rc.i_rc_method = C.X264_RC_ABR
+		param.rc.i_vbv_max_bitrate = bitrate
+		param.rc.i_vbv_buffer_size = bitrate
+	case "vbr":
+		param.rc.i_rc_method = C.X264_RC_ABR
+		param.rc.i_vbv_max_bitrate = bitrate * 2
+		param.rc.i_vbv_buffer_size = bitrate * 2
+	case "crf":
+		// the quality is constant up to the bitrate
+		param.rc.i_rc_method = C.X264_RC_CRF
+		param.rc.f_rf_constant = C.float(params.CRF)
+		param.rc.i_vbv_max_bitrate = bitrate
+		param.rc.i_vbv_buffer_size = bitrate * 2
+	}
+
+	profile := params.Profile
+	if profile == "" {
+		profile = "high"
+	}
+	cProfile := C.CString(profile)
+	defer C.free(unsafe.Pointer(cProfile))
+	if C.x264_param_apply_profile(&param, cProfile) < 0 {
+		return fmt.Errorf("invalid x264 profile %s", profile)
+	}
+
+	engine := C.whip_x264_open(&param)
+	if engine == nil {
+		return fmt.Errorf("x264_encoder_open failed")
+	}
+
+	encoder.release()
+	encoder.engine = engine
+	return nil
+}
+
+func (encoder *x264Encoder) release() {
+	if encoder.engine != nil {
+		C.whip_x264_close(encoder.engine)
+		encoder.engine = nil
+	}
+}
+
+func (encoder *x264Encoder) Read() ([]byte, func(), error) {
+	// the frame is read without holding the lock, so the keyframe requests don't wait for it
+	img, release, err := encoder.reader.Read()
+	if err != nil {
+		return nil, func() {}, err
+	}
+	defer release()
+	frame := img.(*image.YCbCr)
+
+	encoder.mu.Lock()
+	defer encoder.mu.Unlock()
+
+	if encoder.closed {
+		return nil, func() {}, io.EOF
+	}
+
+	size := frame.Bounds().Size()
+	if size != encoder.size() {
+		if err := encoder.open(size.X, size.Y); err != nil {
+			return nil, func() {}, err
+		}
+		encoder.property.Width, encoder.property.Height = size.X, size.Y
+	}
+
+	// x264 needs strictly increasing timestamps
+	pts := int64(time.Since(encoder.start) / time.Millisecond)
+	if pts <= encoder.last {
+		pts = encoder.last + 1
+	}
+	encoder.last = pts
+
+	keyFrame := C.int(0)
+	if encoder.forceKeyFrame {
+		keyFrame = 1
+		encoder.forceKeyFrame = false
+	}
+	var payload *C.uint8_t
+	n := C.whip_x264_encode(encoder.engine,
+		(*C.uint8_t)(&frame.Y[0]), (*C.uint8_t)(&frame.Cb[0]), (*C.uint8_t)(&frame.Cr[0]),
+		C.int(frame.YStride), C.int(frame.CStride), C.int64_t(pts), keyFrame, &payload)
+	if n < 0 {
+		return nil, func() {}, fmt.Errorf("x264_encoder_encode failed (%d)", n)
+	}
+	if n == 0 {
+		return nil, func() {}, nil
+	}
+
+	return C.GoBytes(unsafe.Pointer(payload), n), func() {}, nil
+}
+
+func (encoder *x264Encoder) size() image.Point {
+	return image.Point{X: encoder.property.Width, Y: encoder.property.Height}
+}
+
+func (encoder *x264Encoder) ForceKeyFrame() error {
+	encoder.mu.Lock()
+	defer encoder.mu.Unlock()
+	encoder.forceKeyFrame = true
+	return nil
+}
+
+func (encoder *x264Encoder) Controller() codec.EncoderController {
+	return encoder
+}
+
+func (encoder *x264Encoder) Close() error {
+	encoder.mu.Lock()
+	defer encoder.mu.Unlock()
+
+	if encoder.closed {
+		return nil
+	}
+	encoder.closed = true
+	encoder.release()
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/io/video"
+)
+
+func init() {
+	RegisterSource("y4m", SourceFactory{
+		Description: "YUV4MPEG2 4:2:0 video file sent at its frame rate, f.e. y4m:/tmp/video.y4m",
+		Kinds:       videoKinds,
+		Options: []SourceOption{
+			{"loop", "false", "start again from the beginning at the end of the file"},
+		},
+		NewTrack: func(uri *SourceURI, kind mediadevices.MediaDeviceType, selector *CodecSelector) (mediadevices.Track, error) {
+			loop, err := uri.BoolOption("loop")
+			if err != nil {
+				return nil, err
+			}
+			reader, err := newY4MReader(uri.Path, loop, selector)
+			if err != nil {
+				return nil, err
+			}
+			return newVideoTrackFromReader(reader, selector), nil
+		},
+	})
+}
+
+// y4mHeader is the stream header of a YUV4MPEG2 file
+type y4mHeader struct {
+	width         int
+	height        int
+	frameDuration time.Duration
+}
+
+// readY4MHeader parses the stream header, f.e. "YUV4MPEG2 W1280 H720 F30:1 Ip A1:1 C420jpeg"
+func readY4MHeader(reader *bufio.Reader) (*y4mHeader, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != "YUV4MPEG2" {
+		return nil, errors.New("invalid y4m stream header")
+	}
+
+	header := &y4mHeader{frameDuration: time.Second / 30}
+	for _, field := range fields[1:] {
+		value := field[1:]
+		switch field[0] {
+		case 'W':
+			header.width, err = strconv.Atoi(value)
+		case 'H':
+			header.height, err = strconv.Atoi(value)
+		case 'F':
+			var num, den int
+			if _, err = fmt.Sscanf(value, "%d:%d", &num, &den); err == nil && num > 0 && den > 0 {
+				header.frameDuration = time.Duration(den) * time.Second / time.Duration(num)
+			}
+		case 'C':
+			if !strings.HasPrefix(value, "420") {
+				return nil, fmt.Errorf("unsupported y4m colorspace %s, only 4:2:0 is supported", value)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid y4m header field %s", field)
+		}
+	}
+
+	if header.width <= 0 || header.height <= 0 {
+		return nil, errors.New("invalid y4m frame size")
+	}
+	return header, nil
+}
+
+// newY4MReader reads the frames of a YUV4MPEG2 file at the frame rate of the file
+func newY4MReader(path string, loop bool, selector *CodecSelector) (video.Reader, error) {
+	var file *os.File
+	var reader *bufio.Reader
+	var header *y4mHeader
+
+	open := func() error {
+		if file != nil {
+			file.Close()
+		}
+
+		var err error
+		file, err = os.Open(path)
+		if err != nil {
+			return err
+		}
+		reader = bufio.NewReader(file)
+		header, err = readY4MHeader(reader)
+		return err
+	}
+	if err := open(); err != nil {
+		return nil, err
+	}
+
+	var start time.Duration
+	var frames int64
+
+	return video.ReaderFunc(func() (img image.Image, release func(), err error) {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && loop {
+			if err = open(); err == nil {
+				line, err = reader.ReadString('\n')
+			}
+		}
+		if err != nil {
+			return nil, func() {}, err
+		}
+		if !strings.HasPrefix(line, "FRAME") {
+			return nil, func() {}, errors.New("invalid y4m frame header")
+		}
+
+		yuv := image.NewYCbCr(image.Rect(0, 0, header.width, header.height), image.YCbCrSubsampleRatio420)
+		for _, plane := range [][]byte{yuv.Y, yuv.Cb, yuv.Cr} {
+			if _, err := io.ReadFull(reader, plane); err != nil {
+				return nil, func() {}, err
+			}
+		}
+
+		// files are read much faster than real time, so the frames are sent at their timestamps
+		if frames == 0 {
+			start = selector.clock.now()
+		}
+		pts := start + time.Duration(frames)*header.frameDuration
+		frames++
+		if wait := pts - selector.clock.now(); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		return WithPresentationTimestamp(yuv, pts), func() {}, nil
+	}), nil
+}